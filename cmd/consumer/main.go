@@ -11,25 +11,70 @@ import (
 	"github.com/message-streaming-app/internal/message"
 	"github.com/message-streaming-app/internal/protocol"
 	"github.com/message-streaming-app/internal/storage"
+	"github.com/message-streaming-app/internal/tlsconfig"
 )
 
 func main() {
 	logger := common.GetLogger()
 	addr := common.GetEnv("BROKER_ADDR", "localhost:9080")
+	topic := common.GetEnv("TOPIC", "")
+	group := common.GetEnv("CONSUMER_GROUP", "")
+	consumerID := common.GetEnv("CONSUMER_ID", "")
+	slowPolicy := common.GetEnv("SLOW_CONSUMER_POLICY", "")
+	filterExpr := common.GetEnv("CONSUMER_FILTER", "")
 
-	conn, err := net.Dial("tcp", addr)
+	// Dial over TLS if BROKER_TLS is set, presenting a client certificate if the broker requires one
+	tlsCfg, err := tlsconfig.ClientConfigFromEnv(logger)
+	if err != nil {
+		logger.Error("failed to load broker TLS settings", "error", err)
+		panic("failed to load broker TLS settings: " + err.Error())
+	}
+	conn, err := tlsconfig.Dial(addr, tlsCfg)
 	if err != nil {
 		logger.Error("dial(%v): %v", "addr", addr, "error", err)
 	}
 	defer conn.Close()
 
-	// Identify as consumer
-	if _, err := conn.Write([]byte("CONSUMER\n")); err != nil {
+	// Identify as consumer, optionally subscribing to a named topic.
+	// Manual acks let the broker redeliver messages that never reached MongoDB.
+	hs := protocol.Handshake{
+		Role:    "CONSUMER",
+		Topic:   topic,
+		Options: map[string]string{protocol.OptionAck: protocol.AckManual},
+	}
+	// Replicas sharing a group split the stream between them
+	if group != "" {
+		hs.Options[protocol.OptionGroup] = group
+	}
+	// With an ID the broker replays the topic from our last committed offset instead
+	if consumerID != "" {
+		hs.Options[protocol.OptionConsumerID] = consumerID
+	}
+	// Overrides what the broker does when we fall behind a broadcast topic
+	if slowPolicy != "" {
+		hs.Options[protocol.OptionSlowConsumer] = slowPolicy
+	}
+	// The broker only sends us messages that match the filter
+	if filterExpr != "" {
+		hs.Options[protocol.OptionFilter] = filterExpr
+	}
+	// A broker that requires authentication answers our credentials before delivering anything
+	creds := brokerCredentials()
+	hs.SetCredentials(creds)
+	if _, err := conn.Write([]byte(hs.String())); err != nil {
 		logger.Error(fmt.Sprintf("write role: %v", err.Error()))
 		panic("failed to identify as consumer: " + err.Error())
 	}
+	if creds.Mechanism != "" {
+		identity, err := protocol.ReadAuthResult(conn)
+		if err != nil {
+			logger.Error("failed to authenticate with the broker", "error", err)
+			panic("failed to authenticate with the broker: " + err.Error())
+		}
+		logger.Info("authenticated with the broker", "identity", identity)
+	}
 
-	logger.Info(fmt.Sprintf("Connected as consumer to %s", addr))
+	logger.Info(fmt.Sprintf("Connected as consumer to %s", addr), "topic", topic, "group", group, "consumer_id", consumerID, "filter", filterExpr)
 
 	// Initialize MongoDB storage
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -60,18 +105,71 @@ func main() {
 		}
 		buf = body
 
+		frame, err := protocol.DecodeTypedFrame(body)
+		if err == nil && frame.Type == protocol.FrameGoAway {
+			// Every delivery before it was flushed to us; a restart reconnects to a live broker
+			logger.Info("broker is going away", "reason", string(frame.Body))
+			return
+		}
+		if err == nil && frame.Type == protocol.FrameError {
+			// The broker refused us, e.g. because it requires credentials we did not send
+			logger.Error("broker refused the connection", "reason", string(frame.Body))
+			return
+		}
+		if err != nil || frame.Type != protocol.FrameDeliver {
+			logger.Error("unexpected frame from broker", "error", err)
+			continue
+		}
+
+		// Replaying consumers commit the offset in the tag; the others ack the delivery tag
+		done := protocol.FrameAck
+		if consumerID != "" {
+			done = protocol.FrameCommit
+		}
+
 		var msg message.Message
-		if err := json.Unmarshal(body, &msg); err != nil {
+		if err := json.Unmarshal(frame.Body, &msg); err != nil {
+			// Redelivery cannot fix malformed JSON; nacking it leaves it in the dead-letter topic for
+			// inspection. A replaying consumer also commits past it, as nacks do not move its offset.
 			logger.Error("invalid JSON: %v", "error", err)
+			sendAck(conn, protocol.FrameNack, frame.Tag, "invalid JSON: "+err.Error())
+			if consumerID != "" {
+				sendAck(conn, done, frame.Tag, "")
+			}
 			continue
 		}
 		logger.Debug("[notification] id=%s type=%s ts=%s payload=%s", msg.ID, msg.Type, msg.Timestamp.Format("15:04:05"), string(msg.Payload))
 
-		// Store message in MongoDB (unmarshal handled by store)
+		// Store message in MongoDB (unmarshal handled by store); only ack once it is persisted
 		if err := mongoStore.StoreMessage(msg); err != nil {
 			logger.Error("failed to store message in MongoDB: %v", "error", err)
-			// Continue processing even if MongoDB store fails
+			if consumerID != "" {
+				// There is no redelivery when replaying; stop so the restart resumes from the last commit
+				return
+			}
+			sendAck(conn, protocol.FrameNack, frame.Tag, err.Error())
 			continue
 		}
+		sendAck(conn, done, frame.Tag, "")
+	}
+}
+
+// sendAck acknowledges (FrameAck), rejects (FrameNack) or commits (FrameCommit) a delivery
+func sendAck(conn net.Conn, typ protocol.FrameType, tag uint64, reason string) {
+	frame := protocol.TypedFrame{Type: typ, Tag: tag, Body: []byte(reason)}
+	if err := protocol.WriteFrame(conn, protocol.EncodeTypedFrame(frame)); err != nil {
+		common.GetLogger().Error("failed to send ack", "type", typ.String(), "tag", tag, "error", err)
+	}
+}
+
+// brokerCredentials returns the credentials for a broker that requires authentication:
+// BROKER_TOKEN, or else BROKER_USERNAME and BROKER_PASSWORD. Without either it returns none.
+func brokerCredentials() protocol.Credentials {
+	if token := common.GetEnv("BROKER_TOKEN", ""); token != "" {
+		return protocol.TokenCredentials(token)
+	}
+	if username := common.GetEnv("BROKER_USERNAME", ""); username != "" {
+		return protocol.PlainCredentials(username, common.GetEnv("BROKER_PASSWORD", ""))
 	}
+	return protocol.Credentials{}
 }
@@ -2,29 +2,24 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
-)
 
-func startHTTPServer(port string, logger *slog.Logger) *http.Server {
-	// Start HTTP server for health checks// Start HTTP health server for k8s probes
-	mux := http.NewServeMux()
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprint(w, `{"status":"ok"}`)
-	})
-	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprint(w, `{"status":"ready"}`)
-	})
+	"github.com/message-streaming-app/internal/broker"
+)
 
+// startHTTPServer serves the broker's HTTP endpoints (see newHTTPHandler) on port
+func startHTTPServer(port string, b *broker.Broker, adminToken string, logger *slog.Logger) *http.Server {
 	srvHTTP := &http.Server{
 		Addr:    ":" + port,
-		Handler: mux,
+		Handler: newHTTPHandler(b, adminToken, logger),
 	}
 
 	go func() {
@@ -35,6 +30,144 @@ func startHTTPServer(port string, logger *slog.Logger) *http.Server {
 	}()
 	return srvHTTP
 }
+
+// newHTTPHandler routes the health, stats, Prometheus metrics, dead-letter and admin endpoints. When adminToken
+// is set, the dead-letter and /admin endpoints require it as a bearer token. Without it they are open, except
+// disconnect and purge, which are not served at all.
+func newHTTPHandler(b *broker.Broker, adminToken string, logger *slog.Logger) http.Handler {
+	// Start HTTP health server for k8s probes
+	mux := http.NewServeMux()
+	if adminToken == "" {
+		logger.Warn("ADMIN_TOKEN is not set: disconnect and purge are disabled, and dead letters and clients can be listed and re-driven by anyone who reaches the HTTP port")
+	}
+	// handleMutating registers an admin endpoint that changes the broker's state, only when a token protects it
+	handleMutating := func(pattern string, handler http.HandlerFunc) {
+		if adminToken != "" {
+			mux.Handle(pattern, requireToken(adminToken, handler))
+		}
+	}
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, b.Liveness())
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, b.Readiness())
+	})
+	mux.HandleFunc("GET /consumers", func(w http.ResponseWriter, r *http.Request) {
+		stats, err := b.BroadcastConsumerStats(r.URL.Query().Get("topic"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"consumers": stats})
+	})
+	mux.Handle("GET /metrics", b.Metrics().Handler())
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"topics": b.Stats()})
+	})
+	mux.Handle("GET /dead-letters", requireToken(adminToken, func(w http.ResponseWriter, r *http.Request) {
+		limit, err := queryInt(r, "limit", 100)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		letters, pending, err := b.DeadLetters(r.URL.Query().Get("topic"), limit)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"pending": pending, "dead_letters": letters})
+	}))
+	mux.Handle("POST /dead-letters/redrive", requireToken(adminToken, func(w http.ResponseWriter, r *http.Request) {
+		limit, err := queryInt(r, "max", 0)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		n, err := b.RedriveDeadLetters(r.URL.Query().Get("topic"), limit)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"redriven": n})
+	}))
+	mux.Handle("GET /admin/clients", requireToken(adminToken, func(w http.ResponseWriter, r *http.Request) {
+		role, topic := r.URL.Query().Get("role"), r.URL.Query().Get("topic")
+		clients := []broker.ClientInfo{}
+		for _, c := range b.Clients() {
+			if (role == "" || c.Role == role) && (topic == "" || c.Topic == topic) {
+				clients = append(clients, c)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"clients": clients})
+	}))
+	handleMutating("POST /admin/clients/disconnect", func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		if err := b.DisconnectClient(id); err != nil {
+			writeJSONError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"disconnected": id})
+	})
+	handleMutating("POST /admin/queues/purge", func(w http.ResponseWriter, r *http.Request) {
+		n, err := b.PurgeQueue(r.URL.Query().Get("topic"), r.URL.Query().Get("group"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+	})
+	return mux
+}
+
+// writeHealth writes a probe report, with 503 if a check failed
+func writeHealth(w http.ResponseWriter, report broker.HealthReport) {
+	status := http.StatusOK
+	if !report.OK() {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+// requireToken rejects requests without "Authorization: Bearer <token>"; an empty token disables the check
+func requireToken(token string, next http.HandlerFunc) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, errors.New("missing or invalid admin token"))
+			return
+		}
+		next(w, r)
+	})
+}
+
+// queryInt reads an integer query parameter, returning def when it is absent
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return n, nil
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError writes err as a JSON error response
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
 func shutdownHTTPServer(srv *http.Server, logger *slog.Logger) {
 	// shutdown HTTP server
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
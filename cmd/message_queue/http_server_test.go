@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/message-streaming-app/internal/broker"
+)
+
+// newTestHTTPServer serves the HTTP endpoints of a broker with a queue-mode "jobs" topic
+func newTestHTTPServer(t *testing.T, adminToken string) *httptest.Server {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := broker.NewBroker(broker.Queue, logger)
+	t.Cleanup(func() { _ = b.Close() })
+	if err := b.CreateTopic("jobs", broker.TopicConfig{Mode: broker.ModeOf(broker.Queue)}); err != nil {
+		t.Fatalf("CreateTopic: %v", err)
+	}
+	srv := httptest.NewServer(newHTTPHandler(b, adminToken, logger))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// request sends a request with an optional bearer token and returns the response
+func request(t *testing.T, srv *httptest.Server, method, path, token string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// adminRoutes are the endpoints behind ADMIN_TOKEN, with the status they answer an authorized request with
+var adminRoutes = []struct {
+	method, path string
+	status       int
+	mutating     bool
+}{
+	{http.MethodGet, "/dead-letters?topic=jobs", http.StatusOK, false},
+	{http.MethodPost, "/dead-letters/redrive?topic=jobs", http.StatusOK, false},
+	{http.MethodGet, "/admin/clients", http.StatusOK, false},
+	{http.MethodPost, "/admin/clients/disconnect?id=unknown", http.StatusNotFound, true},
+	{http.MethodPost, "/admin/queues/purge?topic=jobs", http.StatusOK, true},
+}
+
+func TestHTTPAdminToken(t *testing.T) {
+	srv := newTestHTTPServer(t, "s3cret")
+	for _, r := range adminRoutes {
+		if resp := request(t, srv, r.method, r.path, ""); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s %s without a token: expected 401, got %d", r.method, r.path, resp.StatusCode)
+		}
+		if resp := request(t, srv, r.method, r.path, "wrong"); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s %s with a wrong token: expected 401, got %d", r.method, r.path, resp.StatusCode)
+		}
+		if resp := request(t, srv, r.method, r.path, "s3cret"); resp.StatusCode != r.status {
+			t.Errorf("%s %s with the token: expected %d, got %d", r.method, r.path, r.status, resp.StatusCode)
+		}
+	}
+	if resp := request(t, srv, http.MethodGet, "/stats", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected /stats to stay open, got %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPWithoutAdminToken(t *testing.T) {
+	srv := newTestHTTPServer(t, "")
+	for _, r := range adminRoutes {
+		resp := request(t, srv, r.method, r.path, "")
+		// Unregistered routes get the mux's plain-text 404; registered ones answer in JSON
+		registered := resp.Header.Get("Content-Type") == "application/json"
+		if registered == r.mutating {
+			t.Errorf("%s %s: expected registered=%v without a token", r.method, r.path, !r.mutating)
+		}
+		if registered && resp.StatusCode != r.status {
+			t.Errorf("%s %s: expected %d, got %d", r.method, r.path, r.status, resp.StatusCode)
+		}
+	}
+}
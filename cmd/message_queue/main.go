@@ -1,7 +1,8 @@
 package main
 
 import (
-	"errors"
+	"context"
+	"crypto/tls"
 	"log/slog"
 	"net"
 	"os"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/message-streaming-app/internal/broker"
 	"github.com/message-streaming-app/internal/common"
+	"github.com/message-streaming-app/internal/tlsconfig"
 )
 
 func main() {
@@ -21,20 +23,103 @@ func main() {
 	// Get configuration from environment
 	deliveryModeStr := strings.ToLower(common.GetEnv("DELIVERY_MODE", "broadcast"))
 	deliveryMode := broker.ParseDeliveryMode(deliveryModeStr)
+	configPath := common.GetEnv("BROKER_CONFIG", "")
 	tcpAddr := common.GetEnv("TCP_PORT", "9080")
 	httpPort := common.GetEnv("HTTP_PORT", "8080")
+	adminToken := common.GetEnv("ADMIN_TOKEN", "")
+	// How long a shutdown waits for consumers to receive what is buffered for them
+	drainTimeout := time.Duration(common.GetEnvInt("DRAIN_TIMEOUT_SECONDS", 10)) * time.Second
 
-	// Create broker
-	srv := broker.NewBroker(deliveryMode, logger)
+	// DELIVERY_MODE is the default for topics not declared in the optional config file
+	cfg := broker.Config{
+		DefaultMode: deliveryMode,
+		AckTimeout:  time.Duration(common.GetEnvInt("ACK_TIMEOUT_SECONDS", 30)) * time.Second,
+		// Failed deliveries before a message moves to the topic's dead-letter topic; -1 disables
+		MaxDeliveryAttempts: common.GetEnvInt("MAX_DELIVERY_ATTEMPTS", 5),
+		ProducerCredits:     common.GetEnvInt("PRODUCER_CREDITS", 256),
+		SlowConsumer: broker.SlowConsumerConfig{
+			BlockTimeoutMs: common.GetEnvInt("SLOW_CONSUMER_BLOCK_TIMEOUT_MS", 100),
+		},
+		// Message IDs are remembered for the window to drop resent messages; -1 disables
+		Dedup: broker.DedupConfig{
+			WindowMs:   common.GetEnvInt("DEDUP_WINDOW_MS", 120000),
+			MaxEntries: common.GetEnvInt("DEDUP_MAX_ENTRIES", 100000),
+		},
+		// TTL of messages that carry none, for topics without their own; 0 keeps them forever
+		MessageTTLMs:      int64(common.GetEnvInt("DEFAULT_MESSAGE_TTL_MS", 0)),
+		DeadLetterExpired: common.GetEnv("DEAD_LETTER_EXPIRED", "false") == "true",
+		// Readiness fails while a queue is this full (percent of max messages); -1 disables
+		Health: broker.HealthConfig{
+			HighWaterPercent: common.GetEnvInt("READY_HIGH_WATER_PERCENT", 90),
+			CheckTimeout:     time.Duration(common.GetEnvInt("HEALTH_CHECK_TIMEOUT_MS", 2000)) * time.Millisecond,
+		},
+		Storage: broker.StorageConfig{
+			Type:              strings.ToLower(common.GetEnv("STORAGE_TYPE", broker.StorageMemory)),
+			Dir:               common.GetEnv("STORAGE_DIR", "data/queues"),
+			RetentionMessages: common.GetEnvInt("RETENTION_MESSAGES", 10000),
+		},
+	}
+	if err := cfg.Storage.Fsync.UnmarshalText([]byte(strings.ToLower(common.GetEnv("FSYNC_POLICY", "interval")))); err != nil {
+		logger.Error("invalid FSYNC_POLICY", "error", err)
+		os.Exit(1)
+	}
+	if err := cfg.SlowConsumer.Policy.UnmarshalText([]byte(strings.ToLower(common.GetEnv("SLOW_CONSUMER_POLICY", "drop-newest")))); err != nil {
+		logger.Error("invalid SLOW_CONSUMER_POLICY", "error", err)
+		os.Exit(1)
+	}
+	if configPath != "" {
+		loaded, err := broker.LoadConfigFile(configPath, cfg)
+		if err != nil {
+			logger.Error("failed to load broker config", "path", configPath, "error", err)
+			os.Exit(1)
+		}
+		cfg = loaded
+	}
+	// With a credentials file, producers and consumers must authenticate in their handshake
+	authFile := common.GetEnv("AUTH_CREDENTIALS_FILE", "")
+	if authFile != "" {
+		auth, err := broker.LoadCredentialsFile(authFile)
+		if err != nil {
+			logger.Error("failed to load credentials", "path", authFile, "error", err)
+			os.Exit(1)
+		}
+		cfg.Authenticator = auth
+	}
+	if err := cfg.Validate(); err != nil {
+		logger.Error("invalid broker config", "error", err)
+		os.Exit(1)
+	}
 
-	// Start listening
+	// Create broker. The HTTP server starts first so probes answer, not ready, while persisted
+	// queues are reopened.
+	srv := broker.NewBrokerWithConfig(cfg, logger)
+	srvHTTP := startHTTPServer(httpPort, srv, adminToken, logger)
+	if err := srv.RecoverTopics(); err != nil {
+		logger.Error("failed to recover persisted topics", "dir", cfg.Storage.Dir, "error", err)
+		os.Exit(1)
+	}
+
+	// Start listening, over TLS if a certificate is configured; a client CA also requires client certificates
 	ln, err := net.Listen("tcp", ":"+tcpAddr)
 	if err != nil {
 		logger.Error("failed to listen", "addr", tcpAddr, "error", err)
 		os.Exit(1)
 	}
-	logger.Info("broker started successfully", "addr", tcpAddr, "delivery_mode", deliveryMode.String())
-	srvHTTP := startHTTPServer(httpPort, logger)
+	tlsOpts := tlsconfig.ServerOptions{
+		CertFile:       common.GetEnv("TLS_CERT_FILE", ""),
+		KeyFile:        common.GetEnv("TLS_KEY_FILE", ""),
+		ClientCAFile:   common.GetEnv("TLS_CLIENT_CA_FILE", ""),
+		ReloadInterval: time.Duration(common.GetEnvInt("TLS_RELOAD_INTERVAL_SECONDS", 10)) * time.Second,
+	}
+	if tlsOpts.CertFile != "" {
+		tlsCfg, err := tlsconfig.NewServerConfig(tlsOpts, logger)
+		if err != nil {
+			logger.Error("failed to load TLS certificate", "cert_file", tlsOpts.CertFile, "error", err)
+			os.Exit(1)
+		}
+		ln = tls.NewListener(ln, tlsCfg)
+	}
+	logger.Info("broker started successfully", "addr", tcpAddr, "default_delivery_mode", cfg.DefaultMode.String(), "configured_topics", len(cfg.Topics), "storage", cfg.Storage.Type, "tls", tlsOpts.CertFile != "", "client_certificates", tlsOpts.CertFile != "" && tlsOpts.ClientCAFile != "", "authentication", authFile != "")
 
 	// Handle graceful shutdown
 	stop := make(chan os.Signal, 1)
@@ -43,36 +128,29 @@ func main() {
 	// Accept loop runs in a goroutine so we can signal shutdown
 	acceptErrCh := make(chan error, 1)
 	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				// If listener closed, exit accept loop
-				if errors.Is(err, net.ErrClosed) {
-					acceptErrCh <- nil
-					return
-				}
-				logger.Error("failed to accept connection", "error", err)
-				continue
-			}
-			logger.Info("accepted connection", "remote_addr", conn.RemoteAddr())
-			go srv.HandleConn(conn)
-		}
+		acceptErrCh <- srv.Serve(ln)
 	}()
 
 	<-stop
 	logger.Info("shutting down")
 
-	// Stop accepting new connections
+	// Report not ready, then stop accepting new connections
+	srv.BeginShutdown()
 	_ = ln.Close()
+	<-acceptErrCh
 
-	// Shutdown HTTP server gracefully
-	shutdownHTTPServer(srvHTTP, logger)
+	// Stop reading producers, flush consumers and send going-away frames within the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warn("broker did not drain before the deadline", "drain_timeout", drainTimeout, "error", err)
+	}
+	cancel()
 
 	// Close broker internals
 	_ = srv.Close()
 
-	// wait briefly for ongoing handlers to finish
-	time.Sleep(1 * time.Second)
+	// Shutdown HTTP server gracefully
+	shutdownHTTPServer(srvHTTP, logger)
 
 	logger.Info("shutdown complete")
 }
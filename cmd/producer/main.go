@@ -3,11 +3,14 @@ package main
 import (
 	"fmt"
 	"log/slog"
-	"net"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/message-streaming-app/internal/common"
 	"github.com/message-streaming-app/internal/producer"
+	"github.com/message-streaming-app/internal/protocol"
+	"github.com/message-streaming-app/internal/tlsconfig"
 )
 
 func main() {
@@ -19,10 +22,16 @@ func main() {
 
 	// Get configuration from environment
 	brokerAddr := envReader.Get("BROKER_ADDR", "localhost:9080")
+	topic := envReader.Get("TOPIC", "")
 	csvPath := envReader.Get("CSV_PATH", filepath.Join("../../", "internal", "data", "dcgm_metrics_20250718_134233.csv"))
 
-	// Establish connection to broker
-	conn, err := net.Dial("tcp", brokerAddr)
+	// Establish connection to broker, over TLS if BROKER_TLS is set
+	tlsCfg, err := tlsconfig.ClientConfigFromEnv(logger)
+	if err != nil {
+		logger.Error("failed to load broker TLS settings", "error", err)
+		os.Exit(1)
+	}
+	conn, err := tlsconfig.Dial(brokerAddr, tlsCfg)
 	if err != nil {
 		logger.Error("failed to connect to broker", "addr", brokerAddr, "error", err)
 		os.Exit(1)
@@ -38,7 +47,25 @@ func main() {
 	logger.Info("csv path resolved successfully", "csv_path", absCSVPath)
 
 	// Create producer
-	prod := producer.NewProducer(conn, logger)
+	// Flow control makes the broker slow the CSV replay down instead of dropping rows,
+	// and confirms report the rows the broker could not store
+	opts := []producer.Option{producer.WithTopic(topic)}
+	if envReader.Get("FLOW_CONTROL", "true") == "true" {
+		opts = append(opts, producer.WithFlowControl())
+	}
+	if envReader.Get("CONFIRMS", "true") == "true" {
+		opts = append(opts, producer.WithConfirms())
+	}
+	if ttlMs := common.GetEnvInt("MESSAGE_TTL_MS", 0); ttlMs > 0 {
+		opts = append(opts, producer.WithTTL(time.Duration(ttlMs)*time.Millisecond))
+	}
+	if column := envReader.Get("PARTITION_KEY_COLUMN", "uuid"); column != "" {
+		opts = append(opts, producer.WithPartitionKeyColumn(column))
+	}
+	if creds := brokerCredentials(envReader); creds.Mechanism != "" {
+		opts = append(opts, producer.WithCredentials(creds))
+	}
+	prod := producer.NewProducer(conn, logger, opts...)
 
 	// Start producer
 	if err := prod.Start(); err != nil {
@@ -61,3 +88,15 @@ func main() {
 
 	logger.Info("Producer shutdown complete", "rows_processed", rowCount)
 }
+
+// brokerCredentials returns the credentials for a broker that requires authentication:
+// BROKER_TOKEN, or else BROKER_USERNAME and BROKER_PASSWORD. Without either it returns none.
+func brokerCredentials(envReader *producer.SimpleEnvironmentReader) protocol.Credentials {
+	if token := envReader.Get("BROKER_TOKEN", ""); token != "" {
+		return protocol.TokenCredentials(token)
+	}
+	if username := envReader.Get("BROKER_USERNAME", ""); username != "" {
+		return protocol.PlainCredentials(username, envReader.Get("BROKER_PASSWORD", ""))
+	}
+	return protocol.Credentials{}
+}
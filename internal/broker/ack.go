@@ -0,0 +1,235 @@
+package broker
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/message-streaming-app/internal/common"
+	"github.com/message-streaming-app/internal/filter"
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+// defaultAckTimeout is used when Config.AckTimeout is not set
+const defaultAckTimeout = 30 * time.Second
+
+// consumerOptions holds the per-connection settings a consumer negotiated in its handshake
+type consumerOptions struct {
+	manualAck bool
+	prefetch  int
+	// group is the consumer group to join; empty means the topic's own delivery mode applies
+	group string
+	// from makes the consumer replay the topic log from this position; nil means live delivery only
+	from *startPosition
+	// id names a replaying consumer so its committed offset is remembered across connections
+	id string
+	// slowPolicy overrides the broker's slow consumer policy for broadcast delivery; nil keeps the default
+	slowPolicy *SlowConsumerPolicy
+	// blockTimeoutMs overrides the broker's block timeout; 0 keeps the default
+	blockTimeoutMs int
+	// filter skips messages that do not match it; nil delivers everything
+	filter *filter.Filter
+}
+
+// parseConsumerOptions validates the consumer-specific handshake options
+func parseConsumerOptions(hs protocol.Handshake) (consumerOptions, error) {
+	opts := consumerOptions{
+		prefetch: common.GetEnvInt("CONSUMER_PREFETCH", 100),
+	}
+
+	switch ack := hs.Option(protocol.OptionAck, protocol.AckAuto); ack {
+	case protocol.AckAuto:
+	case protocol.AckManual:
+		opts.manualAck = true
+	default:
+		return consumerOptions{}, fmt.Errorf("unknown ack mode %q", ack)
+	}
+
+	if v := hs.Option(protocol.OptionPrefetch, ""); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return consumerOptions{}, fmt.Errorf("invalid prefetch %q", v)
+		}
+		opts.prefetch = n
+	}
+
+	if g := hs.Option(protocol.OptionGroup, ""); g != "" {
+		if err := validateGroupName(g); err != nil {
+			return consumerOptions{}, err
+		}
+		opts.group = g
+	}
+
+	if v := hs.Option(protocol.OptionFrom, ""); v != "" {
+		if opts.group != "" {
+			return consumerOptions{}, fmt.Errorf("%s and %s cannot be combined", protocol.OptionFrom, protocol.OptionGroup)
+		}
+		pos, err := parseStartPosition(v)
+		if err != nil {
+			return consumerOptions{}, err
+		}
+		opts.from = &pos
+	}
+
+	if id := hs.Option(protocol.OptionConsumerID, ""); id != "" {
+		if opts.group != "" {
+			return consumerOptions{}, fmt.Errorf("%s and %s cannot be combined", protocol.OptionConsumerID, protocol.OptionGroup)
+		}
+		if err := validateConsumerID(id); err != nil {
+			return consumerOptions{}, err
+		}
+		opts.id = id
+	}
+
+	if v := hs.Option(protocol.OptionSlowConsumer, ""); v != "" {
+		var policy SlowConsumerPolicy
+		if err := policy.UnmarshalText([]byte(v)); err != nil {
+			return consumerOptions{}, err
+		}
+		opts.slowPolicy = &policy
+	}
+
+	if v := hs.Option(protocol.OptionBlockTimeout, ""); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return consumerOptions{}, fmt.Errorf("invalid %s %q", protocol.OptionBlockTimeout, v)
+		}
+		opts.blockTimeoutMs = n
+	}
+
+	if v := hs.Option(protocol.OptionFilter, ""); v != "" {
+		if opts.group != "" {
+			return consumerOptions{}, fmt.Errorf("%s and %s cannot be combined", protocol.OptionFilter, protocol.OptionGroup)
+		}
+		f, err := filter.Parse(v)
+		if err != nil {
+			return consumerOptions{}, err
+		}
+		opts.filter = f
+	}
+	return opts, nil
+}
+
+// matches reports whether a message passes the consumer's filter
+func (o consumerOptions) matches(msg []byte) bool {
+	return o.filter == nil || o.filter.Match(msg)
+}
+
+// inflightMessage is a delivery waiting for an ack
+type inflightMessage struct {
+	msg      []byte
+	deadline time.Time
+}
+
+// inflightTracker keeps messages delivered to one consumer until they are acknowledged
+type inflightTracker struct {
+	mu      sync.Mutex
+	pending map[uint64]inflightMessage
+}
+
+// newInflightTracker creates an empty tracker
+func newInflightTracker() *inflightTracker {
+	return &inflightTracker{
+		pending: make(map[uint64]inflightMessage),
+	}
+}
+
+// add records a delivery awaiting an ack
+func (t *inflightTracker) add(tag uint64, msg []byte, deadline time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[tag] = inflightMessage{msg: msg, deadline: deadline}
+}
+
+// remove forgets a delivery and returns the delivered message
+func (t *inflightTracker) remove(tag uint64) ([]byte, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m, ok := t.pending[tag]
+	if !ok {
+		return nil, false
+	}
+	delete(t.pending, tag)
+	return m.msg, true
+}
+
+// expired removes and returns deliveries whose ack deadline is before now
+func (t *inflightTracker) expired(now time.Time) [][]byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var msgs [][]byte
+	for tag, m := range t.pending {
+		if m.deadline.Before(now) {
+			delete(t.pending, tag)
+			msgs = append(msgs, m.msg)
+		}
+	}
+	return msgs
+}
+
+// drain removes and returns every pending delivery, in the order they were delivered
+func (t *inflightTracker) drain() [][]byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tags := slices.Sorted(maps.Keys(t.pending))
+	msgs := make([][]byte, 0, len(tags))
+	for _, tag := range tags {
+		msgs = append(msgs, t.pending[tag].msg)
+		delete(t.pending, tag)
+	}
+	return msgs
+}
+
+// len returns the number of unacknowledged deliveries
+func (t *inflightTracker) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pending)
+}
+
+// readAcks processes ack/nack frames sent by a consumer until the connection fails, which is how
+// the broker notices a consumer disconnect. Settled deliveries free a slot on c; nacked ones are
+// retried or dead-lettered first. A nil tracker discards all frames.
+func (b *Broker) readAcks(topicName string, tracker *inflightTracker, c *queueConsumer, reader FrameReader) {
+	buf := make([]byte, 0, 1024)
+	for {
+		body, err := reader.ReadFrame(buf)
+		if err != nil {
+			if err != io.EOF {
+				b.logger.Debug("consumer read error", "topic", topicName, "error", err)
+			}
+			return
+		}
+		if tracker == nil {
+			continue
+		}
+
+		f, err := protocol.DecodeTypedFrame(body)
+		if err != nil {
+			b.logger.Warn("invalid frame from consumer", "topic", topicName, "error", err)
+			continue
+		}
+		switch f.Type {
+		case protocol.FrameAck:
+			msg, ok := tracker.remove(f.Tag)
+			if !ok {
+				b.logger.Debug("ack for unknown delivery tag", "topic", topicName, "tag", f.Tag)
+				continue
+			}
+			c.d.settled(msg)
+			c.release(msg)
+		case protocol.FrameNack:
+			if msg, ok := tracker.remove(f.Tag); ok {
+				b.logger.Warn("delivery rejected by consumer", "topic", topicName, "tag", f.Tag, "reason", string(f.Body))
+				c.d.retry(msg, string(f.Body))
+				c.release(msg)
+			}
+		default:
+			b.logger.Warn("unexpected frame from consumer", "topic", topicName, "type", f.Type.String())
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package broker
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+// connectPipe runs HandleConn on one end of an in-memory pipe and sends the handshake on the other
+func connectPipe(t *testing.T, b *Broker, handshake string) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	go b.HandleConn(server)
+	if _, err := client.Write([]byte(handshake)); err != nil {
+		t.Fatalf("write handshake: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// readTyped reads one typed frame from a client connection
+func readTyped(t *testing.T, conn net.Conn) protocol.TypedFrame {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	body, err := protocol.ReadFrame(conn, nil)
+	if err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	f, err := protocol.DecodeTypedFrame(body)
+	if err != nil {
+		t.Fatalf("decode frame: %v", err)
+	}
+	return f
+}
+
+// sendTyped writes one typed frame from a client connection
+func sendTyped(t *testing.T, conn net.Conn, f protocol.TypedFrame) {
+	t.Helper()
+	if err := protocol.WriteFrame(conn, protocol.EncodeTypedFrame(f)); err != nil {
+		t.Fatalf("write frame: %v", err)
+	}
+}
+
+// waitFor polls cond until it holds or the timeout expires
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestParseConsumerOptions(t *testing.T) {
+	opts, err := parseConsumerOptions(protocol.Handshake{Role: roleConsumer})
+	if err != nil || opts.manualAck || opts.prefetch <= 0 {
+		t.Fatalf("unexpected defaults: %+v (err=%v)", opts, err)
+	}
+
+	hs, _ := protocol.ParseHandshake("CONSUMER storage ack=manual prefetch=5")
+	opts, err = parseConsumerOptions(hs)
+	if err != nil || !opts.manualAck || opts.prefetch != 5 {
+		t.Fatalf("unexpected options: %+v (err=%v)", opts, err)
+	}
+
+	hs, _ = protocol.ParseHandshake("CONSUMER telemetry slow=block block_timeout_ms=250")
+	opts, err = parseConsumerOptions(hs)
+	if err != nil || opts.slowPolicy == nil || *opts.slowPolicy != SlowConsumerBlock || opts.blockTimeoutMs != 250 {
+		t.Fatalf("unexpected slow consumer options: %+v (err=%v)", opts, err)
+	}
+
+	for _, line := range []string{"CONSUMER ack=sometimes", "CONSUMER prefetch=0", "CONSUMER prefetch=x", "CONSUMER slow=sometimes", "CONSUMER block_timeout_ms=0"} {
+		hs, _ := protocol.ParseHandshake(line)
+		if _, err := parseConsumerOptions(hs); err == nil {
+			t.Errorf("%q: expected error", line)
+		}
+	}
+}
+
+func TestInflightTracker(t *testing.T) {
+	tracker := newInflightTracker()
+
+	now := time.Now()
+	tracker.add(1, []byte("a"), now.Add(-time.Second))
+	tracker.add(2, []byte("b"), now.Add(time.Hour))
+	tracker.add(3, []byte("c"), now.Add(time.Hour))
+
+	expired := tracker.expired(now)
+	if len(expired) != 1 || string(expired[0]) != "a" {
+		t.Fatalf("expected delivery 1 to expire, got %q", expired)
+	}
+	if msg, ok := tracker.remove(2); !ok || string(msg) != "b" {
+		t.Fatalf("expected to remove delivery 2, got %q", msg)
+	}
+	if _, ok := tracker.remove(2); ok {
+		t.Fatal("expected second remove to fail")
+	}
+	if rest := tracker.drain(); len(rest) != 1 || string(rest[0]) != "c" {
+		t.Fatalf("expected drain to return delivery 3, got %q", rest)
+	}
+	if tracker.len() != 0 {
+		t.Fatalf("expected tracker to be empty")
+	}
+}
+
+func TestQueueConsumerAckRemovesMessage(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Queue, logger)
+	q := mustTopic(t, b, "storage").queue
+	_ = q.Enqueue([]byte("m1"))
+	_ = q.Enqueue([]byte("m2"))
+
+	conn := connectPipe(t, b, "CONSUMER storage ack=manual prefetch=1\n")
+
+	f := readTyped(t, conn)
+	if f.Type != protocol.FrameDeliver || string(f.Body) != "m1" {
+		t.Fatalf("expected delivery of m1, got %+v", f)
+	}
+	sendTyped(t, conn, protocol.TypedFrame{Type: protocol.FrameAck, Tag: f.Tag})
+
+	// prefetch=1 means m2 only arrives once m1 was acked
+	f = readTyped(t, conn)
+	if string(f.Body) != "m2" {
+		t.Fatalf("expected delivery of m2, got %q", f.Body)
+	}
+	sendTyped(t, conn, protocol.TypedFrame{Type: protocol.FrameAck, Tag: f.Tag})
+
+	time.Sleep(20 * time.Millisecond)
+	if q.Len() != 0 {
+		t.Fatalf("expected acked messages to be gone, queue has %d", q.Len())
+	}
+}
+
+func TestQueueConsumerNackRedelivers(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Queue, logger)
+	_ = mustTopic(t, b, "storage").queue.Enqueue([]byte("m1"))
+
+	conn := connectPipe(t, b, "CONSUMER storage ack=manual prefetch=1\n")
+
+	first := readTyped(t, conn)
+	sendTyped(t, conn, protocol.TypedFrame{Type: protocol.FrameNack, Tag: first.Tag, Body: []byte("mongo down")})
+
+	second := readTyped(t, conn)
+	if string(second.Body) != "m1" || second.Tag == first.Tag {
+		t.Fatalf("expected m1 redelivered with a new tag, got %+v", second)
+	}
+}
+
+func TestQueueConsumerNackOnFullQueue(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBrokerWithConfig(Config{DefaultMode: Queue, Storage: StorageConfig{MaxMessages: 2}}, logger)
+	q := mustTopic(t, b, "storage").queue
+	_ = q.Enqueue([]byte("m0"))
+
+	conn := connectPipe(t, b, "CONSUMER storage ack=manual prefetch=1\n")
+	first := readTyped(t, conn)
+
+	// Producers refill the queue while m0 is in flight, so its requeue does not fit
+	_ = q.Enqueue([]byte("m1"))
+	_ = q.Enqueue([]byte("m2"))
+	if !q.IsFull() {
+		t.Fatal("expected the queue to be full")
+	}
+	sendTyped(t, conn, protocol.TypedFrame{Type: protocol.FrameNack, Tag: first.Tag, Body: []byte("mongo down")})
+
+	for _, want := range []string{"m0", "m1", "m2"} {
+		f := readTyped(t, conn)
+		if string(f.Body) != want {
+			t.Fatalf("expected %s, got %q", want, f.Body)
+		}
+		sendTyped(t, conn, protocol.TypedFrame{Type: protocol.FrameAck, Tag: f.Tag})
+	}
+}
+
+func TestQueueConsumerDisconnectRequeuesUnacked(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Queue, logger)
+	q := mustTopic(t, b, "storage").queue
+	_ = q.Enqueue([]byte("m1"))
+
+	conn := connectPipe(t, b, "CONSUMER storage ack=manual\n")
+	readTyped(t, conn)
+	if q.Len() != 0 {
+		t.Fatalf("expected message to be in flight")
+	}
+
+	conn.Close()
+	waitFor(t, func() bool { return q.Len() == 1 })
+
+	msg, _ := q.Dequeue()
+	if string(msg) != "m1" {
+		t.Fatalf("expected m1 requeued, got %q", msg)
+	}
+}
+
+func TestQueueConsumerAckTimeoutRedelivers(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBrokerWithConfig(Config{DefaultMode: Queue, AckTimeout: 20 * time.Millisecond}, logger)
+	_ = mustTopic(t, b, "storage").queue.Enqueue([]byte("m1"))
+
+	conn := connectPipe(t, b, "CONSUMER storage ack=manual prefetch=1\n")
+
+	first := readTyped(t, conn)
+	second := readTyped(t, conn)
+	if string(second.Body) != "m1" || second.Tag == first.Tag {
+		t.Fatalf("expected m1 redelivered after ack timeout, got %+v", second)
+	}
+}
+
+func TestBroadcastConsumerManualAckUsesTypedFrames(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Broadcast, logger)
+	tp := mustTopic(t, b, "telemetry")
+
+	conn := connectPipe(t, b, "CONSUMER telemetry ack=manual\n")
+	waitFor(t, func() bool { return tp.registry.GetConsumerCount() == 1 })
+
+	_ = tp.registry.BroadcastMessage([]byte("live"))
+	f := readTyped(t, conn)
+	if f.Type != protocol.FrameDeliver || string(f.Body) != "live" {
+		t.Fatalf("expected typed delivery, got %+v", f)
+	}
+	// Acks on broadcast topics are accepted and ignored
+	sendTyped(t, conn, protocol.TypedFrame{Type: protocol.FrameAck, Tag: f.Tag})
+}
@@ -0,0 +1,200 @@
+package broker
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+// authReplyTimeout bounds the write of the answer to a client's credentials, so a client that
+// does not read cannot hold its handler
+const authReplyTimeout = 5 * time.Second
+
+// ErrInvalidCredentials is returned by StaticAuthenticator for unknown or wrong credentials
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// errNoCredentials rejects a client that sent no credentials to a broker that requires them
+var errNoCredentials = errors.New("authentication required")
+
+// Authenticator checks the credentials clients send in their handshake. Implementations must be
+// safe for concurrent use.
+type Authenticator interface {
+	// Authenticate returns the identity the credentials belong to, or an error if they do not
+	// allow a client of role (PRODUCER or CONSUMER) to connect
+	Authenticate(role string, creds protocol.Credentials) (string, error)
+}
+
+// CredentialsFile is the JSON document read by LoadCredentialsFile
+type CredentialsFile struct {
+	Tokens []TokenCredential `json:"tokens"`
+	Users  []UserCredential  `json:"users"`
+}
+
+// TokenCredential is a bearer token accepted with protocol.AuthToken
+type TokenCredential struct {
+	Token string `json:"token"`
+	// Identity names the token's holder in logs and the admin API
+	Identity string `json:"identity"`
+	// Roles limits the token to "producer" or "consumer" connections; empty allows both
+	Roles []string `json:"roles,omitempty"`
+}
+
+// UserCredential is a username and password accepted with protocol.AuthPlain
+type UserCredential struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Roles limits the user to "producer" or "consumer" connections; empty allows both
+	Roles []string `json:"roles,omitempty"`
+}
+
+// credential is an accepted secret, kept as a SHA-256 digest
+type credential struct {
+	identity string
+	digest   [sha256.Size]byte
+	roles    []string
+}
+
+// allows reports whether the credential may connect as role
+func (c credential) allows(role string) bool {
+	return len(c.roles) == 0 || slices.Contains(c.roles, roleLabel(role))
+}
+
+// StaticAuthenticator accepts a fixed set of tokens and users
+type StaticAuthenticator struct {
+	// tokens is keyed by the digest of the token, so a lookup does not compare the secret itself
+	tokens map[[sha256.Size]byte]credential
+	users  map[string]credential
+}
+
+// NewStaticAuthenticator creates an authenticator for the tokens and users of f
+func NewStaticAuthenticator(f CredentialsFile) (*StaticAuthenticator, error) {
+	a := &StaticAuthenticator{
+		tokens: make(map[[sha256.Size]byte]credential),
+		users:  make(map[string]credential),
+	}
+	for i, t := range f.Tokens {
+		if t.Token == "" || t.Identity == "" {
+			return nil, fmt.Errorf("token %d: token and identity are required", i)
+		}
+		if err := validateRoles(t.Roles); err != nil {
+			return nil, fmt.Errorf("token %s: %w", t.Identity, err)
+		}
+		digest := sha256.Sum256([]byte(t.Token))
+		if _, ok := a.tokens[digest]; ok {
+			return nil, fmt.Errorf("token %s: duplicate token", t.Identity)
+		}
+		a.tokens[digest] = credential{identity: t.Identity, digest: digest, roles: t.Roles}
+	}
+	for i, u := range f.Users {
+		if u.Username == "" || u.Password == "" {
+			return nil, fmt.Errorf("user %d: username and password are required", i)
+		}
+		if err := validateRoles(u.Roles); err != nil {
+			return nil, fmt.Errorf("user %s: %w", u.Username, err)
+		}
+		if _, ok := a.users[u.Username]; ok {
+			return nil, fmt.Errorf("user %s: duplicate username", u.Username)
+		}
+		a.users[u.Username] = credential{identity: u.Username, digest: sha256.Sum256([]byte(u.Password)), roles: u.Roles}
+	}
+	return a, nil
+}
+
+// validateRoles checks that every role of a credential is "producer" or "consumer"
+func validateRoles(roles []string) error {
+	for _, r := range roles {
+		if r != roleLabel(roleProducer) && r != roleLabel(roleConsumer) {
+			return fmt.Errorf("unknown role %q", r)
+		}
+	}
+	return nil
+}
+
+// LoadCredentialsFile reads a JSON CredentialsFile and returns its authenticator
+func LoadCredentialsFile(path string) (*StaticAuthenticator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %w", err)
+	}
+	var f CredentialsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials file: %w", err)
+	}
+	return NewStaticAuthenticator(f)
+}
+
+// Authenticate implements Authenticator for protocol.AuthToken and protocol.AuthPlain credentials
+func (a *StaticAuthenticator) Authenticate(role string, creds protocol.Credentials) (string, error) {
+	var c credential
+	var ok bool
+	switch creds.Mechanism {
+	case protocol.AuthToken:
+		c, ok = a.tokens[sha256.Sum256(creds.Response)]
+	case protocol.AuthPlain:
+		username, password, err := creds.Plain()
+		if err != nil {
+			return "", err
+		}
+		c, ok = a.users[username]
+		digest := sha256.Sum256([]byte(password))
+		ok = ok && subtle.ConstantTimeCompare(digest[:], c.digest[:]) == 1
+	default:
+		return "", fmt.Errorf("unsupported authentication mechanism %q", creds.Mechanism)
+	}
+	if !ok {
+		return "", ErrInvalidCredentials
+	}
+	if !c.allows(role) {
+		return "", fmt.Errorf("%s is not allowed to connect as %s", c.identity, roleLabel(role))
+	}
+	return c.identity, nil
+}
+
+// authenticate checks the credentials of a handshake against the configured authenticator, and
+// returns the identity they belong to. A client that sent credentials is answered with an
+// authenticated frame; a refused client is sent an error frame, and false is returned so its
+// connection is closed. Without an authenticator every client is accepted unchecked.
+func (b *Broker) authenticate(conn net.Conn, hs protocol.Handshake) (string, bool) {
+	creds, sent, err := hs.Credentials()
+	var identity string
+	if err == nil && b.cfg.Authenticator != nil {
+		if sent {
+			identity, err = b.cfg.Authenticator.Authenticate(hs.Role, creds)
+		} else {
+			err = errNoCredentials
+		}
+	}
+
+	if err != nil {
+		b.logger.Warn("authentication failed", "remote_addr", conn.RemoteAddr(), "role", hs.Role, "mechanism", creds.Mechanism, "error", err)
+		// The reason sent back does not tell which part of the credentials was wrong
+		reason := protocol.ErrAuthenticationFailed.Error()
+		if errors.Is(err, errNoCredentials) {
+			reason = errNoCredentials.Error()
+		}
+		_ = b.writeAuthResult(conn, protocol.FrameError, reason)
+		return "", false
+	}
+	if sent {
+		if err := b.writeAuthResult(conn, protocol.FrameAuthenticated, identity); err != nil {
+			b.logger.Error("failed to answer credentials", "remote_addr", conn.RemoteAddr(), "error", err)
+			return "", false
+		}
+	}
+	return identity, true
+}
+
+// writeAuthResult writes the answer to a client's credentials
+func (b *Broker) writeAuthResult(conn net.Conn, typ protocol.FrameType, body string) error {
+	_ = conn.SetWriteDeadline(time.Now().Add(authReplyTimeout))
+	defer func() { _ = conn.SetWriteDeadline(time.Time{}) }()
+	return protocol.WriteFrame(conn, protocol.EncodeTypedFrame(protocol.TypedFrame{Type: typ, Body: []byte(body)}))
+}
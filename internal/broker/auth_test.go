@@ -0,0 +1,140 @@
+package broker
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+// testCredentials has a producer-only token and a user allowed both roles
+var testCredentials = CredentialsFile{
+	Tokens: []TokenCredential{{Token: "p-token", Identity: "csv-producer", Roles: []string{"producer"}}},
+	Users:  []UserCredential{{Username: "writer", Password: "s3cret"}},
+}
+
+// handshakeWith returns a handshake line carrying credentials
+func handshakeWith(role, topic string, creds protocol.Credentials) string {
+	hs := protocol.Handshake{Role: role, Topic: topic}
+	hs.SetCredentials(creds)
+	return hs.String()
+}
+
+func TestStaticAuthenticator(t *testing.T) {
+	a, err := NewStaticAuthenticator(testCredentials)
+	if err != nil {
+		t.Fatalf("NewStaticAuthenticator: %v", err)
+	}
+
+	for name, tc := range map[string]struct {
+		role     string
+		creds    protocol.Credentials
+		identity string
+	}{
+		"token":             {roleProducer, protocol.TokenCredentials("p-token"), "csv-producer"},
+		"plain as producer": {roleProducer, protocol.PlainCredentials("writer", "s3cret"), "writer"},
+		"plain as consumer": {roleConsumer, protocol.PlainCredentials("writer", "s3cret"), "writer"},
+	} {
+		if identity, err := a.Authenticate(tc.role, tc.creds); err != nil || identity != tc.identity {
+			t.Errorf("%s: expected %q, got %q (err=%v)", name, tc.identity, identity, err)
+		}
+	}
+
+	for name, tc := range map[string]struct {
+		role  string
+		creds protocol.Credentials
+	}{
+		"unknown token":     {roleProducer, protocol.TokenCredentials("nope")},
+		"wrong password":    {roleConsumer, protocol.PlainCredentials("writer", "guess")},
+		"unknown user":      {roleConsumer, protocol.PlainCredentials("nobody", "s3cret")},
+		"role not allowed":  {roleConsumer, protocol.TokenCredentials("p-token")},
+		"unknown mechanism": {roleProducer, protocol.Credentials{Mechanism: "scram-sha-256"}},
+		"malformed plain":   {roleProducer, protocol.Credentials{Mechanism: protocol.AuthPlain, Response: []byte("writer")}},
+	} {
+		if identity, err := a.Authenticate(tc.role, tc.creds); err == nil {
+			t.Errorf("%s: expected an error, got %q", name, identity)
+		}
+	}
+
+	for name, f := range map[string]CredentialsFile{
+		"missing identity": {Tokens: []TokenCredential{{Token: "t"}}},
+		"duplicate token":  {Tokens: []TokenCredential{{Token: "t", Identity: "a"}, {Token: "t", Identity: "b"}}},
+		"missing password": {Users: []UserCredential{{Username: "u"}}},
+		"unknown role":     {Users: []UserCredential{{Username: "u", Password: "p", Roles: []string{"admin"}}}},
+	} {
+		if _, err := NewStaticAuthenticator(f); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestLoadCredentialsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	data := `{"tokens": [{"token": "c-token", "identity": "mongo-consumer", "roles": ["consumer"]}]}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("write credentials: %v", err)
+	}
+	a, err := LoadCredentialsFile(path)
+	if err != nil {
+		t.Fatalf("LoadCredentialsFile: %v", err)
+	}
+	if identity, err := a.Authenticate(roleConsumer, protocol.TokenCredentials("c-token")); err != nil || identity != "mongo-consumer" {
+		t.Fatalf("expected mongo-consumer, got %q (err=%v)", identity, err)
+	}
+	if _, err := LoadCredentialsFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Fatal("expected a missing file to fail")
+	}
+}
+
+func TestHandshakeAuthentication(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	a, err := NewStaticAuthenticator(testCredentials)
+	if err != nil {
+		t.Fatalf("NewStaticAuthenticator: %v", err)
+	}
+	b := NewBrokerWithConfig(Config{DefaultMode: Queue, Authenticator: a}, logger)
+	defer b.Close()
+	tp := mustTopic(t, b, "jobs")
+
+	// Accepted credentials are answered before the connection is handled as usual
+	conn := connectPipe(t, b, handshakeWith(roleProducer, "jobs", protocol.TokenCredentials("p-token")))
+	if identity, err := protocol.ReadAuthResult(conn); err != nil || identity != "csv-producer" {
+		t.Fatalf("expected csv-producer, got %q (err=%v)", identity, err)
+	}
+	if err := protocol.WriteFrame(conn, []byte("a")); err != nil {
+		t.Fatalf("write frame: %v", err)
+	}
+	waitFor(t, func() bool { return tp.queue.Len() == 1 })
+	if clients := b.Clients(); len(clients) != 1 || clients[0].Identity != "csv-producer" {
+		t.Fatalf("expected the client's identity in the admin API, got %+v", clients)
+	}
+
+	for name, handshake := range map[string]string{
+		"no credentials":   "PRODUCER jobs\n",
+		"wrong password":   handshakeWith(roleConsumer, "jobs", protocol.PlainCredentials("writer", "guess")),
+		"role not allowed": handshakeWith(roleConsumer, "jobs", protocol.TokenCredentials("p-token")),
+	} {
+		conn := connectPipe(t, b, handshake)
+		f := readTyped(t, conn)
+		if f.Type != protocol.FrameError {
+			t.Fatalf("%s: expected an error frame, got %s", name, f.Type)
+		}
+		if _, err := protocol.ReadFrame(conn, nil); err == nil {
+			t.Fatalf("%s: expected the connection to be closed", name)
+		}
+	}
+	if _, err := protocol.ReadAuthResult(connectPipe(t, b, "CONSUMER jobs\n")); !errors.Is(err, protocol.ErrAuthenticationFailed) {
+		t.Fatalf("expected ErrAuthenticationFailed, got %v", err)
+	}
+
+	// A broker without an authenticator accepts credentials without checking them
+	open := NewBroker(Queue, logger)
+	defer open.Close()
+	conn = connectPipe(t, open, handshakeWith(roleProducer, "jobs", protocol.TokenCredentials("anything")))
+	if _, err := protocol.ReadAuthResult(conn); err != nil {
+		t.Fatalf("expected the credentials to be accepted, got %v", err)
+	}
+}
@@ -2,8 +2,13 @@ package broker
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/message-streaming-app/internal/common"
 	"github.com/message-streaming-app/internal/protocol"
@@ -14,142 +19,557 @@ const (
 	roleConsumer = "CONSUMER"
 )
 
-// Broker accepts producer and consumer connections and distributes messages by mode
+// Broker accepts producer and consumer connections and distributes messages by mode.
+// Each topic named in the handshake gets its own registry and queue, created on demand,
+// and uses the delivery mode declared for it in Config.
 type Broker struct {
-	mode     DeliveryMode
-	logger   Logger
-	registry ConsumerRegistry
-	queue    MessageQueue
+	cfg    Config
+	logger Logger
+
+	mu     sync.RWMutex
+	topics map[string]*topic
+
+	// subscriptions holds the wildcard subscriptions of consumers that follow several topics
+	subscriptions *subscriptionTrie
+	// clients tracks connected producers and consumers for the admin API
+	clients *clientRegistry
+	// metrics are served in the Prometheus format
+	metrics *brokerMetrics
+	// conns tracks the connections being handled so Shutdown can drain them
+	conns *connTracker
+
+	// accept tracks the listener served by Serve; recovered, shuttingDown and lockCheck feed the
+	// readiness and liveness checks
+	accept       acceptLoop
+	recovered    atomic.Bool
+	shuttingDown atomic.Bool
+	lockCheck    atomic.Bool
 }
 
-// NewBroker creates a new Broker instance
+// NewBroker creates a new Broker instance that uses mode for every topic
 func NewBroker(mode DeliveryMode, logger Logger) *Broker {
+	return NewBrokerWithConfig(Config{DefaultMode: mode}, logger)
+}
+
+// NewBrokerWithConfig creates a new Broker instance with per-topic settings
+func NewBrokerWithConfig(cfg Config, logger Logger) *Broker {
+	if cfg.AckTimeout <= 0 {
+		cfg.AckTimeout = defaultAckTimeout
+	}
+	if cfg.MaxDeliveryAttempts == 0 {
+		cfg.MaxDeliveryAttempts = defaultMaxDeliveryAttempts
+	}
+	if cfg.ProducerCredits <= 0 {
+		cfg.ProducerCredits = defaultProducerCredits
+	}
 	b := &Broker{
-		mode:     mode,
-		logger:   logger,
-		registry: NewBroadcastRegistry(logger),
-		queue:    NewMemoryMessageQueue(10000, logger),
+		cfg:           cfg,
+		logger:        logger,
+		topics:        make(map[string]*topic),
+		subscriptions: newSubscriptionTrie(logger),
+		conns:         newConnTracker(),
 	}
+	b.metrics = newBrokerMetrics(b)
+	b.clients = newClientRegistry(b.metrics)
 	return b
 }
 
-// Close shuts down broker internals (registry and queue)
+// Close shuts down broker internals (registries and queues of every topic, and wildcard subscriptions)
 func (b *Broker) Close() error {
-	if b.queue != nil {
-		_ = b.queue.Close()
-	}
-	if b.registry != nil {
-		_ = b.registry.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name, t := range b.topics {
+		t.close()
+		delete(b.topics, name)
 	}
+	b.subscriptions.close()
 	return nil
 }
 
 // HandleConn handles a single TCP connection
-// The first line sent must be either "PRODUCER" or "CONSUMER"
+// The first line sent must be "PRODUCER [topic]" or "CONSUMER [topic]"; the topic defaults to DefaultTopic.
+// A consumer may name a wildcard subscription such as "telemetry/+/+/DCGM_FI_DEV_GPU_TEMP" instead of a topic.
 func (b *Broker) HandleConn(conn net.Conn) {
+	if !b.conns.add(conn) {
+		b.logger.Debug("refusing connection while draining", "remote_addr", conn.RemoteAddr())
+		_ = conn.Close()
+		return
+	}
+	defer b.conns.remove(conn)
 	defer conn.Close()
 	br := bufio.NewReader(conn)
 
-	// Read the role identifier (PRODUCER or CONSUMER)
+	// Read the handshake line (role and optional topic)
 	line, err := br.ReadString('\n')
 	if err != nil {
+		if errors.Is(err, io.EOF) && line == "" {
+			// Probes and load balancer health checks connect without sending anything
+			b.logger.Debug("connection closed before handshake", "remote_addr", conn.RemoteAddr())
+			return
+		}
+		if b.conns.isDraining() {
+			b.logger.Debug("handshake interrupted by shutdown", "remote_addr", conn.RemoteAddr())
+			return
+		}
 		b.logger.Error("failed to read role identifier", "error", err)
 		return
 	}
 
-	role := trimLine(line)
-	b.logger.Info("connection received", "remote_addr", conn.RemoteAddr(), "role", role)
+	hs, err := protocol.ParseHandshake(trimLine(line))
+	if err != nil {
+		b.logger.Error("invalid handshake", "remote_addr", conn.RemoteAddr(), "error", err)
+		return
+	}
+	if hs.Role != roleProducer && hs.Role != roleConsumer {
+		b.logger.Error("unknown role received", "remote_addr", conn.RemoteAddr(), "role", hs.Role)
+		return
+	}
+	identity, ok := b.authenticate(conn, hs)
+	if !ok {
+		return
+	}
+	if hs.Role == roleConsumer {
+		// A draining consumer still reads acks for the messages flushed to it
+		b.conns.keepReading(conn)
+	}
+	topicName := hs.Topic
+	if topicName == "" {
+		topicName = DefaultTopic
+	}
+	if hs.Role == roleConsumer && isWildcard(topicName) {
+		if err := validateSubscription(topicName); err != nil {
+			b.logger.Error("invalid subscription in handshake", "remote_addr", conn.RemoteAddr(), "error", err)
+			return
+		}
+		b.logger.Info("connection received", "remote_addr", conn.RemoteAddr(), "role", hs.Role, "subscription", topicName)
+		c := b.clients.add(conn, hs.Role, topicName, "", identity, len(line))
+		defer b.clients.remove(c)
+		frameReader, frameWriter := c.frames(br)
+		b.handleConsumerWildcard(topicName, hs, frameReader, frameWriter)
+		return
+	}
+	if err := validateTopicName(topicName); err != nil {
+		b.logger.Error("invalid topic in handshake", "remote_addr", conn.RemoteAddr(), "error", err)
+		return
+	}
+	b.logger.Info("connection received", "remote_addr", conn.RemoteAddr(), "role", hs.Role, "topic", topicName)
+
+	// Track the connection and count what goes through its frame reader and writer
+	c := b.clients.add(conn, hs.Role, topicName, hs.Option(protocol.OptionGroup, ""), identity, len(line))
+	defer b.clients.remove(c)
+	frameReader, frameWriter := c.frames(br)
 
-	// Create frame reader and writer
-	frameReader := NewBufferedFrameReader(br)
-	frameWriter := NewConnectionFrameWriter(conn)
+	t, err := b.getOrCreateTopic(topicName)
+	if err != nil {
+		b.logger.Error("failed to open topic", "topic", topicName, "error", err)
+		return
+	}
 
-	switch role {
+	switch hs.Role {
 	case roleProducer:
-		b.handleProducer(frameReader)
+		b.handleProducer(t, hs, frameReader, frameWriter)
 	case roleConsumer:
-		b.handleConsumer(frameWriter)
-	default:
-		b.logger.Error("unknown role received", "role", role)
+		b.handleConsumer(t, hs, frameReader, frameWriter)
 	}
 }
 
-// handleProducer reads messages from a producer and enqueues them
-func (b *Broker) handleProducer(reader FrameReader) {
-	defer b.logger.Info("producer connection closed")
+// handleProducer reads messages from a producer and enqueues them on its topic.
+// The producer is not read while the topic is saturated, so a full queue slows it down instead
+// of dropping its messages. A producer that asked for credit flow control is also told how many
+// messages it may send, and gets more only while the topic has room. A producer in confirm mode
+// gets an ack or nack for every message once it has been stored. Once the broker drains, the
+// producer is no longer read, and is sent a going-away frame if it negotiated typed frames.
+func (b *Broker) handleProducer(t *topic, hs protocol.Handshake, reader FrameReader, writer FrameWriter) {
+	defer b.logger.Info("producer connection closed", "topic", t.name)
+
+	window, err := b.parseProducerFlow(hs)
+	if err != nil {
+		b.logger.Error("invalid producer options", "topic", t.name, "error", err)
+		return
+	}
+	confirm, err := parseProducerConfirm(hs)
+	if err != nil {
+		b.logger.Error("invalid producer options", "topic", t.name, "error", err)
+		return
+	}
+	var credits *producerCredits
+	if window > 0 {
+		credits = &producerCredits{window: window}
+	}
+	typed := confirm || credits != nil
 
+	var seq uint64
 	buf := make([]byte, 0, 64*1024)
 	for {
+		if !b.waitForCapacity(t) {
+			return
+		}
+		if b.conns.isDraining() {
+			b.goAway(writer, typed)
+			return
+		}
+		if credits != nil {
+			if err := credits.topUp(writer); err != nil {
+				b.logger.Error("producer write error", "topic", t.name, "error", err)
+				return
+			}
+		}
+
 		body, err := reader.ReadFrame(buf)
 		if err != nil {
+			if b.conns.isDraining() {
+				// The drain interrupted the read; a partly read message is not confirmed
+				b.goAway(writer, typed)
+				return
+			}
 			if err != io.EOF {
-				b.logger.Error("producer read error", "error", err)
+				b.logger.Error("producer read error", "topic", t.name, "error", err)
 			}
 			return
 		}
+		if credits != nil && !credits.use() {
+			b.logger.Warn("producer sent a message without credit", "topic", t.name)
+		}
 
-		// Enqueue the message based on delivery mode
-		switch b.mode {
-		case Broadcast:
-			err := b.registry.BroadcastMessage(body)
-			if err != nil {
-				b.logger.Warn("failed to broadcast message", "error", err)
+		err = b.publish(t, body)
+		if confirm {
+			seq++
+			if err := b.confirm(writer, seq, body, err); err != nil {
+				b.logger.Error("producer write error", "topic", t.name, "error", err)
+				return
 			}
+		}
+	}
+}
 
-		case Queue:
-			if err := b.queue.Enqueue(body); err != nil {
-				b.logger.Warn("failed to enqueue message", "error", err)
-			}
+// parseProducerConfirm reports whether a producer asked for publisher confirms
+func parseProducerConfirm(hs protocol.Handshake) (bool, error) {
+	switch v := hs.Option(protocol.OptionConfirm, "false"); v {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid %s %q", protocol.OptionConfirm, v)
+	}
+}
+
+// confirm tells a producer whether its message number seq was accepted; publishErr is the result
+// of publishing it
+func (b *Broker) confirm(writer FrameWriter, seq uint64, msg []byte, publishErr error) error {
+	c := protocol.Confirm{Seq: seq, Acked: publishErr == nil, MessageID: parseEnvelope(msg).ID}
+	if publishErr != nil {
+		c.Reason = publishErr.Error()
+	}
+	if err := writer.WriteFrame(protocol.EncodeConfirm(c)); err != nil {
+		return fmt.Errorf("failed to confirm message: %w", err)
+	}
+	return nil
+}
+
+// publish drops a message whose ID was already published to the topic within the dedup window,
+// so a producer that resends after a lost connection does not deliver it twice, and stores or
+// schedules any other message. A dropped duplicate counts as published.
+func (b *Broker) publish(t *topic, msg []byte) error {
+	var env envelope
+	if t.dedup != nil || mayBeScheduled(msg) {
+		env = parseEnvelope(msg)
+	}
+	now := time.Now()
+	key := ""
+	if t.dedup != nil {
+		key = dedupKey(env)
+	}
+	if key != "" && t.dedup.check(key, now) {
+		n := t.duplicates.Add(1)
+		b.logger.Debug("dropping duplicate message", "topic", t.name, "key", key, "duplicates", n)
+		return nil
+	}
+
+	if err := b.storeOrSchedule(t, env, msg, now); err != nil {
+		if key != "" {
+			t.dedup.forget(key)
+		}
+		return err
+	}
+	return nil
+}
+
+// storeOrSchedule stores a message now, or hands it to the topic's scheduler if it asked to be
+// delivered later
+func (b *Broker) storeOrSchedule(t *topic, env envelope, msg []byte, now time.Time) error {
+	due, later, err := env.deliverAt(now)
+	if err != nil {
+		return err
+	}
+	if later {
+		return t.scheduler.schedule(due, msg)
+	}
+	if err := b.store(t, msg); err != nil {
+		return err
+	}
+	t.published.Add(1)
+	return nil
+}
+
+// store records a message in the topic log for replay, then delivers it based on the topic's
+// delivery mode and copies it to every consumer group and matching wildcard subscription. It returns an error if the message could
+// not be stored in the log, the topic queue or a group queue; consumers that miss a broadcast
+// because they are slow do not fail it.
+func (b *Broker) store(t *topic, msg []byte) error {
+	var errs []error
+	if _, err := t.log.append(msg); err != nil {
+		b.logger.Warn("failed to append message to topic log", "topic", t.name, "error", err)
+		errs = append(errs, fmt.Errorf("failed to append to topic log: %w", err))
+	}
+	switch t.mode {
+	case Broadcast:
+		// Consumers that missed the message are logged by the registry
+		err := t.registry.BroadcastMessage(msg)
+		if err != nil && !errors.Is(err, ErrConsumerFull) {
+			b.logger.Warn("failed to broadcast message", "topic", t.name, "error", err)
+		}
+
+	case Queue:
+		if err := t.queue.Enqueue(msg); err != nil {
+			b.metrics.enqueueDrops.With(t.name).Inc()
+			b.logger.Warn("failed to enqueue message", "topic", t.name, "error", err)
+			errs = append(errs, fmt.Errorf("failed to enqueue: %w", err))
 		}
 	}
+	if err := b.publishToGroups(t, msg); err != nil {
+		errs = append(errs, err)
+	}
+	b.subscriptions.publish(t.name, msg)
+	return errors.Join(errs...)
 }
 
-// handleConsumer delivers messages to a consumer
-func (b *Broker) handleConsumer(writer FrameWriter) {
-	defer b.logger.Info("consumer connection closed")
+// handleConsumer delivers messages from a topic to a consumer.
+// A consumer that names a group shares that group's copy of the stream with the other members,
+// and one that names a start position or a consumer ID replays the topic log, whatever the topic's
+// delivery mode. A filter skips messages for broadcast and replaying consumers; consumers that
+// share a queue cannot filter, since a skipped message would be lost to the others.
+func (b *Broker) handleConsumer(t *topic, hs protocol.Handshake, reader FrameReader, writer FrameWriter) {
+	defer b.logger.Info("consumer connection closed", "topic", t.name)
+
+	opts, err := parseConsumerOptions(hs)
+	if err != nil {
+		b.logger.Error("invalid consumer options", "topic", t.name, "error", err)
+		return
+	}
+	if opts.filter != nil {
+		if t.mode == Queue && opts.from == nil && opts.id == "" {
+			b.logger.Error("invalid consumer options", "topic", t.name, "error", "queue mode consumers cannot filter")
+			return
+		}
+		b.logger.Info("consumer filter set", "topic", t.name, "filter", opts.filter.String())
+	}
+
+	if opts.group != "" {
+		g, err := b.getOrCreateGroup(t, opts.group)
+		if err != nil {
+			b.logger.Error("failed to open consumer group", "topic", t.name, "group", opts.group, "error", err)
+			return
+		}
+		b.handleConsumerQueue(t, g.dispatcher, opts, reader, writer)
+		return
+	}
+	if opts.from != nil || opts.id != "" {
+		b.handleConsumerReplay(t, opts, reader, writer)
+		return
+	}
 
-	switch b.mode {
+	switch t.mode {
 	case Broadcast:
-		b.handleConsumerBroadcast(writer)
+		b.handleConsumerBroadcast(t, opts, reader, writer)
 	case Queue:
-		b.handleConsumerQueue(writer)
+		b.handleConsumerQueue(t, t.dispatcher, opts, reader, writer)
 	}
 }
 
 // handleConsumerBroadcast handles a consumer in broadcast mode
-func (b *Broker) handleConsumerBroadcast(writer FrameWriter) {
-	// Create a channel for this consumer
+func (b *Broker) handleConsumerBroadcast(t *topic, opts consumerOptions, reader FrameReader, writer FrameWriter) {
+	ch := newConsumerChannel()
+
+	// Register the consumer with its slow consumer policy
+	consumerID := t.registry.RegisterConsumerWithPolicy(ch, b.slowConsumerConfig(opts))
+	defer t.registry.UnregisterConsumer(consumerID)
+
+	expired := func(msg []byte) bool { return b.discardExpired(t, "", msg, false) }
+	b.writeBroadcast(t.name, consumerID, ch, &t.nextTag, expired, opts, reader, writer)
+}
+
+// newConsumerChannel creates the buffer of a broadcast consumer
+func newConsumerChannel() chan []byte {
 	ChannelBufferSize := common.GetEnvInt("CONSUMER_CHANNEL_BUFFER_SIZE", 10000)
-	ch := make(chan []byte, ChannelBufferSize)
+	return make(chan []byte, ChannelBufferSize)
+}
 
-	// Register the consumer
-	consumerID := b.registry.RegisterConsumer(ch)
-	defer b.registry.UnregisterConsumer(consumerID)
+// writeBroadcast sends a broadcast consumer the messages of its channel as they arrive, until the
+// channel is closed or a write fails, skipping those that expired while buffered or do not match
+// the consumer's filter. Broadcast deliveries are never redelivered, so acks from manual-ack
+// consumers are read and ignored; their delivery tags are taken from tags. Once the broker drains,
+// the messages already buffered are sent, followed by a going-away frame for manual-ack consumers.
+func (b *Broker) writeBroadcast(name, consumerID string, ch chan []byte, tags *atomic.Uint64, expired func(msg []byte) bool, opts consumerOptions, reader FrameReader, writer FrameWriter) {
+	if opts.manualAck {
+		go b.readAcks(name, nil, nil, reader)
+	}
 
-	// Send messages as they arrive
-	for msg := range ch {
-		if err := writer.WriteFrame(msg); err != nil {
-			b.logger.Error("consumer write error", "consumer_id", consumerID, "error", err)
+	// A broadcast consumer is only read from with manual acks, so an operator's disconnect is
+	// noticed here rather than at the next write
+	disconnected := kicked(writer)
+	send := func(msg []byte) error {
+		if expired(msg) || !opts.matches(msg) {
+			return nil
+		}
+		frame := msg
+		if opts.manualAck {
+			frame = protocol.EncodeTypedFrame(protocol.TypedFrame{Type: protocol.FrameDeliver, Tag: tags.Add(1), Body: msg})
+		}
+		if err := writer.WriteFrame(frame); err != nil {
+			b.logger.Error("consumer write error", "topic", name, "consumer_id", consumerID, "error", err)
+			return err
+		}
+		b.metrics.observeDelivery("broadcast", msg)
+		return nil
+	}
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok || send(msg) != nil {
+				return
+			}
+		case <-disconnected:
+			return
+		case <-b.conns.draining:
+			// Producers are no longer read, so the buffer only holds what is left to flush
+			for len(ch) > 0 {
+				if send(<-ch) != nil {
+					return
+				}
+			}
+			b.goAway(writer, opts.manualAck)
 			return
 		}
 	}
 }
 
-// handleConsumerQueue handles a consumer in queue mode
-func (b *Broker) handleConsumerQueue(writer FrameWriter) {
+// slowConsumerConfig returns the broker's slow consumer settings with the consumer's overrides applied
+func (b *Broker) slowConsumerConfig(opts consumerOptions) SlowConsumerConfig {
+	cfg := b.cfg.SlowConsumer
+	if opts.slowPolicy != nil {
+		cfg.Policy = *opts.slowPolicy
+	}
+	if opts.blockTimeoutMs > 0 {
+		cfg.BlockTimeoutMs = opts.blockTimeoutMs
+	}
+	return cfg
+}
+
+// handleConsumerQueue handles a consumer in queue mode or in a consumer group.
+// The dispatcher d hands it messages in round-robin order with the other consumers. With
+// manual acks each delivery is tagged and held until the consumer acks it; nacked, timed-out and
+// (on disconnect) still-pending deliveries are put back on the queue for another consumer, or
+// dead-lettered once they have failed too often. Messages that expired in the queue are discarded
+// instead of delivered. Once the broker drains, the consumer keeps receiving messages until the
+// queue is empty and it has acked its deliveries, and is then sent a going-away frame if it uses
+// manual acks.
+func (b *Broker) handleConsumerQueue(t *topic, d *dispatcher, opts consumerOptions, reader FrameReader, writer FrameWriter) {
+	c := d.register(opts.prefetch)
+	mode := "queue"
+	if d.group != "" {
+		mode = "group"
+	}
+	var tracker *inflightTracker
+	if opts.manualAck {
+		tracker = newInflightTracker()
+	}
+	// unwritten is a delivery that failed to reach a consumer without manual acks
+	var unwritten []byte
+	defer func() {
+		pending := d.unregister(c)
+		if unwritten != nil {
+			pending = append([][]byte{unwritten}, pending...)
+		}
+		var unacked [][]byte
+		if tracker != nil {
+			unacked = tracker.drain()
+		}
+		d.giveBack(c, unacked, pending)
+	}()
+
+	// The read side ends when the consumer disconnects
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.readAcks(t.name, tracker, c, reader)
+	}()
+
+	if tracker != nil {
+		// Redeliver messages whose ack deadline has passed
+		go func() {
+			ticker := time.NewTicker(b.cfg.AckTimeout / 2)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case now := <-ticker.C:
+					for _, msg := range tracker.expired(now) {
+						b.logger.Warn("ack timeout, redelivering message", "topic", t.name, "group", d.group)
+						d.retry(msg, "ack timeout")
+						c.release(msg)
+					}
+				}
+			}
+		}()
+	}
+
+	draining := b.conns.draining
+	var poll <-chan time.Time
 	for {
-		msg, err := b.queue.Dequeue()
-		if err != nil {
-			// Queue might be closed or empty, wait a bit and retry
-			// In production, this should use a blocking dequeue operation
-			b.logger.Error("queue dequeue error", "error", err)
+		var msg []byte
+		select {
+		case <-done:
 			return
+		case msg = <-c.out:
+		case <-draining:
+			draining = nil
+			ticker := time.NewTicker(drainPollInterval)
+			defer ticker.Stop()
+			poll = ticker.C
+			continue
+		case <-poll:
+			if len(c.out) == 0 && d.backlogLen() == 0 && (tracker == nil || tracker.len() == 0) {
+				b.goAway(writer, tracker != nil)
+				return
+			}
+			continue
+		}
+		if b.discardExpired(t, d.group, msg, true) {
+			d.settled(msg)
+			c.release(msg)
+			continue
 		}
 
-		if err := writer.WriteFrame(msg); err != nil {
-			b.logger.Error("consumer write error", "error", err)
+		frame := msg
+		if tracker != nil {
+			tag := t.nextTag.Add(1)
+			tracker.add(tag, msg, time.Now().Add(b.cfg.AckTimeout))
+			frame = protocol.EncodeTypedFrame(protocol.TypedFrame{Type: protocol.FrameDeliver, Tag: tag, Body: msg})
+		}
+		if err := writer.WriteFrame(frame); err != nil {
+			b.logger.Error("consumer write error", "topic", t.name, "consumer_id", c.id, "error", err)
+			if tracker == nil {
+				unwritten = msg
+			}
 			return
 		}
+		b.metrics.observeDelivery(mode, msg)
+		if tracker == nil {
+			d.settled(msg)
+			c.release(msg)
+		}
 	}
 }
 
@@ -4,15 +4,18 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/message-streaming-app/internal/protocol"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -21,13 +24,21 @@ type simpleConn struct {
 	readBuf  *bytes.Reader
 	writeBuf *bytes.Buffer
 	closed   bool
+
+	// hold, when set, makes Read block once readBuf is exhausted (like an idle client) until Close
+	hold      chan struct{}
+	closeOnce sync.Once
 }
 
 func (s *simpleConn) Read(b []byte) (int, error) {
 	if s.readBuf == nil {
 		return 0, io.EOF
 	}
-	return s.readBuf.Read(b)
+	n, err := s.readBuf.Read(b)
+	if err == io.EOF && s.hold != nil {
+		<-s.hold
+	}
+	return n, err
 }
 func (s *simpleConn) Write(b []byte) (int, error) {
 	if s.closed {
@@ -35,13 +46,31 @@ func (s *simpleConn) Write(b []byte) (int, error) {
 	}
 	return s.writeBuf.Write(b)
 }
-func (s *simpleConn) Close() error                       { s.closed = true; return nil }
+func (s *simpleConn) Close() error {
+	s.closed = true
+	s.closeOnce.Do(func() {
+		if s.hold != nil {
+			close(s.hold)
+		}
+	})
+	return nil
+}
 func (s *simpleConn) LocalAddr() net.Addr                { return nil }
 func (s *simpleConn) RemoteAddr() net.Addr               { return nil }
 func (s *simpleConn) SetDeadline(t time.Time) error      { return nil }
 func (s *simpleConn) SetReadDeadline(t time.Time) error  { return nil }
 func (s *simpleConn) SetWriteDeadline(t time.Time) error { return nil }
 
+// mustTopic returns the named topic, creating it if needed
+func mustTopic(t *testing.T, b *Broker, name string) *topic {
+	t.Helper()
+	tp, err := b.getOrCreateTopic(name)
+	if err != nil {
+		t.Fatalf("getOrCreateTopic(%q): %v", name, err)
+	}
+	return tp
+}
+
 func frameBytes(payload []byte) []byte {
 	var h [4]byte
 	binary.BigEndian.PutUint32(h[:], uint32(len(payload)))
@@ -75,7 +104,7 @@ func TestHandleConnProducerQueueEnqueues(t *testing.T) {
 	b.HandleConn(conn)
 
 	// Dequeue message from broker queue
-	msg, err := b.queue.Dequeue()
+	msg, err := mustTopic(t, b, DefaultTopic).queue.Dequeue()
 	if err != nil {
 		t.Fatalf("expected message in queue, got error: %v", err)
 	}
@@ -101,7 +130,7 @@ func TestHandleConnConsumerBroadcastReceivesMessage(t *testing.T) {
 
 	// this produces a new message that should be broadcast to the consumer
 	payload := []byte("broadcast-msg")
-	b.registry.BroadcastMessage(payload)
+	mustTopic(t, b, DefaultTopic).registry.BroadcastMessage(payload)
 
 	// allow write to occur
 	time.Sleep(20 * time.Millisecond)
@@ -126,7 +155,7 @@ func TestHandleConnConsumerQueueReceivesEnqueuedMessage(t *testing.T) {
 	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
 	b := NewBroker(Queue, logger)
 
-	conn := &simpleConn{readBuf: bytes.NewReader([]byte("CONSUMER\n")), writeBuf: &bytes.Buffer{}}
+	conn := &simpleConn{readBuf: bytes.NewReader([]byte("CONSUMER\n")), writeBuf: &bytes.Buffer{}, hold: make(chan struct{})}
 
 	var wg sync.WaitGroup
 	wg.Go(func() {
@@ -135,7 +164,7 @@ func TestHandleConnConsumerQueueReceivesEnqueuedMessage(t *testing.T) {
 
 	// enqueue a message
 	payload := []byte("queue-consumer-msg")
-	if err := b.queue.Enqueue(payload); err != nil {
+	if err := mustTopic(t, b, DefaultTopic).queue.Enqueue(payload); err != nil {
 		t.Fatalf("enqueue failed: %v", err)
 	}
 
@@ -154,6 +183,82 @@ func TestHandleConnConsumerQueueReceivesEnqueuedMessage(t *testing.T) {
 	}
 }
 
+func TestHandleConnProducerTopicIsolation(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Queue, logger)
+
+	alerts := append([]byte("PRODUCER alerts\n"), frameBytes([]byte("alert-msg"))...)
+	b.HandleConn(&simpleConn{readBuf: bytes.NewReader(alerts), writeBuf: &bytes.Buffer{}})
+
+	telemetry := append([]byte("PRODUCER telemetry\n"), frameBytes([]byte("telemetry-msg"))...)
+	b.HandleConn(&simpleConn{readBuf: bytes.NewReader(telemetry), writeBuf: &bytes.Buffer{}})
+
+	msg, err := mustTopic(t, b, "alerts").queue.Dequeue()
+	if err != nil || string(msg) != "alert-msg" {
+		t.Fatalf("expected alert-msg on alerts topic, got %q (err=%v)", msg, err)
+	}
+	msg, err = mustTopic(t, b, "telemetry").queue.Dequeue()
+	if err != nil || string(msg) != "telemetry-msg" {
+		t.Fatalf("expected telemetry-msg on telemetry topic, got %q (err=%v)", msg, err)
+	}
+	if mustTopic(t, b, DefaultTopic).queue.Len() != 0 {
+		t.Fatalf("expected default topic to stay empty")
+	}
+	assert.ElementsMatch(t, []string{"alerts", "telemetry", DefaultTopic}, b.Topics())
+}
+
+func TestHandleConnRejectsInvalidTopic(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Queue, logger)
+
+	data := append([]byte("PRODUCER bad*topic\n"), frameBytes([]byte("msg"))...)
+	b.HandleConn(&simpleConn{readBuf: bytes.NewReader(data), writeBuf: &bytes.Buffer{}})
+
+	if len(b.Topics()) != 0 {
+		t.Fatalf("expected no topics to be created, got %v", b.Topics())
+	}
+}
+
+func TestHandleConnRejectsUnknownRole(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	b := NewBroker(Queue, logger)
+
+	for _, handshake := range []string{
+		"FOO bad//topic\n",
+		// Credentials are not checked, or answered, for a role that does not exist
+		handshakeWith("FOO", "jobs", protocol.TokenCredentials("anything")),
+	} {
+		logs.Reset()
+		conn := &simpleConn{readBuf: bytes.NewReader([]byte(handshake)), writeBuf: &bytes.Buffer{}}
+		b.HandleConn(conn)
+		if !strings.Contains(logs.String(), "unknown role received") || strings.Contains(logs.String(), "invalid topic") {
+			t.Errorf("%q: expected an unknown role to be reported, got logs %q", handshake, logs.String())
+		}
+		if conn.writeBuf.Len() != 0 {
+			t.Errorf("%q: expected no answer, got %q", handshake, conn.writeBuf.Bytes())
+		}
+	}
+	if len(b.Topics()) != 0 {
+		t.Fatalf("expected no topics to be created, got %v", b.Topics())
+	}
+}
+
+func TestValidateTopicName(t *testing.T) {
+	valid := []string{"default", "gpu.telemetry", "alerts_v2", "inventory-events", "telemetry/mtv5-dgx1/0/DCGM_FI_DEV_GPU_TEMP"}
+	for _, name := range valid {
+		if err := validateTopicName(name); err != nil {
+			t.Errorf("validateTopicName(%q) returned error: %v", name, err)
+		}
+	}
+	invalid := []string{"", "bad topic", "bad*topic", string(make([]byte, maxTopicNameLength+1)), "/telemetry", "telemetry/", "telemetry//temp", "telemetry/../jobs", "telemetry/+", "telemetry/#"}
+	for _, name := range invalid {
+		if err := validateTopicName(name); err == nil {
+			t.Errorf("validateTopicName(%q) expected error", name)
+		}
+	}
+}
+
 func TestBroadcastRegistryRegister(t *testing.T) {
 	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
 	registry := NewBroadcastRegistry(logger)
@@ -218,6 +323,94 @@ func TestBroadcastRegistryBroadcastMessage(t *testing.T) {
 	}
 }
 
+func TestBroadcastRegistrySlowConsumerDoesNotBlockOthers(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	registry := NewBroadcastRegistry(logger)
+
+	slow := make(chan []byte, 1)
+	healthy := make(chan []byte, 10)
+	slowID := registry.RegisterConsumer(slow)
+	registry.RegisterConsumer(healthy)
+
+	for _, m := range []string{"m1", "m2", "m3"} {
+		err := registry.BroadcastMessage([]byte(m))
+		if m != "m1" && !errors.Is(err, ErrConsumerFull) {
+			t.Fatalf("%s: expected ErrConsumerFull, got %v", m, err)
+		}
+	}
+
+	if len(healthy) != 3 {
+		t.Fatalf("expected the healthy consumer to receive every message, got %d", len(healthy))
+	}
+	if got := string(<-slow); got != "m1" {
+		t.Fatalf("expected drop-newest to keep m1, got %s", got)
+	}
+	for _, st := range registry.ConsumerStats() {
+		want := uint64(0)
+		if st.ID == slowID {
+			want = 2
+		}
+		if st.Dropped != want {
+			t.Errorf("consumer %s: expected %d drops, got %d", st.ID, want, st.Dropped)
+		}
+	}
+}
+
+func TestBroadcastRegistrySlowConsumerPolicies(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	registry := NewBroadcastRegistry(logger)
+
+	oldest := make(chan []byte, 2)
+	registry.RegisterConsumerWithPolicy(oldest, SlowConsumerConfig{Policy: SlowConsumerDropOldest})
+	blocking := make(chan []byte, 1)
+	registry.RegisterConsumerWithPolicy(blocking, SlowConsumerConfig{Policy: SlowConsumerBlock, BlockTimeoutMs: 1000})
+	disconnected := make(chan []byte, 1)
+	registry.RegisterConsumerWithPolicy(disconnected, SlowConsumerConfig{Policy: SlowConsumerDisconnect})
+
+	_ = registry.BroadcastMessage([]byte("m1"))
+
+	// The blocked send completes once the consumer makes room
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = registry.BroadcastMessage([]byte("m2"))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if got := string(<-blocking); got != "m1" {
+		t.Fatalf("expected m1 first on the blocking consumer, got %s", got)
+	}
+	<-done
+	if got := string(<-blocking); got != "m2" {
+		t.Fatalf("expected the blocked send to deliver m2, got %s", got)
+	}
+
+	_ = registry.BroadcastMessage([]byte("m3"))
+	if a, b := string(<-oldest), string(<-oldest); a != "m2" || b != "m3" {
+		t.Fatalf("expected drop-oldest to keep m2 and m3, got %s and %s", a, b)
+	}
+	if _, ok := <-disconnected; ok {
+		t.Fatal("expected the disconnected consumer's channel to be closed without its backlog")
+	}
+	if registry.GetConsumerCount() != 2 {
+		t.Fatalf("expected the slow consumer to be unregistered, %d consumers left", registry.GetConsumerCount())
+	}
+}
+
+func TestBroadcastRegistryBlockTimeoutDrops(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	registry := NewBroadcastRegistry(logger)
+	ch := make(chan []byte, 1)
+	registry.RegisterConsumerWithPolicy(ch, SlowConsumerConfig{Policy: SlowConsumerBlock, BlockTimeoutMs: 10})
+
+	_ = registry.BroadcastMessage([]byte("m1"))
+	if err := registry.BroadcastMessage([]byte("m2")); !errors.Is(err, ErrConsumerFull) {
+		t.Fatalf("expected ErrConsumerFull after the block timeout, got %v", err)
+	}
+	if st := registry.ConsumerStats(); len(st) != 1 || st[0].Dropped != 1 || st[0].Buffered != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
 func TestBroadcastRegistryGetConsumerCount(t *testing.T) {
 	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
 	registry := NewBroadcastRegistry(logger)
@@ -370,8 +563,8 @@ func TestNewBrokerBroadcastMode(t *testing.T) {
 	if broker == nil {
 		t.Error("expected non-nil broker")
 	}
-	if broker.mode != Broadcast {
-		t.Errorf("expected Broadcast mode, got %v", broker.mode)
+	if broker.cfg.DefaultMode != Broadcast {
+		t.Errorf("expected Broadcast mode, got %v", broker.cfg.DefaultMode)
 	}
 }
 
@@ -382,8 +575,8 @@ func TestNewBrokerQueueMode(t *testing.T) {
 	if broker == nil {
 		t.Error("expected non-nil broker")
 	}
-	if broker.mode != Queue {
-		t.Errorf("expected Queue mode, got %v", broker.mode)
+	if broker.cfg.DefaultMode != Queue {
+		t.Errorf("expected Queue mode, got %v", broker.cfg.DefaultMode)
 	}
 }
 
@@ -0,0 +1,237 @@
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrUnknownClient is returned when an admin request names a client that is not connected
+var ErrUnknownClient = errors.New("unknown client")
+
+// frameHeaderSize is the length prefix of every frame, counted in the client byte counters
+const frameHeaderSize = 4
+
+// ClientInfo describes a connected producer or consumer
+type ClientInfo struct {
+	// ID identifies the connection for DisconnectClient
+	ID string `json:"id"`
+	// Role is "producer" or "consumer"
+	Role string `json:"role"`
+	// Topic is the topic the client publishes to or consumes from, or a consumer's wildcard subscription
+	Topic string `json:"topic"`
+	// Group is the consumer group a consumer joined, if any
+	Group string `json:"group,omitempty"`
+	// Identity is who the client authenticated as, when it sent credentials
+	Identity string `json:"identity,omitempty"`
+	// RemoteAddr is the client's network address
+	RemoteAddr string `json:"remote_addr"`
+	// ConnectedAt is when the client completed its handshake
+	ConnectedAt time.Time `json:"connected_at"`
+	// BytesIn and BytesOut count the bytes read from and written to the client, handshake included
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+	// Messages counts the messages a producer published or a consumer was delivered
+	Messages uint64 `json:"messages"`
+}
+
+// client is a connection tracked for the admin API
+type client struct {
+	id          string
+	role        string
+	topic       string
+	group       string
+	identity    string
+	remoteAddr  string
+	connectedAt time.Time
+	conn        net.Conn
+	// metrics are the Prometheus counters of the client's role
+	metrics *roleMetrics
+
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+	messages atomic.Uint64
+
+	// kicked is closed when an operator disconnects the client
+	kicked   chan struct{}
+	kickOnce sync.Once
+}
+
+// info returns a snapshot of the client's details and counters
+func (c *client) info() ClientInfo {
+	return ClientInfo{
+		ID:          c.id,
+		Role:        roleLabel(c.role),
+		Topic:       c.topic,
+		Group:       c.group,
+		Identity:    c.identity,
+		RemoteAddr:  c.remoteAddr,
+		ConnectedAt: c.connectedAt,
+		BytesIn:     c.bytesIn.Load(),
+		BytesOut:    c.bytesOut.Load(),
+		Messages:    c.messages.Load(),
+	}
+}
+
+// kick closes the client's connection, so its handler ends at its next read or write
+func (c *client) kick() {
+	c.kickOnce.Do(func() {
+		close(c.kicked)
+		_ = c.conn.Close()
+	})
+}
+
+// clientRegistry tracks the connections that completed a handshake
+type clientRegistry struct {
+	mu      sync.Mutex
+	clients map[string]*client
+	nextID  atomic.Uint64
+	metrics *brokerMetrics
+}
+
+// newClientRegistry creates an empty registry that also counts client traffic in metrics
+func newClientRegistry(metrics *brokerMetrics) *clientRegistry {
+	return &clientRegistry{clients: make(map[string]*client), metrics: metrics}
+}
+
+// add tracks a connection; handshakeBytes is the length of the handshake line it sent
+func (r *clientRegistry) add(conn net.Conn, role, topicName, group, identity string, handshakeBytes int) *client {
+	c := &client{
+		id:          fmt.Sprintf("client-%d", r.nextID.Add(1)),
+		role:        role,
+		topic:       topicName,
+		group:       group,
+		identity:    identity,
+		connectedAt: time.Now().UTC(),
+		conn:        conn,
+		metrics:     r.metrics.roles[role],
+		kicked:      make(chan struct{}),
+	}
+	if addr := conn.RemoteAddr(); addr != nil {
+		c.remoteAddr = addr.String()
+	}
+	c.bytesIn.Add(uint64(handshakeBytes))
+	c.metrics.bytesIn.Add(uint64(handshakeBytes))
+	c.metrics.connections.Inc()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clients[c.id] = c
+	return c
+}
+
+// remove stops tracking a connection once its handler has returned
+func (r *clientRegistry) remove(c *client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.clients, c.id)
+}
+
+// get returns a tracked connection by ID
+func (r *clientRegistry) get(id string) (*client, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.clients[id]
+	return c, ok
+}
+
+// list returns a snapshot of every tracked connection, oldest first
+func (r *clientRegistry) list() []ClientInfo {
+	r.mu.Lock()
+	clients := make([]ClientInfo, 0, len(r.clients))
+	for _, c := range r.clients {
+		clients = append(clients, c.info())
+	}
+	r.mu.Unlock()
+	sort.Slice(clients, func(i, j int) bool {
+		if !clients[i].ConnectedAt.Equal(clients[j].ConnectedAt) {
+			return clients[i].ConnectedAt.Before(clients[j].ConnectedAt)
+		}
+		return clients[i].ID < clients[j].ID
+	})
+	return clients
+}
+
+// clientFrameReader reads frames from a client, counting its bytes and published messages
+type clientFrameReader struct {
+	reader *BufferedFrameReader
+	c      *client
+}
+
+// ReadFrame reads a frame and updates the client's counters
+func (r *clientFrameReader) ReadFrame(buf []byte) ([]byte, error) {
+	body, err := r.reader.ReadFrame(buf)
+	if err != nil {
+		if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+			r.c.metrics.readErrors.Inc()
+		}
+		return body, err
+	}
+	n := uint64(frameHeaderSize + len(body))
+	r.c.bytesIn.Add(n)
+	r.c.metrics.bytesIn.Add(n)
+	r.c.metrics.messagesIn.Inc()
+	if r.c.role == roleProducer {
+		r.c.messages.Add(1)
+	}
+	return body, nil
+}
+
+// clientFrameWriter writes frames to a client, counting its bytes and delivered messages
+type clientFrameWriter struct {
+	writer *ConnectionFrameWriter
+	c      *client
+}
+
+// WriteFrame writes a frame and updates the client's counters
+func (w *clientFrameWriter) WriteFrame(data []byte) error {
+	if err := w.writer.WriteFrame(data); err != nil {
+		return err
+	}
+	n := uint64(frameHeaderSize + len(data))
+	w.c.bytesOut.Add(n)
+	w.c.metrics.bytesOut.Add(n)
+	w.c.metrics.messagesOut.Inc()
+	if w.c.role == roleConsumer {
+		w.c.messages.Add(1)
+	}
+	return nil
+}
+
+// frames returns the frame reader and writer of a tracked connection
+func (c *client) frames(br *bufio.Reader) (*clientFrameReader, *clientFrameWriter) {
+	return &clientFrameReader{reader: NewBufferedFrameReader(br), c: c},
+		&clientFrameWriter{writer: NewConnectionFrameWriter(c.conn), c: c}
+}
+
+// kicked returns a channel closed when an operator disconnects the client writing to w, or nil
+// (which never fires) for writers that are not tracked
+func kicked(w FrameWriter) <-chan struct{} {
+	if cw, ok := w.(*clientFrameWriter); ok {
+		return cw.c.kicked
+	}
+	return nil
+}
+
+// Clients returns the connected producers and consumers, oldest first
+func (b *Broker) Clients() []ClientInfo {
+	return b.clients.list()
+}
+
+// DisconnectClient closes a client's connection. Queue consumers' unacked deliveries are
+// requeued as on any disconnect.
+func (b *Broker) DisconnectClient(id string) error {
+	c, ok := b.clients.get(id)
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownClient, id)
+	}
+	b.logger.Warn("disconnecting client", "client_id", id, "role", c.role, "topic", c.topic, "remote_addr", c.remoteAddr)
+	c.kick()
+	return nil
+}
@@ -0,0 +1,104 @@
+package broker
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+// clientsByRole returns the connected clients of a role
+func clientsByRole(b *Broker, role string) []ClientInfo {
+	var clients []ClientInfo
+	for _, c := range b.Clients() {
+		if c.Role == role {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
+func TestClientsAreListedWithCounters(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Broadcast, logger)
+	defer b.Close()
+	tp := mustTopic(t, b, "telemetry")
+
+	conn := connectPipe(t, b, "CONSUMER telemetry\n")
+	waitFor(t, func() bool { return tp.registry.GetConsumerCount() == 1 })
+	go publish(b, "telemetry", "m1", "m2")
+	for range 2 {
+		if _, err := protocol.ReadFrame(conn, nil); err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+	}
+
+	// Counters are updated once a write returns, which may be after the client has read it
+	waitFor(t, func() bool {
+		consumers := clientsByRole(b, "consumer")
+		return len(clientsByRole(b, "producer")) == 0 && len(consumers) == 1 && consumers[0].Messages == 2
+	})
+	c := clientsByRole(b, "consumer")[0]
+	if c.Topic != "telemetry" || c.Messages != 2 || c.BytesIn != uint64(len("CONSUMER telemetry\n")) || c.BytesOut != 2*(frameHeaderSize+2) {
+		t.Fatalf("unexpected consumer info %+v", c)
+	}
+	if c.ConnectedAt.IsZero() || c.ID == "" {
+		t.Fatalf("expected an ID and a connection time, got %+v", c)
+	}
+}
+
+func TestDisconnectClient(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Broadcast, logger)
+	defer b.Close()
+	tp := mustTopic(t, b, "telemetry")
+
+	conn := connectPipe(t, b, "CONSUMER telemetry\n")
+	waitFor(t, func() bool { return tp.registry.GetConsumerCount() == 1 })
+	if err := b.DisconnectClient("client-404"); !errors.Is(err, ErrUnknownClient) {
+		t.Fatalf("expected ErrUnknownClient, got %v", err)
+	}
+	if err := b.DisconnectClient(b.Clients()[0].ID); err != nil {
+		t.Fatalf("DisconnectClient: %v", err)
+	}
+
+	// An idle broadcast consumer is unregistered right away, not at its next delivery
+	waitFor(t, func() bool { return tp.registry.GetConsumerCount() == 0 && len(b.Clients()) == 0 })
+	if _, err := protocol.ReadFrame(conn, nil); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+}
+
+func TestPurgeQueue(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBrokerWithConfig(Config{DefaultMode: Queue, Topics: map[string]TopicConfig{"telemetry": {Mode: ModeOf(Broadcast)}}}, logger)
+	defer b.Close()
+	tp := mustTopic(t, b, "jobs")
+	if _, err := b.getOrCreateGroup(tp, "writers"); err != nil {
+		t.Fatalf("getOrCreateGroup: %v", err)
+	}
+	publish(b, "jobs", "a", "b", "c")
+
+	stats := b.Stats()
+	if len(stats) != 1 || stats[0].QueueDepth != 3 || len(stats[0].Groups) != 1 || stats[0].Groups[0].QueueDepth != 3 {
+		t.Fatalf("expected a depth of 3 on the topic and its group, got %+v", stats)
+	}
+	if n, err := b.PurgeQueue("jobs", ""); err != nil || n != 3 {
+		t.Fatalf("expected 3 messages purged, got %d (err=%v)", n, err)
+	}
+	if n, err := b.PurgeQueue("jobs", "writers"); err != nil || n != 3 {
+		t.Fatalf("expected 3 group messages purged, got %d (err=%v)", n, err)
+	}
+	if tp.queue.Len() != 0 {
+		t.Fatalf("expected an empty queue, got %d", tp.queue.Len())
+	}
+
+	mustTopic(t, b, "telemetry")
+	for _, args := range [][2]string{{"telemetry", ""}, {"missing", ""}, {"jobs", "readers"}} {
+		if _, err := b.PurgeQueue(args[0], args[1]); err == nil {
+			t.Errorf("PurgeQueue(%q, %q) expected error", args[0], args[1])
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// TopicConfig holds the settings declared for a single topic
+type TopicConfig struct {
+	// Mode is the delivery mode used for the topic; nil uses Config.DefaultMode
+	Mode *DeliveryMode `json:"mode,omitempty"`
+	// TTLMs is how long after their timestamp the topic's messages expire, unless a message carries
+	// its own ttl_ms; 0 uses Config.MessageTTLMs and a negative value keeps them forever
+	TTLMs int64 `json:"ttl_ms"`
+	// PriorityLevels gives the topic's queue and its group queues that many priority levels
+	// (2 to MaxPriorityLevels); 0 keeps them FIFO
+	PriorityLevels int `json:"priority_levels"`
+	// Partitions splits the topic's queue and its group queues into that many partitions by
+	// message key (2 to MaxPartitions), each consumed by one consumer at a time; 0 keeps them whole
+	Partitions int `json:"partitions"`
+}
+
+// ModeOf returns a pointer to m, for setting TopicConfig.Mode
+func ModeOf(m DeliveryMode) *DeliveryMode {
+	return &m
+}
+
+// Storage types for StorageConfig.Type
+const (
+	StorageMemory = "memory"
+	StorageDisk   = "disk"
+)
+
+// StorageConfig selects the MessageQueue implementation backing queue-mode topics
+type StorageConfig struct {
+	// Type is StorageMemory (default) or StorageDisk
+	Type string `json:"type"`
+	// Dir is the root directory for disk queues; each topic gets its own subdirectory
+	Dir string `json:"dir"`
+	// Fsync selects when disk queues flush to stable storage
+	Fsync FsyncPolicy `json:"fsync"`
+	// FsyncIntervalMs is the background flush period for the "interval" policy
+	FsyncIntervalMs int `json:"fsync_interval_ms"`
+	// SegmentBytes is the size at which disk queues start a new segment file
+	SegmentBytes int64 `json:"segment_bytes"`
+	// MaxMessages bounds the undelivered messages per queue (default 10000)
+	MaxMessages int `json:"max_messages"`
+	// RetentionMessages is how many recent messages each topic keeps for replay (default 10000)
+	RetentionMessages int `json:"retention_messages"`
+}
+
+// diskOptions converts the storage settings into disk queue options
+func (s StorageConfig) diskOptions() DiskQueueOptions {
+	return DiskQueueOptions{
+		Fsync:         s.Fsync,
+		FsyncInterval: time.Duration(s.FsyncIntervalMs) * time.Millisecond,
+		SegmentBytes:  s.SegmentBytes,
+		MaxMessages:   s.MaxMessages,
+	}
+}
+
+// Config holds broker-wide settings and per-topic overrides
+type Config struct {
+	// DefaultMode is used for topics that have no entry in Topics
+	DefaultMode DeliveryMode `json:"default_mode"`
+	// Topics declares per-topic settings keyed by topic name
+	Topics map[string]TopicConfig `json:"topics"`
+	// Storage selects where queue-mode topics keep undelivered messages
+	Storage StorageConfig `json:"storage"`
+	// AckTimeout is how long a manual-ack consumer may hold a delivery before it is redelivered
+	AckTimeout time.Duration `json:"-"`
+	// MaxDeliveryAttempts is how many failed deliveries move a message to the topic's dead-letter
+	// topic (default 5); a negative value disables dead-lettering
+	MaxDeliveryAttempts int `json:"max_delivery_attempts"`
+	// ProducerCredits is the number of messages a flow-controlled producer may have sent but not yet
+	// had accepted by the broker (default 256)
+	ProducerCredits int `json:"producer_credits"`
+	// SlowConsumer is the default handling of broadcast consumers whose buffer is full;
+	// consumers may override it in their handshake
+	SlowConsumer SlowConsumerConfig `json:"slow_consumer"`
+	// Dedup bounds the per-topic index used to drop messages whose ID was recently published
+	Dedup DedupConfig `json:"dedup"`
+	// MessageTTLMs is the TTL of messages of topics without their own; 0 means they never expire
+	MessageTTLMs int64 `json:"message_ttl_ms"`
+	// DeadLetterExpired moves queued messages that expired to the topic's dead-letter topic
+	// instead of discarding them
+	DeadLetterExpired bool `json:"dead_letter_expired"`
+	// Health tunes the readiness and liveness checks
+	Health HealthConfig `json:"health"`
+	// Authenticator checks the credentials of clients; when nil, clients connect without any
+	Authenticator Authenticator `json:"-"`
+}
+
+// topicConfig returns the declared settings for a topic, falling back to the defaults. The
+// returned config always has a mode.
+func (c Config) topicConfig(name string) TopicConfig {
+	if tc, ok := c.Topics[name]; ok {
+		return c.withDefaultMode(tc)
+	}
+	// Dead letters wait in a queue until they are consumed or re-driven, and never expire
+	if isDeadLetterTopic(name) {
+		return TopicConfig{Mode: ModeOf(Queue), TTLMs: -1}
+	}
+	return c.withDefaultMode(TopicConfig{})
+}
+
+// withDefaultMode sets the mode of a topic config that has none to DefaultMode
+func (c Config) withDefaultMode(tc TopicConfig) TopicConfig {
+	if tc.Mode == nil {
+		tc.Mode = ModeOf(c.DefaultMode)
+	}
+	return tc
+}
+
+// validate checks the topic settings
+func (tc TopicConfig) validate() error {
+	if tc.PriorityLevels != 0 && (tc.PriorityLevels < 2 || tc.PriorityLevels > MaxPriorityLevels) {
+		return fmt.Errorf("%d priority levels, want 2 to %d", tc.PriorityLevels, MaxPriorityLevels)
+	}
+	if tc.Partitions != 0 && (tc.Partitions < 2 || tc.Partitions > MaxPartitions) {
+		return fmt.Errorf("%d partitions, want 2 to %d", tc.Partitions, MaxPartitions)
+	}
+	return nil
+}
+
+// Validate checks the storage settings and that all declared topics have valid names and settings
+func (c Config) Validate() error {
+	switch c.Storage.Type {
+	case "", StorageMemory:
+	case StorageDisk:
+		if c.Storage.Dir == "" {
+			return fmt.Errorf("invalid storage config: disk storage requires a directory")
+		}
+	default:
+		return fmt.Errorf("invalid storage config: unknown type %q", c.Storage.Type)
+	}
+	for name, tc := range c.Topics {
+		if err := validateTopicName(name); err != nil {
+			return fmt.Errorf("invalid topic config: %w", err)
+		}
+		if err := tc.validate(); err != nil {
+			return fmt.Errorf("invalid topic config for %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// LoadConfigFile reads a JSON broker config file, e.g.
+//
+//	{"default_mode": "broadcast", "topics": {"storage": {"mode": "queue"}}}
+//
+// Fields missing from the file keep the values from defaults.
+func LoadConfigFile(path string, defaults Config) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read broker config: %w", err)
+	}
+
+	cfg := defaults
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return Config{}, fmt.Errorf("failed to parse broker config: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
@@ -0,0 +1,129 @@
+package broker
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeliveryModeUnmarshalText(t *testing.T) {
+	var m DeliveryMode
+	if err := m.UnmarshalText([]byte("queue")); err != nil || m != Queue {
+		t.Fatalf("expected Queue, got %v (err=%v)", m, err)
+	}
+	if err := m.UnmarshalText([]byte("broadcast")); err != nil || m != Broadcast {
+		t.Fatalf("expected Broadcast, got %v (err=%v)", m, err)
+	}
+	if err := m.UnmarshalText([]byte("fanout")); err == nil {
+		t.Fatalf("expected error for unknown mode")
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.json")
+	data := `{"topics": {"telemetry": {"mode": "broadcast"}, "storage": {"mode": "queue"}}}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	cfg, err := LoadConfigFile(path, Config{DefaultMode: Queue})
+	if err != nil {
+		t.Fatalf("LoadConfigFile failed: %v", err)
+	}
+	if cfg.DefaultMode != Queue {
+		t.Errorf("expected default mode from defaults to be kept, got %v", cfg.DefaultMode)
+	}
+	if *cfg.topicConfig("telemetry").Mode != Broadcast {
+		t.Errorf("expected telemetry to be broadcast")
+	}
+	if *cfg.topicConfig("storage").Mode != Queue {
+		t.Errorf("expected storage to be queue")
+	}
+	if *cfg.topicConfig("other").Mode != Queue {
+		t.Errorf("expected undeclared topic to use default mode")
+	}
+}
+
+func TestLoadConfigFileTopicWithoutMode(t *testing.T) {
+	dir := t.TempDir()
+	for data, want := range map[string]DeliveryMode{
+		`{"topics": {"jobs": {"partitions": 4}}}`:                             Queue,
+		`{"default_mode": "broadcast", "topics": {"jobs": {"ttl_ms": 1000}}}`: Broadcast,
+	} {
+		path := filepath.Join(dir, "broker.json")
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		cfg, err := LoadConfigFile(path, Config{DefaultMode: Queue})
+		if err != nil {
+			t.Fatalf("LoadConfigFile failed: %v", err)
+		}
+		if m := *cfg.topicConfig("jobs").Mode; m != want {
+			t.Errorf("%s: expected a topic without a mode to use the default %v, got %v", data, want, m)
+		}
+	}
+
+	// Topics created through the API fall back the same way
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBrokerWithConfig(Config{DefaultMode: Queue}, logger)
+	defer b.Close()
+	if err := b.CreateTopic("jobs", TopicConfig{TTLMs: 1000}); err != nil {
+		t.Fatalf("CreateTopic failed: %v", err)
+	}
+	if m := mustTopic(t, b, "jobs").mode; m != Queue {
+		t.Errorf("expected jobs topic in queue mode, got %v", m)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := LoadConfigFile(filepath.Join(dir, "missing.json"), Config{}); err == nil {
+		t.Errorf("expected error for missing file")
+	}
+
+	cases := map[string]string{
+		"bad_mode.json":       `{"default_mode": "fanout"}`,
+		"bad_topic.json":      `{"topics": {"bad topic": {"mode": "queue"}}}`,
+		"bad_json.json":       `{"topics":`,
+		"bad_levels.json":     `{"topics": {"alerts": {"mode": "queue", "priority_levels": 1}}}`,
+		"bad_partitions.json": `{"topics": {"telemetry": {"mode": "queue", "partitions": 1}}}`,
+	}
+	for name, data := range cases {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		if _, err := LoadConfigFile(path, Config{}); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestBrokerPerTopicDeliveryMode(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBrokerWithConfig(Config{
+		DefaultMode: Broadcast,
+		Topics:      map[string]TopicConfig{"storage": {Mode: ModeOf(Queue)}},
+	}, logger)
+
+	if m := mustTopic(t, b, "storage").mode; m != Queue {
+		t.Errorf("expected storage topic in queue mode, got %v", m)
+	}
+	if m := mustTopic(t, b, "dashboards").mode; m != Broadcast {
+		t.Errorf("expected dashboards topic in broadcast mode, got %v", m)
+	}
+
+	if err := b.CreateTopic("alerts", TopicConfig{Mode: ModeOf(Queue)}); err != nil {
+		t.Fatalf("CreateTopic failed: %v", err)
+	}
+	if m := mustTopic(t, b, "alerts").mode; m != Queue {
+		t.Errorf("expected alerts topic in queue mode, got %v", m)
+	}
+	if err := b.CreateTopic("alerts", TopicConfig{Mode: ModeOf(Broadcast)}); err == nil {
+		t.Errorf("expected error creating an existing topic")
+	}
+	if err := b.CreateTopic("bad topic", TopicConfig{}); err == nil {
+		t.Errorf("expected error for invalid topic name")
+	}
+}
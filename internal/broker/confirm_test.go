@@ -0,0 +1,73 @@
+package broker
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+// readConfirm reads one producer confirm
+func readConfirm(t *testing.T, conn net.Conn) protocol.Confirm {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	body, err := protocol.ReadFrame(conn, nil)
+	if err != nil {
+		t.Fatalf("read confirm: %v", err)
+	}
+	f, err := protocol.DecodeTypedFrame(body)
+	if err != nil {
+		t.Fatalf("decode frame: %v", err)
+	}
+	c, err := protocol.DecodeConfirm(f)
+	if err != nil {
+		t.Fatalf("decode confirm: %v", err)
+	}
+	return c
+}
+
+func TestProducerConfirms(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Broadcast, logger)
+	defer b.Close()
+	tp := mustTopic(t, b, "telemetry")
+
+	conn := connectPipe(t, b, "PRODUCER telemetry confirm=true\n")
+	_ = protocol.WriteFrame(conn, []byte(`{"id":"m-1","type":"metric"}`))
+	if c := readConfirm(t, conn); !c.Acked || c.Seq != 1 || c.MessageID != "m-1" {
+		t.Fatalf("expected ack of message 1, got %+v", c)
+	}
+	_ = protocol.WriteFrame(conn, []byte("not json"))
+	if c := readConfirm(t, conn); !c.Acked || c.Seq != 2 || c.MessageID != "" {
+		t.Fatalf("expected ack of message 2 without an ID, got %+v", c)
+	}
+
+	// A message that cannot be stored for a consumer group is rejected with the reason
+	g, err := b.getOrCreateGroup(tp, "writers")
+	if err != nil {
+		t.Fatalf("getOrCreateGroup: %v", err)
+	}
+	_ = g.queue.Close()
+	_ = protocol.WriteFrame(conn, []byte(`{"id":"m-3"}`))
+	c := readConfirm(t, conn)
+	if c.Acked || c.Seq != 3 || c.MessageID != "m-3" || !strings.Contains(c.Reason, "writers") {
+		t.Fatalf("expected nack of message 3 naming the group, got %+v", c)
+	}
+}
+
+func TestParseProducerConfirm(t *testing.T) {
+	for line, want := range map[string]bool{"PRODUCER": false, "PRODUCER t confirm=true": true, "PRODUCER t confirm=false": false} {
+		hs, _ := protocol.ParseHandshake(line)
+		if got, err := parseProducerConfirm(hs); err != nil || got != want {
+			t.Errorf("%q: expected %v, got %v (err=%v)", line, want, got, err)
+		}
+	}
+	hs, _ := protocol.ParseHandshake("PRODUCER t confirm=yes")
+	if _, err := parseProducerConfirm(hs); err == nil {
+		t.Error("expected invalid confirm value to be rejected")
+	}
+}
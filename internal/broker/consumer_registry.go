@@ -1,17 +1,184 @@
 package broker
 
 import (
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/message-streaming-app/internal/common"
 )
 
+// ErrConsumerFull is returned by BroadcastMessage when a consumer's buffer was full and the
+// consumer missed a message because of it
+var ErrConsumerFull = errors.New("consumer buffer full")
+
+// defaultBlockTimeout is used when SlowConsumerConfig.BlockTimeoutMs is not set
+const defaultBlockTimeout = 100 * time.Millisecond
+
+// dropLogInterval is how many drops for one consumer are logged as a single warning
+const dropLogInterval = 1000
+
+// SlowConsumerPolicy decides what happens to a broadcast message when a consumer's buffer is full
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerDropNewest discards the new message for that consumer
+	SlowConsumerDropNewest SlowConsumerPolicy = iota
+	// SlowConsumerDropOldest discards the oldest buffered message to make room for the new one
+	SlowConsumerDropOldest
+	// SlowConsumerBlock waits up to the block timeout for room, then discards the new message
+	SlowConsumerBlock
+	// SlowConsumerDisconnect unregisters the consumer and discards its backlog, which closes its connection
+	SlowConsumerDisconnect
+)
+
+func (p SlowConsumerPolicy) String() string {
+	switch p {
+	case SlowConsumerDropNewest:
+		return "drop-newest"
+	case SlowConsumerDropOldest:
+		return "drop-oldest"
+	case SlowConsumerBlock:
+		return "block"
+	case SlowConsumerDisconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (p SlowConsumerPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (p *SlowConsumerPolicy) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "drop-newest":
+		*p = SlowConsumerDropNewest
+	case "drop-oldest":
+		*p = SlowConsumerDropOldest
+	case "block":
+		*p = SlowConsumerBlock
+	case "disconnect":
+		*p = SlowConsumerDisconnect
+	default:
+		return fmt.Errorf("unknown slow consumer policy %q", string(text))
+	}
+	return nil
+}
+
+// SlowConsumerConfig selects how a broadcast consumer with a full buffer is handled
+type SlowConsumerConfig struct {
+	// Policy is applied when the consumer's buffer is full
+	Policy SlowConsumerPolicy `json:"policy"`
+	// BlockTimeoutMs is how long SlowConsumerBlock waits for room (default 100)
+	BlockTimeoutMs int `json:"block_timeout_ms"`
+}
+
+// blockTimeout returns the block timeout, falling back to the default
+func (c SlowConsumerConfig) blockTimeout() time.Duration {
+	if c.BlockTimeoutMs <= 0 {
+		return defaultBlockTimeout
+	}
+	return time.Duration(c.BlockTimeoutMs) * time.Millisecond
+}
+
+// ConsumerStats describes one broadcast consumer
+type ConsumerStats struct {
+	// ID is the consumer ID assigned at registration
+	ID string `json:"id"`
+	// Policy is the consumer's slow consumer policy
+	Policy SlowConsumerPolicy `json:"policy"`
+	// Buffered is the number of messages waiting in the consumer's buffer
+	Buffered int `json:"buffered"`
+	// Dropped is the number of messages the consumer missed because its buffer was full
+	Dropped uint64 `json:"dropped"`
+}
+
+// broadcastConsumer is a registered consumer channel with its slow consumer policy.
+// mu serializes sends with close so a message is never sent on a closed channel.
+type broadcastConsumer struct {
+	id      string
+	ch      chan []byte
+	cfg     SlowConsumerConfig
+	dropped atomic.Uint64
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// send delivers msg according to the consumer's policy. It reports whether the consumer missed a
+// message and whether it must be disconnected.
+func (c *broadcastConsumer) send(msg []byte) (dropped, disconnect bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false, false
+	}
+
+	select {
+	case c.ch <- msg:
+		return false, false
+	default:
+	}
+
+	switch c.cfg.Policy {
+	case SlowConsumerDropOldest:
+		// Only the consumer receives from ch, so once one message is removed there is room
+		select {
+		case <-c.ch:
+		default:
+		}
+		select {
+		case c.ch <- msg:
+		default:
+		}
+	case SlowConsumerBlock:
+		timer := time.NewTimer(c.cfg.blockTimeout())
+		defer timer.Stop()
+		select {
+		case c.ch <- msg:
+			return false, false
+		case <-timer.C:
+		}
+	case SlowConsumerDisconnect:
+		// Discard the backlog so the consumer's handler stops after its current write
+		// instead of working through messages it is too slow for
+	drain:
+		for {
+			select {
+			case <-c.ch:
+				c.dropped.Add(1)
+			default:
+				break drain
+			}
+		}
+		c.closed = true
+		close(c.ch)
+		return true, true
+	}
+	return true, false
+}
+
+// close closes the consumer's channel once
+func (c *broadcastConsumer) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.ch)
+	}
+}
+
 // BroadcastRegistry manages consumer channels for broadcast delivery mode
 type BroadcastRegistry struct {
 	mu        sync.RWMutex
-	consumers map[string]chan []byte
+	consumers map[string]*broadcastConsumer
 	logger    Logger
 }
 
@@ -19,51 +186,76 @@ type BroadcastRegistry struct {
 func NewBroadcastRegistry(logger Logger) *BroadcastRegistry {
 	ChannelBufferSize := common.GetEnvInt("MAX_CONSUMERS", 10)
 	return &BroadcastRegistry{
-		consumers: make(map[string]chan []byte, ChannelBufferSize),
+		consumers: make(map[string]*broadcastConsumer, ChannelBufferSize),
 		logger:    logger,
 	}
 }
 
-// RegisterConsumer adds a channel for a consumer and returns its unique ID
+// RegisterConsumer adds a channel for a consumer that drops new messages while its buffer is full
+// and returns its unique ID
 func (r *BroadcastRegistry) RegisterConsumer(ch chan []byte) string {
+	return r.RegisterConsumerWithPolicy(ch, SlowConsumerConfig{})
+}
+
+// RegisterConsumerWithPolicy adds a channel for a consumer with the given slow consumer policy
+// and returns its unique ID
+func (r *BroadcastRegistry) RegisterConsumerWithPolicy(ch chan []byte, cfg SlowConsumerConfig) string {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	id := uuid.New().String()
-	r.consumers[id] = ch
-	r.logger.Info("consumer registered", "consumer_id", id, "total_consumers", len(r.consumers))
+	r.consumers[id] = &broadcastConsumer{id: id, ch: ch, cfg: cfg}
+	r.logger.Info("consumer registered", "consumer_id", id, "slow_consumer_policy", cfg.Policy.String(), "total_consumers", len(r.consumers))
 	return id
 }
 
 // UnregisterConsumer removes a consumer by ID
 func (r *BroadcastRegistry) UnregisterConsumer(id string) {
 	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	if ch, ok := r.consumers[id]; ok {
-		close(ch)
+	c, ok := r.consumers[id]
+	if ok {
 		delete(r.consumers, id)
-		r.logger.Info("consumer unregistered", "consumer_id", id, "remaining_consumers", len(r.consumers))
+	}
+	remaining := len(r.consumers)
+	r.mu.Unlock()
+
+	if ok {
+		c.close()
+		r.logger.Info("consumer unregistered", "consumer_id", id, "dropped", c.dropped.Load(), "remaining_consumers", remaining)
 	}
 }
 
-// BroadcastMessage sends a message to all registered consumers
+// BroadcastMessage sends a message to all registered consumers. Each consumer whose buffer is
+// full is handled by its own policy, so a slow consumer never keeps the others from receiving the
+// message. It returns ErrConsumerFull if any consumer missed it.
 func (r *BroadcastRegistry) BroadcastMessage(msg []byte) error {
 	r.mu.RLock()
-	chans := make([]chan []byte, 0, len(r.consumers))
-	for _, ch := range r.consumers {
-		chans = append(chans, ch)
+	consumers := make([]*broadcastConsumer, 0, len(r.consumers))
+	for _, c := range r.consumers {
+		consumers = append(consumers, c)
 	}
 	r.mu.RUnlock()
 
-	for _, ch := range chans {
+	missed := 0
+	for _, c := range consumers {
 		msgCopy := append([]byte(nil), msg...)
-		select {
-		case ch <- msgCopy:
-		default:
-			r.logger.Warn("consumer channel full, dropping message")
-			return fmt.Errorf("consumer channel full")
+		dropped, disconnect := c.send(msgCopy)
+		if !dropped {
+			continue
+		}
+		missed++
+		n := c.dropped.Add(1)
+		if disconnect {
+			r.logger.Warn("consumer buffer full, disconnecting slow consumer", "consumer_id", c.id)
+			r.UnregisterConsumer(c.id)
+			continue
 		}
+		if n == 1 || n%dropLogInterval == 0 {
+			r.logger.Warn("consumer buffer full, dropping messages", "consumer_id", c.id, "policy", c.cfg.Policy.String(), "dropped", n)
+		}
+	}
+	if missed > 0 {
+		return fmt.Errorf("%w: %d of %d consumers missed the message", ErrConsumerFull, missed, len(consumers))
 	}
 	return nil
 }
@@ -75,12 +267,23 @@ func (r *BroadcastRegistry) GetConsumerCount() int {
 	return len(r.consumers)
 }
 
+// ConsumerStats returns the buffer usage and drop counter of every registered consumer
+func (r *BroadcastRegistry) ConsumerStats() []ConsumerStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	stats := make([]ConsumerStats, 0, len(r.consumers))
+	for id, c := range r.consumers {
+		stats = append(stats, ConsumerStats{ID: id, Policy: c.cfg.Policy, Buffered: len(c.ch), Dropped: c.dropped.Load()})
+	}
+	return stats
+}
+
 // Close closes all consumer channels and clears the registry
 func (r *BroadcastRegistry) Close() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	for id, ch := range r.consumers {
-		close(ch)
+	for id, c := range r.consumers {
+		c.close()
 		delete(r.consumers, id)
 	}
 	return nil
@@ -0,0 +1,223 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deadLetterSuffix is appended to a topic name to form the name of its dead-letter topic
+const deadLetterSuffix = ".dlq"
+
+// defaultMaxDeliveryAttempts is used when Config.MaxDeliveryAttempts is not set
+const defaultMaxDeliveryAttempts = 5
+
+// DeadLetter is a message that was moved to a dead-letter topic after failing too many times.
+// Dead-letter topics carry DeadLetter values encoded as JSON.
+type DeadLetter struct {
+	// Offset is the position of the dead letter in the dead-letter topic's log
+	Offset uint64 `json:"offset"`
+	// Topic is the topic the message was published to
+	Topic string `json:"topic"`
+	// Group is the consumer group that failed to process the message, if any
+	Group string `json:"group,omitempty"`
+	// ConsumerID is the replaying consumer that rejected the message, if any
+	ConsumerID string `json:"consumer_id,omitempty"`
+	// SourceOffset is the message's offset in the topic log when a replaying consumer rejected it
+	SourceOffset *uint64 `json:"source_offset,omitempty"`
+	// Attempts is the number of failed deliveries
+	Attempts int `json:"attempts"`
+	// Reason describes the last failure, e.g. a nack reason
+	Reason string `json:"reason"`
+	// DeadLetteredAt is when the message was moved
+	DeadLetteredAt time.Time `json:"dead_lettered_at"`
+	// Payload is the original message
+	Payload []byte `json:"payload"`
+}
+
+// redeliveryPolicy decides when a message that keeps failing is moved to a dead-letter topic
+type redeliveryPolicy struct {
+	// maxAttempts is the number of failed deliveries after which a message is dead-lettered; 0 never does
+	maxAttempts int
+	// deadLetter moves a message to the dead-letter topic
+	deadLetter func(msg []byte, attempts int, reason string) error
+}
+
+// attemptCounter counts failed deliveries per message. Messages are identified by a hash of their
+// contents, so identical messages share a count. Only messages that failed at least once and have
+// not been settled since are tracked.
+type attemptCounter struct {
+	mu     sync.Mutex
+	counts map[uint64]int
+}
+
+// newAttemptCounter creates an empty counter
+func newAttemptCounter() *attemptCounter {
+	return &attemptCounter{counts: make(map[uint64]int)}
+}
+
+// fail records a failed delivery and returns the number of failures so far
+func (a *attemptCounter) fail(msg []byte) int {
+	key := messageKey(msg)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.counts[key]++
+	return a.counts[key]
+}
+
+// forget drops the count of a message
+func (a *attemptCounter) forget(msg []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.counts) == 0 {
+		return
+	}
+	delete(a.counts, messageKey(msg))
+}
+
+// messageKey hashes a message's contents
+func messageKey(msg []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(msg)
+	return h.Sum64()
+}
+
+// isDeadLetterTopic reports whether a topic name is a dead-letter topic
+func isDeadLetterTopic(name string) bool {
+	return strings.HasSuffix(name, deadLetterSuffix)
+}
+
+// deadLetterTopicName returns the name of a topic's dead-letter topic
+func deadLetterTopicName(name string) string {
+	return name + deadLetterSuffix
+}
+
+// deadLettersEnabled reports whether failed messages of a topic are dead-lettered.
+// Dead-letter topics never dead-letter their own messages.
+func (b *Broker) deadLettersEnabled(topicName string) bool {
+	return b.cfg.MaxDeliveryAttempts >= 0 && !isDeadLetterTopic(topicName)
+}
+
+// redeliveryPolicy returns the dead-letter policy for messages of a topic or one of its groups
+func (b *Broker) redeliveryPolicy(topicName, group string) redeliveryPolicy {
+	if !b.deadLettersEnabled(topicName) {
+		return redeliveryPolicy{}
+	}
+	return redeliveryPolicy{
+		maxAttempts: b.cfg.MaxDeliveryAttempts,
+		deadLetter: func(msg []byte, attempts int, reason string) error {
+			return b.deadLetter(DeadLetter{Topic: topicName, Group: group, Attempts: attempts, Reason: reason, Payload: msg})
+		},
+	}
+}
+
+// deadLetter publishes a failed message to its topic's dead-letter topic
+func (b *Broker) deadLetter(dl DeadLetter) error {
+	dt, err := b.getOrCreateTopic(deadLetterTopicName(dl.Topic))
+	if err != nil {
+		return err
+	}
+	dl.DeadLetteredAt = time.Now().UTC()
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return fmt.Errorf("failed to encode dead letter: %w", err)
+	}
+	if err := b.publish(dt, data); err != nil {
+		return fmt.Errorf("failed to publish dead letter: %w", err)
+	}
+	b.logger.Warn("message dead-lettered", "topic", dl.Topic, "group", dl.Group, "consumer_id", dl.ConsumerID, "attempts", dl.Attempts, "reason", dl.Reason, "dead_letter_topic", dt.name)
+	return nil
+}
+
+// DeadLetters returns up to limit of the most recent dead letters of a topic that are still
+// retained in its dead-letter topic's log, oldest first, along with the number still waiting in
+// the dead-letter queue. The log keeps dead letters that were already re-driven or consumed.
+func (b *Broker) DeadLetters(topicName string, limit int) ([]DeadLetter, int, error) {
+	dt, err := b.existingTopic(deadLetterTopicName(topicName))
+	if err != nil || dt == nil {
+		return nil, 0, err
+	}
+
+	first, next := dt.log.bounds()
+	if limit > 0 && next-first > uint64(limit) {
+		first = next - uint64(limit)
+	}
+	letters := make([]DeadLetter, 0, next-first)
+	for offset := first; offset < next; offset++ {
+		rec, err := dt.log.read(offset)
+		if errors.Is(err, errOffsetOutOfRange) {
+			// Dropped by retention since bounds was taken
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		var dl DeadLetter
+		if err := json.Unmarshal(rec.msg, &dl); err != nil {
+			return nil, 0, fmt.Errorf("failed to decode dead letter %d: %w", offset, err)
+		}
+		dl.Offset = offset
+		letters = append(letters, dl)
+	}
+	return letters, dt.queue.Len(), nil
+}
+
+// RedriveDeadLetters moves up to limit dead letters (all of them if limit <= 0) from a topic's
+// dead-letter queue back to where they failed, with a fresh attempt count: a group's letters go
+// back on the group's queue, and the others on the topic queue in queue mode or to the end of the
+// topic log otherwise, where replaying consumers pick them up under a new offset.
+// It returns the number of messages re-driven.
+func (b *Broker) RedriveDeadLetters(topicName string, limit int) (int, error) {
+	dt, err := b.existingTopic(deadLetterTopicName(topicName))
+	if err != nil || dt == nil {
+		return 0, err
+	}
+	t, err := b.getOrCreateTopic(topicName)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for limit <= 0 || n < limit {
+		data, err := dt.queue.Dequeue()
+		if errors.Is(err, ErrQueueEmpty) {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+
+		var dl DeadLetter
+		if err := json.Unmarshal(data, &dl); err != nil {
+			b.logger.Error("dropping undecodable dead letter", "topic", dt.name, "error", err)
+			continue
+		}
+		if err := b.redrive(t, dl); err != nil {
+			_ = dt.queue.Enqueue(data)
+			return n, fmt.Errorf("failed to re-drive dead letter: %w", err)
+		}
+		n++
+	}
+	b.logger.Info("dead letters re-driven", "topic", topicName, "count", n)
+	return n, nil
+}
+
+// redrive puts a dead letter's payload back where it failed
+func (b *Broker) redrive(t *topic, dl DeadLetter) error {
+	if dl.Group != "" {
+		g, err := b.getOrCreateGroup(t, dl.Group)
+		if err != nil {
+			return err
+		}
+		return g.queue.Enqueue(dl.Payload)
+	}
+	if t.mode == Queue {
+		return t.queue.Enqueue(dl.Payload)
+	}
+	_, err := t.log.append(dl.Payload)
+	return err
+}
@@ -0,0 +1,155 @@
+package broker
+
+import (
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+func TestNackedMessageIsDeadLettered(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBrokerWithConfig(Config{DefaultMode: Queue, MaxDeliveryAttempts: 3}, logger)
+	defer b.Close()
+	q := mustTopic(t, b, "jobs").queue
+	_ = q.Enqueue([]byte("poison"))
+	_ = q.Enqueue([]byte("ok"))
+
+	conn := connectPipe(t, b, "CONSUMER jobs ack=manual prefetch=1\n")
+	poisonDeliveries := 0
+	for poisonDeliveries < 3 {
+		f := readTyped(t, conn)
+		if string(f.Body) == "poison" {
+			poisonDeliveries++
+			sendTyped(t, conn, protocol.TypedFrame{Type: protocol.FrameNack, Tag: f.Tag, Body: []byte("invalid JSON")})
+			continue
+		}
+		sendTyped(t, conn, protocol.TypedFrame{Type: protocol.FrameAck, Tag: f.Tag})
+	}
+
+	var letters []DeadLetter
+	var pending int
+	waitFor(t, func() bool {
+		var err error
+		letters, pending, err = b.DeadLetters("jobs", 10)
+		return err == nil && len(letters) == 1
+	})
+	dl := letters[0]
+	if dl.Topic != "jobs" || dl.Attempts != 3 || dl.Reason != "invalid JSON" || string(dl.Payload) != "poison" {
+		t.Fatalf("unexpected dead letter %+v", dl)
+	}
+	if pending != 1 {
+		t.Fatalf("expected 1 pending dead letter, got %d", pending)
+	}
+	if q.Len() != 0 {
+		t.Fatalf("expected the poison message to leave the queue, queue has %d", q.Len())
+	}
+	conn.Close()
+
+	// Re-driving puts it back on the queue and leaves the history in the log
+	n, err := b.RedriveDeadLetters("jobs", 0)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 message re-driven, got %d (err=%v)", n, err)
+	}
+	waitFor(t, func() bool { return q.Len() == 1 })
+	if letters, pending, _ := b.DeadLetters("jobs", 10); len(letters) != 1 || pending != 0 {
+		t.Fatalf("expected history of 1 and nothing pending, got %d and %d", len(letters), pending)
+	}
+}
+
+func TestDeadLetterAttemptsResetOnAck(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBrokerWithConfig(Config{DefaultMode: Queue, MaxDeliveryAttempts: 2}, logger)
+	defer b.Close()
+	_ = mustTopic(t, b, "jobs").queue.Enqueue([]byte("m1"))
+
+	conn := connectPipe(t, b, "CONSUMER jobs ack=manual prefetch=1\n")
+	f := readTyped(t, conn)
+	sendTyped(t, conn, protocol.TypedFrame{Type: protocol.FrameNack, Tag: f.Tag})
+	f = readTyped(t, conn)
+	sendTyped(t, conn, protocol.TypedFrame{Type: protocol.FrameAck, Tag: f.Tag})
+
+	// The same content published again starts with a clean slate
+	publish(b, "jobs", "m1")
+	f = readTyped(t, conn)
+	sendTyped(t, conn, protocol.TypedFrame{Type: protocol.FrameNack, Tag: f.Tag})
+	if f = readTyped(t, conn); string(f.Body) != "m1" {
+		t.Fatalf("expected m1 redelivered, got %q", f.Body)
+	}
+	if letters, _, _ := b.DeadLetters("jobs", 10); len(letters) != 0 {
+		t.Fatalf("expected no dead letters, got %+v", letters)
+	}
+}
+
+func TestConsumerGroupDeadLetterRedrivesToGroup(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBrokerWithConfig(Config{DefaultMode: Broadcast, MaxDeliveryAttempts: 1}, logger)
+	defer b.Close()
+	tp := mustTopic(t, b, "telemetry")
+
+	conn := connectPipe(t, b, "CONSUMER telemetry ack=manual group=writers\n")
+	waitFor(t, func() bool { return groupMembers(tp, "writers") == 1 })
+	publish(b, "telemetry", "bad")
+	f := readTyped(t, conn)
+	sendTyped(t, conn, protocol.TypedFrame{Type: protocol.FrameNack, Tag: f.Tag, Body: []byte("mongo down")})
+
+	waitFor(t, func() bool {
+		letters, _, _ := b.DeadLetters("telemetry", 0)
+		return len(letters) == 1 && letters[0].Group == "writers"
+	})
+	if n, err := b.RedriveDeadLetters("telemetry", 0); err != nil || n != 1 {
+		t.Fatalf("expected 1 message re-driven, got %d (err=%v)", n, err)
+	}
+	if f := readTyped(t, conn); string(f.Body) != "bad" {
+		t.Fatalf("expected re-driven message on the group, got %q", f.Body)
+	}
+}
+
+func TestReplayConsumerNackDeadLetters(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Broadcast, logger)
+	defer b.Close()
+	publish(b, "events", "a", "b")
+
+	conn := connectPipe(t, b, "CONSUMER events id=writer\n")
+	readOffsets(t, conn, 2)
+	sendTyped(t, conn, protocol.TypedFrame{Type: protocol.FrameNack, Tag: 1, Body: []byte("invalid JSON")})
+
+	var letters []DeadLetter
+	waitFor(t, func() bool {
+		letters, _, _ = b.DeadLetters("events", 0)
+		return len(letters) == 1
+	})
+	dl := letters[0]
+	if dl.ConsumerID != "writer" || dl.SourceOffset == nil || *dl.SourceOffset != 1 || string(dl.Payload) != "b" {
+		t.Fatalf("unexpected dead letter %+v", dl)
+	}
+
+	// Re-driving appends the message to the log again under a new offset
+	if n, err := b.RedriveDeadLetters("events", 0); err != nil || n != 1 {
+		t.Fatalf("expected 1 message re-driven, got %d (err=%v)", n, err)
+	}
+	if got := readOffsets(t, conn, 1); got != "[2:b]" {
+		t.Fatalf("expected re-driven message at offset 2, got %s", got)
+	}
+}
+
+func TestDeadLetteringDisabled(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBrokerWithConfig(Config{DefaultMode: Queue, MaxDeliveryAttempts: -1}, logger)
+	defer b.Close()
+	_ = mustTopic(t, b, "jobs").queue.Enqueue([]byte("m1"))
+
+	conn := connectPipe(t, b, "CONSUMER jobs ack=manual prefetch=1\n")
+	for i := 0; i < defaultMaxDeliveryAttempts+1; i++ {
+		f := readTyped(t, conn)
+		if string(f.Body) != "m1" {
+			t.Fatalf("expected m1 redelivered, got %q", f.Body)
+		}
+		sendTyped(t, conn, protocol.TypedFrame{Type: protocol.FrameNack, Tag: f.Tag})
+	}
+	if dt, err := b.existingTopic("jobs.dlq"); err != nil || dt != nil {
+		t.Fatal("expected no dead-letter topic when dead-lettering is disabled")
+	}
+}
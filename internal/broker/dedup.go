@@ -0,0 +1,133 @@
+package broker
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultDedupWindow is used when DedupConfig.WindowMs is not set
+const defaultDedupWindow = 2 * time.Minute
+
+// defaultDedupMaxEntries is used when DedupConfig.MaxEntries is not set
+const defaultDedupMaxEntries = 100000
+
+// DedupConfig bounds the index of recently published message IDs used to drop repeats
+type DedupConfig struct {
+	// WindowMs is how long a message ID is remembered (default 120000); a negative value disables
+	// deduplication
+	WindowMs int `json:"window_ms"`
+	// MaxEntries is how many IDs each topic remembers at most (default 100000); the oldest are
+	// forgotten first
+	MaxEntries int `json:"max_entries"`
+}
+
+// window returns the dedup window, falling back to the default
+func (c DedupConfig) window() time.Duration {
+	if c.WindowMs == 0 {
+		return defaultDedupWindow
+	}
+	return time.Duration(c.WindowMs) * time.Millisecond
+}
+
+// maxEntries returns the index bound, falling back to the default
+func (c DedupConfig) maxEntries() int {
+	if c.MaxEntries <= 0 {
+		return defaultDedupMaxEntries
+	}
+	return c.MaxEntries
+}
+
+// dedupKey returns the key a message is deduplicated on: its ID, or else its producer ID and
+// sequence number. Messages without either are never treated as duplicates.
+func dedupKey(env envelope) string {
+	if env.ID != "" {
+		return "id:" + env.ID
+	}
+	if env.ProducerID != "" && env.Seq != nil {
+		return "seq:" + env.ProducerID + "/" + strconv.FormatUint(*env.Seq, 10)
+	}
+	return ""
+}
+
+// dedupEntry is a remembered key and when it was first published
+type dedupEntry struct {
+	key string
+	at  time.Time
+}
+
+// dedupIndex remembers the keys of messages published to a topic within the dedup window.
+// Entries are kept in publish order, which is also expiry order, so the oldest are evicted first
+// both when they fall out of the window and when the index is full.
+type dedupIndex struct {
+	window     time.Duration
+	maxEntries int
+
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	order []dedupEntry
+	head  int
+}
+
+// newDedupIndex creates an index for the given settings, or returns nil if deduplication is disabled
+func newDedupIndex(cfg DedupConfig) *dedupIndex {
+	if cfg.WindowMs < 0 {
+		return nil
+	}
+	return &dedupIndex{
+		window:     cfg.window(),
+		maxEntries: cfg.maxEntries(),
+		seen:       make(map[string]time.Time),
+	}
+}
+
+// check reports whether key was already published within the window. If it was not, the key is
+// remembered from now on, so a concurrent publish of the same message is also caught.
+func (d *dedupIndex) check(key string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.evict(now.Add(-d.window), -1)
+	if _, ok := d.seen[key]; ok {
+		return true
+	}
+	d.evict(now.Add(-d.window), d.maxEntries-1)
+	d.seen[key] = now
+	d.order = append(d.order, dedupEntry{key: key, at: now})
+	return false
+}
+
+// forget drops a key whose message could not be published, so a retry is not mistaken for a duplicate
+func (d *dedupIndex) forget(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// The stale entry left in order is skipped when it is evicted
+	delete(d.seen, key)
+}
+
+// len returns the number of remembered keys
+func (d *dedupIndex) len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.seen)
+}
+
+// evict forgets the keys published before cutoff and, while more than keep keys are remembered,
+// the oldest ones; a negative keep means no bound. The caller holds mu.
+func (d *dedupIndex) evict(cutoff time.Time, keep int) {
+	for d.head < len(d.order) {
+		e := d.order[d.head]
+		if !e.at.Before(cutoff) && (keep < 0 || len(d.seen) <= keep) {
+			break
+		}
+		if at, ok := d.seen[e.key]; ok && at.Equal(e.at) {
+			delete(d.seen, e.key)
+		}
+		d.order[d.head] = dedupEntry{}
+		d.head++
+	}
+	// Reclaim the evicted prefix once it makes up most of the slice
+	if d.head > 1024 && d.head > len(d.order)/2 {
+		d.order = append([]dedupEntry(nil), d.order[d.head:]...)
+		d.head = 0
+	}
+}
@@ -0,0 +1,72 @@
+package broker
+
+import (
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDuplicateMessagesAreDropped(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Queue, logger)
+	defer b.Close()
+	q := mustTopic(t, b, "jobs").queue
+
+	publish(b, "jobs",
+		`{"id":"m-1","payload":1}`,
+		`{"id":"m-1","payload":1}`,
+		`{"producer_id":"csv","seq":7}`,
+		`{"producer_id":"csv","seq":7}`,
+		`{"producer_id":"csv","seq":8}`,
+		"not json",
+		"not json",
+	)
+	if q.Len() != 5 {
+		t.Fatalf("expected 5 messages after dropping duplicates, got %d", q.Len())
+	}
+	stats := b.Stats()
+	if len(stats) != 1 || stats[0].Published != 5 || stats[0].Duplicates != 2 || stats[0].DedupEntries != 3 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestDeduplicationDisabled(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBrokerWithConfig(Config{DefaultMode: Queue, Dedup: DedupConfig{WindowMs: -1}}, logger)
+	defer b.Close()
+	q := mustTopic(t, b, "jobs").queue
+
+	publish(b, "jobs", `{"id":"m-1"}`, `{"id":"m-1"}`)
+	if q.Len() != 2 {
+		t.Fatalf("expected both messages without deduplication, got %d", q.Len())
+	}
+}
+
+func TestDedupIndexIsBounded(t *testing.T) {
+	d := newDedupIndex(DedupConfig{WindowMs: 1000, MaxEntries: 2})
+	now := time.Now()
+	for _, key := range []string{"a", "b", "c"} {
+		if d.check(key, now) {
+			t.Fatalf("expected %q to be new", key)
+		}
+	}
+	// The oldest key is forgotten once the index is full
+	if d.check("a", now) {
+		t.Fatal("expected a to have been evicted")
+	}
+	if !d.check("c", now) {
+		t.Fatal("expected c to be a duplicate")
+	}
+
+	// Keys are forgotten once they fall out of the window
+	if d.check("c", now.Add(2*time.Second)) {
+		t.Fatal("expected c to have expired")
+	}
+
+	// A key whose message failed to publish can be published again
+	d.forget("c")
+	if d.check("c", now.Add(2*time.Second)) {
+		t.Fatal("expected c to be forgotten")
+	}
+}
@@ -0,0 +1,391 @@
+package broker
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FsyncPolicy controls when the disk queue flushes writes to stable storage
+type FsyncPolicy int
+
+const (
+	// FsyncInterval flushes in the background every DiskQueueOptions.FsyncInterval
+	FsyncInterval FsyncPolicy = iota
+	// FsyncAlways flushes after every enqueue and dequeue; safest and slowest
+	FsyncAlways
+	// FsyncNever leaves flushing to the operating system
+	FsyncNever
+)
+
+func (p FsyncPolicy) String() string {
+	switch p {
+	case FsyncInterval:
+		return "interval"
+	case FsyncAlways:
+		return "always"
+	case FsyncNever:
+		return "never"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (p FsyncPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (p *FsyncPolicy) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "interval":
+		*p = FsyncInterval
+	case "always":
+		*p = FsyncAlways
+	case "never":
+		*p = FsyncNever
+	default:
+		return fmt.Errorf("unknown fsync policy %q", string(text))
+	}
+	return nil
+}
+
+// cursorFileName holds the committed offset: the first message that was not consumed or settled yet
+const cursorFileName = "cursor"
+
+// DiskQueueOptions tunes a DiskMessageQueue
+type DiskQueueOptions struct {
+	// Fsync selects when writes are flushed to disk
+	Fsync FsyncPolicy
+	// FsyncInterval is the background flush period for FsyncInterval (default 1s)
+	FsyncInterval time.Duration
+	// SegmentBytes is the size at which a new segment file is started (default 16MiB)
+	SegmentBytes int64
+	// MaxMessages bounds the number of undelivered messages (default 10000)
+	MaxMessages int
+}
+
+// withDefaults fills in unset options
+func (o DiskQueueOptions) withDefaults() DiskQueueOptions {
+	if o.FsyncInterval <= 0 {
+		o.FsyncInterval = time.Second
+	}
+	if o.SegmentBytes <= 0 {
+		o.SegmentBytes = 16 * 1024 * 1024
+	}
+	if o.MaxMessages <= 0 {
+		o.MaxMessages = 10000
+	}
+	return o
+}
+
+// DiskMessageQueue is a persistent MessageQueue built on an append-only segmented log.
+// Enqueue appends to the log and head marks the next message to dequeue. Messages dequeued for
+// delivery stay in flight until they are settled (acked, requeued or dead-lettered). A persisted
+// cursor holds the committed offset, the oldest message not yet consumed or settled, and segments
+// behind it are deleted. On open, a torn tail left by a crash is truncated, and the queue resumes
+// from the committed offset, so messages that were undelivered or delivered but never settled are
+// available again.
+type DiskMessageQueue struct {
+	mu     sync.Mutex
+	log    *segmentLog
+	cursor *os.File
+	head   uint64
+	// committed is the offset last written to the cursor
+	committed uint64
+	// inflight holds the messages dequeued for delivery and not settled yet, oldest first. A settled
+	// message stays until the ones before it are settled too, as the committed offset cannot pass them.
+	inflight []inflightRecord
+	opts     DiskQueueOptions
+	logger   Logger
+
+	// notify is closed and replaced whenever a message is appended
+	notify chan struct{}
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// inflightRecord is a message dequeued for delivery, identified by its content hash
+type inflightRecord struct {
+	offset  uint64
+	key     uint64
+	settled bool
+}
+
+// NewDiskMessageQueue opens (or creates) a disk queue in dir and recovers its state
+func NewDiskMessageQueue(dir string, opts DiskQueueOptions, logger Logger) (*DiskMessageQueue, error) {
+	opts = opts.withDefaults()
+	log, err := openSegmentLog(dir, opts.SegmentBytes)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := os.OpenFile(filepath.Join(dir, cursorFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		log.close()
+		return nil, fmt.Errorf("failed to open queue cursor: %w", err)
+	}
+
+	q := &DiskMessageQueue{
+		log:    log,
+		cursor: cursor,
+		opts:   opts,
+		logger: logger,
+		notify: make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+
+	// Resume from the persisted cursor, clamped to the records that survived recovery
+	var buf [8]byte
+	q.head = log.firstOffset()
+	if n, _ := cursor.ReadAt(buf[:], 0); n == len(buf) {
+		q.head = binary.BigEndian.Uint64(buf[:])
+	}
+	if first := log.firstOffset(); q.head < first {
+		q.head = first
+	}
+	if next := log.nextOffset(); q.head > next {
+		q.head = next
+	}
+	q.committed = q.head
+
+	if opts.Fsync == FsyncInterval {
+		q.wg.Add(1)
+		go q.syncLoop()
+	}
+	logger.Info("disk queue opened", "dir", dir, "pending_messages", q.Len(), "fsync", opts.Fsync.String())
+	return q, nil
+}
+
+// Enqueue appends a message to the log
+func (q *DiskMessageQueue) Enqueue(msg []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.isClosed() {
+		return ErrQueueClosed
+	}
+	if q.lenLocked() >= q.opts.MaxMessages {
+		q.logger.Warn("queue full, message dropped", "queue_size", q.opts.MaxMessages, "pending_messages", q.lenLocked())
+		return ErrQueueFull
+	}
+
+	if _, err := q.log.append(msg); err != nil {
+		return err
+	}
+	if q.opts.Fsync == FsyncAlways {
+		if err := q.log.sync(); err != nil {
+			return err
+		}
+	}
+
+	close(q.notify)
+	q.notify = make(chan struct{})
+	return nil
+}
+
+// Dequeue retrieves the next message without blocking
+func (q *DiskMessageQueue) Dequeue() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.isClosed() {
+		return nil, ErrQueueClosed
+	}
+	return q.dequeueLocked(false)
+}
+
+// DequeueContext blocks until a message is available, ctx is done or the queue is closed
+func (q *DiskMessageQueue) DequeueContext(ctx context.Context) ([]byte, error) {
+	return q.dequeueContext(ctx, false)
+}
+
+// dequeueUnsettled implements settlingQueue
+func (q *DiskMessageQueue) dequeueUnsettled() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.isClosed() {
+		return nil, ErrQueueClosed
+	}
+	return q.dequeueLocked(true)
+}
+
+// dequeueUnsettledContext implements settlingQueue
+func (q *DiskMessageQueue) dequeueUnsettledContext(ctx context.Context) ([]byte, error) {
+	return q.dequeueContext(ctx, true)
+}
+
+// dequeueContext blocks until a message is available, ctx is done or the queue is closed. An
+// unsettled message is kept in flight until it is settled.
+func (q *DiskMessageQueue) dequeueContext(ctx context.Context, unsettled bool) ([]byte, error) {
+	for {
+		q.mu.Lock()
+		if q.isClosed() {
+			q.mu.Unlock()
+			return nil, ErrQueueClosed
+		}
+		msg, err := q.dequeueLocked(unsettled)
+		if err != ErrQueueEmpty {
+			q.mu.Unlock()
+			return msg, err
+		}
+		notify := q.notify
+		q.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-q.closed:
+			return nil, ErrQueueClosed
+		}
+	}
+}
+
+// dequeueLocked reads the record at head and advances it. An unsettled record is kept in flight;
+// any other is consumed right away, which commits it once no earlier record is in flight.
+func (q *DiskMessageQueue) dequeueLocked(unsettled bool) ([]byte, error) {
+	if q.head >= q.log.nextOffset() {
+		return nil, ErrQueueEmpty
+	}
+	msg, err := q.log.read(q.head)
+	if err != nil {
+		return nil, err
+	}
+	if unsettled {
+		q.inflight = append(q.inflight, inflightRecord{offset: q.head, key: messageKey(msg)})
+	}
+	q.head++
+	if err := q.commitLocked(); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// settle implements settlingQueue: it marks the oldest in-flight record with the message's content
+// as settled, and commits the records that are no longer in flight
+func (q *DiskMessageQueue) settle(msg []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.isClosed() {
+		return
+	}
+	key := messageKey(msg)
+	for i := range q.inflight {
+		if r := &q.inflight[i]; !r.settled && r.key == key {
+			r.settled = true
+			break
+		}
+	}
+	n := 0
+	for n < len(q.inflight) && q.inflight[n].settled {
+		n++
+	}
+	q.inflight = q.inflight[n:]
+	if err := q.commitLocked(); err != nil {
+		q.logger.Error("failed to commit settled messages", "error", err)
+	}
+}
+
+// commitLocked persists the committed offset, the oldest record in flight or else head, if it
+// moved, and drops the segments behind it
+func (q *DiskMessageQueue) commitLocked() error {
+	committed := q.head
+	if len(q.inflight) > 0 {
+		committed = q.inflight[0].offset
+	}
+	if committed == q.committed {
+		return nil
+	}
+
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], committed)
+	if _, err := q.cursor.WriteAt(buf[:], 0); err != nil {
+		return fmt.Errorf("failed to persist queue cursor: %w", err)
+	}
+	if q.opts.Fsync == FsyncAlways {
+		if err := q.cursor.Sync(); err != nil {
+			return err
+		}
+	}
+	q.committed = committed
+	if err := q.log.truncateBefore(committed); err != nil {
+		q.logger.Warn("failed to delete consumed segments", "error", err)
+	}
+	return nil
+}
+
+// IsFull checks if the queue is at capacity
+func (q *DiskMessageQueue) IsFull() bool {
+	return q.Len() >= q.opts.MaxMessages
+}
+
+// Len returns the number of undelivered messages
+func (q *DiskMessageQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.lenLocked()
+}
+
+func (q *DiskMessageQueue) lenLocked() int {
+	if q.isClosed() {
+		return 0
+	}
+	return int(q.log.nextOffset() - q.head)
+}
+
+// Close flushes and closes the queue files; undelivered messages remain on disk
+func (q *DiskMessageQueue) Close() error {
+	q.mu.Lock()
+	if q.isClosed() {
+		q.mu.Unlock()
+		return nil
+	}
+	close(q.closed)
+	q.mu.Unlock()
+	q.wg.Wait()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	syncErr := q.log.sync()
+	if err := q.cursor.Sync(); err != nil && syncErr == nil {
+		syncErr = err
+	}
+	_ = q.cursor.Close()
+	_ = q.log.close()
+	return syncErr
+}
+
+// syncLoop periodically flushes the log and cursor for FsyncInterval
+func (q *DiskMessageQueue) syncLoop() {
+	defer q.wg.Done()
+	ticker := time.NewTicker(q.opts.FsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.closed:
+			return
+		case <-ticker.C:
+			q.mu.Lock()
+			if err := q.log.sync(); err != nil {
+				q.logger.Error("disk queue fsync failed", "error", err)
+			}
+			if err := q.cursor.Sync(); err != nil {
+				q.logger.Error("disk queue cursor fsync failed", "error", err)
+			}
+			q.mu.Unlock()
+		}
+	}
+}
+
+// isClosed reports whether Close has been called
+func (q *DiskMessageQueue) isClosed() bool {
+	select {
+	case <-q.closed:
+		return true
+	default:
+		return false
+	}
+}
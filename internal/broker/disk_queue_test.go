@@ -0,0 +1,277 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestDiskQueue(t *testing.T, dir string, opts DiskQueueOptions) *DiskMessageQueue {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	q, err := NewDiskMessageQueue(dir, opts, logger)
+	if err != nil {
+		t.Fatalf("NewDiskMessageQueue: %v", err)
+	}
+	return q
+}
+
+func TestDiskMessageQueue_EnqueueDequeue(t *testing.T) {
+	q := newTestDiskQueue(t, t.TempDir(), DiskQueueOptions{Fsync: FsyncAlways})
+	defer q.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := q.Enqueue([]byte(fmt.Sprintf("msg-%d", i))); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+	if q.Len() != 3 {
+		t.Fatalf("expected 3 messages, got %d", q.Len())
+	}
+	for i := 0; i < 3; i++ {
+		msg, err := q.Dequeue()
+		if err != nil || string(msg) != fmt.Sprintf("msg-%d", i) {
+			t.Fatalf("expected msg-%d, got %q (err=%v)", i, msg, err)
+		}
+	}
+	if _, err := q.Dequeue(); !errors.Is(err, ErrQueueEmpty) {
+		t.Fatalf("expected ErrQueueEmpty, got %v", err)
+	}
+}
+
+func TestDiskMessageQueue_SurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	q := newTestDiskQueue(t, dir, DiskQueueOptions{})
+	_ = q.Enqueue([]byte("delivered"))
+	_ = q.Enqueue([]byte("pending-1"))
+	_ = q.Enqueue([]byte("pending-2"))
+	if msg, _ := q.Dequeue(); string(msg) != "delivered" {
+		t.Fatalf("unexpected first message %q", msg)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	q = newTestDiskQueue(t, dir, DiskQueueOptions{})
+	defer q.Close()
+	if q.Len() != 2 {
+		t.Fatalf("expected 2 pending messages after reopen, got %d", q.Len())
+	}
+	if msg, _ := q.Dequeue(); string(msg) != "pending-1" {
+		t.Fatalf("expected pending-1, got %q", msg)
+	}
+}
+
+func TestDiskMessageQueue_RedeliversUnsettled(t *testing.T) {
+	dir := t.TempDir()
+	q := newTestDiskQueue(t, dir, DiskQueueOptions{})
+	for _, m := range []string{"a", "b", "c"} {
+		_ = q.Enqueue([]byte(m))
+	}
+	for _, want := range []string{"a", "b"} {
+		if msg, err := q.dequeueUnsettled(); err != nil || string(msg) != want {
+			t.Fatalf("expected %s, got %q (err=%v)", want, msg, err)
+		}
+	}
+	// b is settled, but a is still unacked, so the cursor cannot move past it
+	q.settle([]byte("b"))
+	q.Close()
+
+	q = newTestDiskQueue(t, dir, DiskQueueOptions{})
+	if q.Len() != 3 {
+		t.Fatalf("expected the unacked messages to be pending again, got %d", q.Len())
+	}
+	for _, want := range []string{"a", "b"} {
+		if msg, _ := q.dequeueUnsettled(); string(msg) != want {
+			t.Fatalf("expected %s to be redelivered, got %q", want, msg)
+		}
+	}
+	q.settle([]byte("b"))
+	q.settle([]byte("a"))
+	q.Close()
+
+	q = newTestDiskQueue(t, dir, DiskQueueOptions{})
+	defer q.Close()
+	if q.Len() != 1 {
+		t.Fatalf("expected only c after settling a and b, got %d", q.Len())
+	}
+	if msg, _ := q.Dequeue(); string(msg) != "c" {
+		t.Fatalf("expected c, got %q", msg)
+	}
+}
+
+func TestDispatcherRequeueOnFullDiskQueue(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	q := newTestDiskQueue(t, t.TempDir(), DiskQueueOptions{MaxMessages: 1})
+	d := newDispatcher("jobs", "", q, redeliveryPolicy{}, logger)
+	defer q.Close()
+	defer d.close()
+
+	c := d.register(1)
+	_ = q.Enqueue([]byte("m0"))
+	m0 := receiveRaw(t, c)
+	_ = q.Enqueue([]byte("m1"))
+
+	// The queue is full, so the dispatcher keeps m0 and delivers it before m1
+	d.requeue(m0)
+	c.release(m0)
+	for _, want := range []string{"m0", "m1"} {
+		msg := receiveRaw(t, c)
+		if string(msg) != want {
+			t.Fatalf("expected %s, got %q", want, msg)
+		}
+		d.settled(msg)
+		c.release(msg)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.inflight) != 0 || q.committed != q.head {
+		t.Fatalf("expected every delivery to be committed, got %d in flight", len(q.inflight))
+	}
+}
+
+func TestDiskMessageQueue_RecoversTornTail(t *testing.T) {
+	dir := t.TempDir()
+	q := newTestDiskQueue(t, dir, DiskQueueOptions{})
+	_ = q.Enqueue([]byte("intact-1"))
+	_ = q.Enqueue([]byte("intact-2"))
+	q.Close()
+
+	// Simulate a crash in the middle of writing a third record
+	logPath := filepath.Join(dir, fmt.Sprintf(segmentNameFormat, 0)+segmentLogSuffix)
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("open segment: %v", err)
+	}
+	_, _ = f.Write([]byte{0, 0, 0, 20, 1, 2, 3, 4, 'p', 'a', 'r'})
+	f.Close()
+
+	q = newTestDiskQueue(t, dir, DiskQueueOptions{})
+	defer q.Close()
+	if q.Len() != 2 {
+		t.Fatalf("expected torn record to be discarded, got %d messages", q.Len())
+	}
+	_ = q.Enqueue([]byte("after-crash"))
+	for _, want := range []string{"intact-1", "intact-2", "after-crash"} {
+		msg, err := q.Dequeue()
+		if err != nil || string(msg) != want {
+			t.Fatalf("expected %s, got %q (err=%v)", want, msg, err)
+		}
+	}
+}
+
+func TestDiskMessageQueue_RollsAndDeletesSegments(t *testing.T) {
+	dir := t.TempDir()
+	q := newTestDiskQueue(t, dir, DiskQueueOptions{SegmentBytes: 64})
+	defer q.Close()
+
+	payload := bytes.Repeat([]byte("x"), 40)
+	for i := 0; i < 10; i++ {
+		if err := q.Enqueue(payload); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+	countSegments := func() int {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*"+segmentLogSuffix))
+		return len(matches)
+	}
+	if n := countSegments(); n < 5 {
+		t.Fatalf("expected several segments, got %d", n)
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := q.Dequeue(); err != nil {
+			t.Fatalf("dequeue %d: %v", i, err)
+		}
+	}
+	if n := countSegments(); n != 1 {
+		t.Fatalf("expected consumed segments to be deleted, %d remain", n)
+	}
+}
+
+func TestDiskMessageQueue_FullAndBlockingDequeue(t *testing.T) {
+	q := newTestDiskQueue(t, t.TempDir(), DiskQueueOptions{MaxMessages: 1, Fsync: FsyncNever})
+
+	_ = q.Enqueue([]byte("one"))
+	if !q.IsFull() {
+		t.Fatal("expected queue to be full")
+	}
+	if err := q.Enqueue([]byte("two")); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+	_, _ = q.Dequeue()
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = q.Enqueue([]byte("late"))
+	}()
+	msg, err := q.DequeueContext(context.Background())
+	if err != nil || string(msg) != "late" {
+		t.Fatalf("expected late, got %q (err=%v)", msg, err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Close()
+	}()
+	if _, err := q.DequeueContext(context.Background()); !errors.Is(err, ErrQueueClosed) {
+		t.Fatalf("expected ErrQueueClosed, got %v", err)
+	}
+}
+
+func TestFsyncPolicyUnmarshalText(t *testing.T) {
+	var p FsyncPolicy
+	for _, name := range []string{"always", "interval", "never"} {
+		if err := p.UnmarshalText([]byte(name)); err != nil || p.String() != name {
+			t.Errorf("UnmarshalText(%q) = %v (err=%v)", name, p, err)
+		}
+	}
+	if err := p.UnmarshalText([]byte("sometimes")); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
+
+func TestBrokerDiskStorageRecoversTopics(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	cfg := Config{DefaultMode: Queue, Storage: StorageConfig{Type: StorageDisk, Dir: t.TempDir()}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	b := NewBrokerWithConfig(cfg, logger)
+	data := append([]byte("PRODUCER jobs\n"), frameBytes([]byte("persisted"))...)
+	b.HandleConn(&simpleConn{readBuf: bytes.NewReader(data), writeBuf: &bytes.Buffer{}})
+	if _, ok := mustTopic(t, b, "jobs").queue.(*DiskMessageQueue); !ok {
+		t.Fatal("expected queue topic to use the disk queue")
+	}
+	b.Close()
+
+	restarted := NewBrokerWithConfig(cfg, logger)
+	defer restarted.Close()
+	if err := restarted.RecoverTopics(); err != nil {
+		t.Fatalf("RecoverTopics: %v", err)
+	}
+	if len(restarted.Topics()) != 1 {
+		t.Fatalf("expected recovered topic, got %v", restarted.Topics())
+	}
+	msg, err := mustTopic(t, restarted, "jobs").queue.Dequeue()
+	if err != nil || string(msg) != "persisted" {
+		t.Fatalf("expected persisted message after restart, got %q (err=%v)", msg, err)
+	}
+}
+
+func TestConfigValidateStorage(t *testing.T) {
+	if err := (Config{Storage: StorageConfig{Type: StorageDisk}}).Validate(); err == nil {
+		t.Error("expected error for disk storage without directory")
+	}
+	if err := (Config{Storage: StorageConfig{Type: "tape"}}).Validate(); err == nil {
+		t.Error("expected error for unknown storage type")
+	}
+}
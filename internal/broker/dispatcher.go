@@ -0,0 +1,628 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// queueConsumer is a consumer attached to a dispatcher.
+// Each delivery handed to it holds one of its slots until the consumer releases it, which bounds
+// the number of messages buffered or unacknowledged per consumer.
+type queueConsumer struct {
+	id    string
+	out   chan []byte
+	slots chan struct{}
+	d     *dispatcher
+
+	// ctx is cancelled when the consumer is unregistered
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	closed bool
+
+	// held counts, by message content hash, the deliveries from a partitioned queue the consumer has
+	// not released yet; guarded by the dispatcher's mu
+	held map[uint64]heldDelivery
+}
+
+// heldDelivery is the partition of a delivery a consumer holds, and how many identical ones it holds
+type heldDelivery struct {
+	partition int
+	n         int
+}
+
+// deliver hands a message to the consumer; it returns false if the consumer has left
+func (c *queueConsumer) deliver(msg []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	// out has the same capacity as slots, so a reserved slot guarantees room
+	c.out <- msg
+	return true
+}
+
+// release frees the slot of a finished delivery and lets the dispatcher pick this consumer again
+func (c *queueConsumer) release(msg []byte) {
+	<-c.slots
+	c.d.released(c, msg)
+	c.d.signal()
+}
+
+// partitionAssignment is the consumer a partition of a partitioned queue is handed to
+type partitionAssignment struct {
+	owner *queueConsumer
+	// ctx is cancelled when the partition is assigned to another consumer
+	ctx    context.Context
+	cancel context.CancelFunc
+	// holder is the consumer holding held unreleased deliveries of the partition. A partition that
+	// moved is only handed to its new owner once the previous one released them, so messages with
+	// the same key are never processed by two consumers at once.
+	holder *queueConsumer
+	held   int
+	// backlog holds the partition's messages taken from its queue but not handed to a consumer yet,
+	// oldest first. The unfinished deliveries of a consumer that left are put back at its front.
+	backlog [][]byte
+}
+
+// wake cancels the partition's context, so its loop stops waiting on an empty queue and sees its
+// backlog. The caller holds the dispatcher's mu.
+func (a *partitionAssignment) wake(parent context.Context) {
+	if a.cancel != nil {
+		a.cancel()
+		a.ctx, a.cancel = context.WithCancel(parent)
+	}
+}
+
+// dispatcher moves messages from a queue to competing consumers in round-robin order.
+// It only dequeues once a consumer has a free slot, so undelivered messages stay in the queue.
+// A PartitionedMessageQueue is dispatched partition by partition instead: each partition is
+// assigned to exactly one consumer, and the partitions are rebalanced when consumers join or leave.
+type dispatcher struct {
+	topic    string
+	group    string
+	queue    MessageQueue
+	policy   redeliveryPolicy
+	attempts *attemptCounter
+	logger   Logger
+
+	mu        sync.Mutex
+	consumers []*queueConsumer
+	next      int
+
+	// partitioned is the queue when it is partitioned, and assignments its partitions' consumers
+	partitioned *PartitionedMessageQueue
+	assignments []partitionAssignment
+	// overflow holds requeued messages that did not fit in the full queue, oldest first. They are
+	// dispatched before the queue's messages. A partitioned queue keeps them in its partitions' backlogs.
+	overflow [][]byte
+
+	// wake is closed and replaced whenever a consumer joins, leaves or frees a slot
+	wake   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	// stopped is set once the dispatch loops have exited and the partition backlogs were requeued
+	stopped bool
+}
+
+// newDispatcher creates a dispatcher for a queue and starts its dispatch loop.
+// group names the consumer group the queue belongs to, or is empty for a queue-mode topic's own queue.
+func newDispatcher(topic, group string, queue MessageQueue, policy redeliveryPolicy, logger Logger) *dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &dispatcher{
+		topic:    topic,
+		group:    group,
+		queue:    queue,
+		policy:   policy,
+		attempts: newAttemptCounter(),
+		logger:   logger,
+		wake:     make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	if pq, ok := queue.(*PartitionedMessageQueue); ok {
+		d.partitioned = pq
+		d.assignments = make([]partitionAssignment, len(pq.partitions))
+	}
+	go d.run(ctx)
+	return d
+}
+
+// register attaches a consumer that may hold up to prefetch deliveries at a time
+func (d *dispatcher) register(prefetch int) *queueConsumer {
+	ctx, cancel := context.WithCancel(d.ctx)
+	c := &queueConsumer{
+		id:     uuid.New().String(),
+		out:    make(chan []byte, prefetch),
+		slots:  make(chan struct{}, prefetch),
+		d:      d,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	d.mu.Lock()
+	d.consumers = append(d.consumers, c)
+	d.rebalance()
+	count := len(d.consumers)
+	d.mu.Unlock()
+
+	d.logger.Info("queue consumer registered", "topic", d.topic, "group", d.group, "consumer_id", c.id, "total_consumers", count)
+	d.signal()
+	return c
+}
+
+// unregister detaches a consumer and returns the messages handed to it that it never picked up.
+// The partitions it held deliveries of stay blocked for their new owners until giveBack is called.
+func (d *dispatcher) unregister(c *queueConsumer) [][]byte {
+	d.mu.Lock()
+	for i, other := range d.consumers {
+		if other == c {
+			d.consumers = append(d.consumers[:i], d.consumers[i+1:]...)
+			if i < d.next {
+				d.next--
+			}
+			break
+		}
+	}
+	if d.next >= len(d.consumers) {
+		d.next = 0
+	}
+	d.rebalance()
+	count := len(d.consumers)
+	d.mu.Unlock()
+	d.signal()
+
+	c.cancel()
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+
+	var pending [][]byte
+	for {
+		select {
+		case msg := <-c.out:
+			pending = append(pending, msg)
+		default:
+			d.logger.Info("queue consumer unregistered", "topic", d.topic, "group", d.group, "consumer_id", c.id, "remaining_consumers", count)
+			return pending
+		}
+	}
+}
+
+// giveBack puts back the deliveries a consumer that left did not finish, in the order they were
+// handed to it: unacked ones count as failed attempts and may be dead-lettered, pending ones go back
+// as they are. A partitioned queue's messages go to the front of their partition's backlog, ahead of
+// the messages dequeued after them, and only then are the consumer's partitions released to their
+// new owners, so each key keeps its order across a rebalance.
+func (d *dispatcher) giveBack(c *queueConsumer, unacked, pending [][]byte) {
+	d.mu.Lock()
+	stopped := d.stopped
+	d.mu.Unlock()
+	if d.partitioned == nil || stopped {
+		for _, msg := range unacked {
+			d.retry(msg, "consumer disconnected")
+		}
+		for _, msg := range pending {
+			d.requeue(msg)
+		}
+		return
+	}
+
+	returned := make([][][]byte, len(d.assignments))
+	for _, msg := range unacked {
+		if !d.deadLettered(msg, "consumer disconnected") {
+			p := d.partitioned.partitionOf(msg)
+			returned[p] = append(returned[p], msg)
+		}
+	}
+	for _, msg := range pending {
+		p := d.partitioned.partitionOf(msg)
+		returned[p] = append(returned[p], msg)
+	}
+
+	d.mu.Lock()
+	if d.stopped {
+		// The dispatcher stopped meanwhile; its queue takes the messages back
+		d.mu.Unlock()
+		for _, msgs := range returned {
+			for _, msg := range msgs {
+				d.requeue(msg)
+			}
+		}
+		return
+	}
+	for p := range d.assignments {
+		a := &d.assignments[p]
+		if len(returned[p]) > 0 {
+			a.backlog = append(returned[p], a.backlog...)
+			a.wake(d.ctx)
+		}
+		if a.holder == c {
+			a.holder, a.held = nil, 0
+		}
+	}
+	c.held = nil
+	d.mu.Unlock()
+	d.signal()
+}
+
+// backlogLen returns the number of messages waiting to be dispatched: those in the queue, in the
+// overflow, and those already taken from a partition but not handed to a consumer yet
+func (d *dispatcher) backlogLen() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := d.queue.Len() + len(d.overflow)
+	for _, a := range d.assignments {
+		n += len(a.backlog)
+	}
+	return n
+}
+
+// consumerCount returns the number of attached consumers
+func (d *dispatcher) consumerCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.consumers)
+}
+
+// signal wakes the dispatch loops
+func (d *dispatcher) signal() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	close(d.wake)
+	d.wake = make(chan struct{})
+}
+
+// close stops the dispatch loop and waits for it to exit. Messages left in the overflow and the
+// partition backlogs are put back on the queue, which is closed after its dispatcher.
+func (d *dispatcher) close() {
+	d.cancel()
+	<-d.done
+
+	d.mu.Lock()
+	d.stopped = true
+	backlog := d.overflow
+	d.overflow = nil
+	for p := range d.assignments {
+		backlog = append(backlog, d.assignments[p].backlog...)
+		d.assignments[p].backlog = nil
+	}
+	d.mu.Unlock()
+	for _, msg := range backlog {
+		d.requeue(msg)
+	}
+}
+
+// run dispatches the queue until ctx is done or the queue is closed, with one loop per partition
+// if the queue is partitioned
+func (d *dispatcher) run(ctx context.Context) {
+	defer close(d.done)
+	if d.partitioned == nil {
+		d.dispatch(ctx)
+		return
+	}
+	var wg sync.WaitGroup
+	for p := range d.assignments {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.dispatchPartition(ctx, p)
+		}()
+	}
+	wg.Wait()
+}
+
+// dispatch is the dispatch loop: reserve the next consumer with a free slot, wait for a message, hand it over
+func (d *dispatcher) dispatch(ctx context.Context) {
+	for {
+		c, err := d.reserve(ctx)
+		if err != nil {
+			return
+		}
+
+		msg := d.takeOverflow()
+		if msg == nil {
+			msg, err = dequeueForDelivery(c.ctx, d.queue)
+		}
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, ErrQueueClosed) {
+				return
+			}
+			// The reserved consumer left while we were waiting; pick another one
+			continue
+		}
+
+		if !c.deliver(msg) {
+			// The consumer left right after the dequeue; put the message back for the others
+			d.requeue(msg)
+		}
+	}
+}
+
+// requeue puts a message that never reached a consumer back on the queue. The delivered copy is
+// settled only once the new one is queued, so a persistent queue keeps one of them either way.
+// The queue's capacity bounds new messages only: a message that does not fit in a full queue is
+// kept by the dispatcher until it is dispatched again.
+func (d *dispatcher) requeue(msg []byte) {
+	if d.queue.IsFull() && d.retain(msg) {
+		return
+	}
+	err := d.queue.Enqueue(msg)
+	if err == nil {
+		settleIn(d.queue, msg)
+		return
+	}
+	if errors.Is(err, ErrQueueFull) && d.retain(msg) {
+		return
+	}
+	d.logger.Error("failed to requeue message", "topic", d.topic, "group", d.group, "error", err)
+}
+
+// retain keeps a requeued message that does not fit in the queue, in the overflow or at the end of
+// its partition's backlog. It returns false once the dispatcher has stopped.
+func (d *dispatcher) retain(msg []byte) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		return false
+	}
+	d.logger.Warn("queue full, keeping requeued message until it is dispatched", "topic", d.topic, "group", d.group)
+	if d.partitioned == nil {
+		d.overflow = append(d.overflow, msg)
+		return true
+	}
+	a := &d.assignments[d.partitioned.partitionOf(msg)]
+	a.backlog = append(a.backlog, msg)
+	a.wake(d.ctx)
+	return true
+}
+
+// takeOverflow removes and returns the oldest overflow message, or nil if there is none
+func (d *dispatcher) takeOverflow() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.overflow) == 0 {
+		return nil
+	}
+	msg := d.overflow[0]
+	d.overflow = d.overflow[1:]
+	return msg
+}
+
+// retry handles a delivery that failed (nack, ack timeout or consumer disconnect): it counts the
+// attempt and requeues the message, or moves it to the dead-letter topic once it has failed
+// policy.maxAttempts times
+func (d *dispatcher) retry(msg []byte, reason string) {
+	if !d.deadLettered(msg, reason) {
+		d.requeue(msg)
+	}
+}
+
+// deadLettered counts a failed delivery, and moves the message to the dead-letter topic once it has
+// failed policy.maxAttempts times; it reports whether it did
+func (d *dispatcher) deadLettered(msg []byte, reason string) bool {
+	n := d.attempts.fail(msg)
+	if d.policy.maxAttempts <= 0 || n < d.policy.maxAttempts {
+		return false
+	}
+	if err := d.policy.deadLetter(msg, n, reason); err != nil {
+		d.logger.Error("failed to dead-letter message, requeueing", "topic", d.topic, "group", d.group, "error", err)
+		return false
+	}
+	d.settled(msg)
+	return true
+}
+
+// settled forgets the failed attempts of a message once a consumer has processed it, and lets a
+// persistent queue drop it
+func (d *dispatcher) settled(msg []byte) {
+	d.attempts.forget(msg)
+	settleIn(d.queue, msg)
+}
+
+// reserve takes a slot on the next consumer in round-robin order that has one free,
+// blocking until such a consumer exists or ctx is done
+func (d *dispatcher) reserve(ctx context.Context) (*queueConsumer, error) {
+	for {
+		d.mu.Lock()
+		n := len(d.consumers)
+		for i := 0; i < n; i++ {
+			idx := (d.next + i) % n
+			c := d.consumers[idx]
+			select {
+			case c.slots <- struct{}{}:
+				d.next = (idx + 1) % n
+				d.mu.Unlock()
+				return c, nil
+			default:
+			}
+		}
+		wake := d.wake
+		d.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// dispatchPartition is the dispatch loop of one partition: take the partition's next message,
+// reserve a slot on the partition's consumer, hand it over. The slot is only taken once there is a
+// message, so an empty partition does not hold one of its consumer's slots, and a consumer that
+// owns more partitions than its prefetch still gets the messages of the busy ones. Messages wait in
+// the partition's backlog until they are handed over, so the partition's order is preserved when
+// it moves to another consumer.
+func (d *dispatcher) dispatchPartition(ctx context.Context, p int) {
+	queue := d.partitioned.partition(p)
+	for {
+		assigned, empty, err := d.partitionContext(ctx, p)
+		if err != nil {
+			return
+		}
+		if empty {
+			msg, err := dequeueForDelivery(assigned, queue)
+			if err != nil {
+				if ctx.Err() != nil || errors.Is(err, ErrQueueClosed) {
+					return
+				}
+				// The partition moved or got messages back from a consumer that left; look again
+				continue
+			}
+			d.mu.Lock()
+			d.assignments[p].backlog = append(d.assignments[p].backlog, msg)
+			d.mu.Unlock()
+		}
+
+		if err := d.deliverPartition(ctx, p); err != nil {
+			// The dispatcher is closing; close puts the backlog back on the queue
+			return
+		}
+	}
+}
+
+// partitionContext blocks until partition p is assigned to a consumer, and returns a context that
+// is cancelled when the partition is reassigned or gets messages back, and whether its backlog is empty
+func (d *dispatcher) partitionContext(ctx context.Context, p int) (context.Context, bool, error) {
+	for {
+		d.mu.Lock()
+		a := d.assignments[p]
+		wake := d.wake
+		d.mu.Unlock()
+		if a.owner != nil {
+			return a.ctx, len(a.backlog) == 0, nil
+		}
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+// deliverPartition hands the oldest message of partition p's backlog to the consumer the partition
+// is assigned to, blocking until it has a free slot and holds no deliveries of the partition from
+// its previous owner. The consumer cannot leave meanwhile, as it is unregistered under mu.
+func (d *dispatcher) deliverPartition(ctx context.Context, p int) error {
+	for {
+		d.mu.Lock()
+		a := &d.assignments[p]
+		if a.owner != nil && (a.held == 0 || a.holder == a.owner) {
+			select {
+			case a.owner.slots <- struct{}{}:
+				msg := a.backlog[0]
+				a.backlog = a.backlog[1:]
+				d.hold(a.owner, p, msg)
+				a.owner.deliver(msg)
+				d.mu.Unlock()
+				return nil
+			default:
+			}
+		}
+		wake := d.wake
+		d.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// hold records that a consumer receives a message of partition p. The caller holds mu.
+func (d *dispatcher) hold(c *queueConsumer, p int, msg []byte) {
+	a := &d.assignments[p]
+	a.holder = c
+	a.held++
+	if c.held == nil {
+		c.held = make(map[uint64]heldDelivery)
+	}
+	key := messageKey(msg)
+	h := c.held[key]
+	c.held[key] = heldDelivery{partition: p, n: h.n + 1}
+}
+
+// released records that a consumer finished a delivery, which may let its partition move to a new owner
+func (d *dispatcher) released(c *queueConsumer, msg []byte) {
+	if d.partitioned == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := messageKey(msg)
+	h, ok := c.held[key]
+	if !ok {
+		return
+	}
+	if h.n--; h.n == 0 {
+		delete(c.held, key)
+	} else {
+		c.held[key] = h
+	}
+	if a := &d.assignments[h.partition]; a.holder == c {
+		if a.held--; a.held == 0 {
+			a.holder = nil
+		}
+	}
+}
+
+// rebalance assigns every partition to one consumer so each gets the same number, give or take
+// one. Partitions stay with their consumer where that keeps the spread even, so a join or leave
+// only moves the partitions it has to. The caller holds mu.
+func (d *dispatcher) rebalance() {
+	if d.partitioned == nil {
+		return
+	}
+	n := len(d.consumers)
+	quota := make(map[*queueConsumer]int, n)
+	for i, c := range d.consumers {
+		quota[c] = len(d.assignments) / n
+		if i < len(d.assignments)%n {
+			quota[c]++
+		}
+	}
+
+	owners := make([]*queueConsumer, len(d.assignments))
+	for p, a := range d.assignments {
+		if quota[a.owner] > 0 {
+			owners[p] = a.owner
+			quota[a.owner]--
+		}
+	}
+	next := 0
+	for p := range owners {
+		if owners[p] != nil || n == 0 {
+			continue
+		}
+		for quota[d.consumers[next]] == 0 {
+			next++
+		}
+		owners[p] = d.consumers[next]
+		quota[owners[p]]--
+	}
+
+	moved := 0
+	for p := range d.assignments {
+		a := &d.assignments[p]
+		if a.owner == owners[p] {
+			continue
+		}
+		if a.cancel != nil {
+			a.cancel()
+		}
+		a.owner = owners[p]
+		a.ctx, a.cancel = context.WithCancel(d.ctx)
+		moved++
+	}
+	d.logger.Info("partitions rebalanced", "topic", d.topic, "group", d.group, "partitions", len(d.assignments), "consumers", n, "moved", moved)
+}
@@ -0,0 +1,126 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+// receive waits for one delivery on a queue consumer and frees its slot
+func receive(t *testing.T, c *queueConsumer) string {
+	t.Helper()
+	select {
+	case msg := <-c.out:
+		c.release(msg)
+		return string(msg)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("consumer %s received nothing", c.id)
+		return ""
+	}
+}
+
+func TestMemoryMessageQueue_DequeueContextBlocks(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	queue := NewMemoryMessageQueue(10, logger)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = queue.Enqueue([]byte("late"))
+	}()
+	msg, err := queue.DequeueContext(context.Background())
+	if err != nil || string(msg) != "late" {
+		t.Fatalf("expected blocking dequeue to return late message, got %q (err=%v)", msg, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := queue.DequeueContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		queue.Close()
+	}()
+	if _, err := queue.DequeueContext(context.Background()); !errors.Is(err, ErrQueueClosed) {
+		t.Fatalf("expected ErrQueueClosed, got %v", err)
+	}
+	if err := queue.Enqueue([]byte("x")); !errors.Is(err, ErrQueueClosed) {
+		t.Fatalf("expected enqueue on closed queue to fail, got %v", err)
+	}
+}
+
+func TestDispatcherRoundRobin(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	queue := NewMemoryMessageQueue(100, logger)
+	d := newDispatcher("jobs", "", queue, redeliveryPolicy{}, logger)
+	defer d.close()
+
+	consumers := []*queueConsumer{d.register(1), d.register(1), d.register(1)}
+
+	for i := 0; i < 6; i++ {
+		_ = queue.Enqueue([]byte{byte('a' + i)})
+	}
+
+	// With one slot each, messages alternate a, b, c, then d, e, f across the three consumers
+	got := make([]string, 3)
+	for round := 0; round < 2; round++ {
+		for i, c := range consumers {
+			got[i] += receive(t, c)
+		}
+	}
+	if got[0] != "ad" || got[1] != "be" || got[2] != "cf" {
+		t.Fatalf("expected round-robin distribution, got %v", got)
+	}
+}
+
+func TestDispatcherUnregisterReturnsUndelivered(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	queue := NewMemoryMessageQueue(100, logger)
+	d := newDispatcher("jobs", "", queue, redeliveryPolicy{}, logger)
+	defer d.close()
+
+	c := d.register(2)
+	_ = queue.Enqueue([]byte("m1"))
+	_ = queue.Enqueue([]byte("m2"))
+	waitFor(t, func() bool { return len(c.out) == 2 })
+
+	pending := d.unregister(c)
+	if len(pending) != 2 || d.consumerCount() != 0 {
+		t.Fatalf("expected 2 undelivered messages and no consumers, got %d / %d", len(pending), d.consumerCount())
+	}
+
+	// Messages arriving with no consumers stay in the queue
+	_ = queue.Enqueue([]byte("m3"))
+	time.Sleep(20 * time.Millisecond)
+	if queue.Len() != 1 {
+		t.Fatalf("expected message to wait in queue, got len %d", queue.Len())
+	}
+}
+
+func TestQueueConsumerConnectsBeforeProducer(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Queue, logger)
+	tp := mustTopic(t, b, "jobs")
+
+	conn := connectPipe(t, b, "CONSUMER jobs ack=manual\n")
+	waitFor(t, func() bool { return tp.dispatcher.consumerCount() == 1 })
+
+	// The consumer stays connected on an empty queue until a message shows up
+	time.Sleep(20 * time.Millisecond)
+	_ = tp.queue.Enqueue([]byte("first"))
+
+	f := readTyped(t, conn)
+	if string(f.Body) != "first" {
+		t.Fatalf("expected first, got %q", f.Body)
+	}
+	sendTyped(t, conn, protocol.TypedFrame{Type: protocol.FrameAck, Tag: f.Tag})
+
+	conn.Close()
+	waitFor(t, func() bool { return tp.dispatcher.consumerCount() == 0 })
+}
@@ -0,0 +1,156 @@
+package broker
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+// drainPollInterval is how often a draining queue consumer checks whether it has anything left
+const drainPollInterval = 10 * time.Millisecond
+
+// goAwayReason is the body of the going-away frame sent while the broker drains
+const goAwayReason = "broker shutting down"
+
+// connTracker tracks the connections being handled, so a shutdown can stop reading them and wait
+// for their handlers to return
+type connTracker struct {
+	mu sync.Mutex
+	// conns maps each connection to whether its reads may be interrupted: producers and connections
+	// that have not sent a handshake yet. Consumers keep reading so their acks still arrive.
+	conns map[net.Conn]bool
+	// draining is closed when the shutdown starts; no connection is added afterwards
+	draining chan struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// newConnTracker creates an empty tracker
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]bool), draining: make(chan struct{})}
+}
+
+// add tracks a connection; it returns false once the broker drains, and the connection must then
+// be closed without being handled
+func (t *connTracker) add(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.conns[conn] = true
+	t.wg.Add(1)
+	return true
+}
+
+// keepReading marks a consumer connection, whose reads are not interrupted by a drain
+func (t *connTracker) keepReading(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.conns[conn]; !ok {
+		return
+	}
+	t.conns[conn] = false
+	if t.closed {
+		// The drain interrupted the handshake's reads just after they finished
+		_ = conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// remove stops tracking a connection once its handler returns
+func (t *connTracker) remove(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.conns[conn]; ok {
+		delete(t.conns, conn)
+		t.wg.Done()
+	}
+}
+
+// drain refuses new connections and interrupts the reads of producers and of connections still
+// in their handshake
+func (t *connTracker) drain() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	t.closed = true
+	close(t.draining)
+	for conn, interrupt := range t.conns {
+		if interrupt {
+			_ = conn.SetReadDeadline(time.Now())
+		}
+	}
+}
+
+// isDraining reports whether the drain has started
+func (t *connTracker) isDraining() bool {
+	select {
+	case <-t.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeAll closes every tracked connection and returns how many there were
+func (t *connTracker) closeAll() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for conn := range t.conns {
+		_ = conn.Close()
+	}
+	return len(t.conns)
+}
+
+// wait blocks until every handler has returned or ctx is done
+func (t *connTracker) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown drains the broker. It reports not ready, refuses new connections and stops reading
+// producers, lets consumers receive the messages already buffered or queued for them (and with
+// manual acks, ack them), then tells clients that negotiated typed frames with a going-away frame
+// and closes their connections. Connections still open when ctx is done are closed, and ctx's
+// error is returned. Close the listener served by Serve first, and call Close afterwards.
+func (b *Broker) Shutdown(ctx context.Context) error {
+	b.BeginShutdown()
+	b.conns.drain()
+	b.logger.Info("draining connections", "clients", len(b.Clients()))
+
+	err := b.conns.wait(ctx)
+	if err != nil {
+		n := b.conns.closeAll()
+		b.logger.Warn("drain deadline passed, closing remaining connections", "connections", n)
+		b.conns.wg.Wait()
+		return err
+	}
+	b.logger.Info("all connections drained")
+	return nil
+}
+
+// goAway tells a client the broker is shutting down, if the client negotiated typed frames. The
+// connection is closed right after, so a failed write is only logged.
+func (b *Broker) goAway(writer FrameWriter, typed bool) {
+	if !typed {
+		return
+	}
+	frame := protocol.EncodeTypedFrame(protocol.TypedFrame{Type: protocol.FrameGoAway, Body: []byte(goAwayReason)})
+	if err := writer.WriteFrame(frame); err != nil {
+		b.logger.Debug("failed to send going-away frame", "error", err)
+	}
+}
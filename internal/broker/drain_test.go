@@ -0,0 +1,144 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+// shutdown runs Shutdown in the background and returns its result channel
+func shutdown(ctx context.Context, b *Broker) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- b.Shutdown(ctx) }()
+	return done
+}
+
+// expectGoAway reads a going-away frame and checks that the connection is closed after it
+func expectGoAway(t *testing.T, conn net.Conn) {
+	t.Helper()
+	if f := readTyped(t, conn); f.Type != protocol.FrameGoAway || string(f.Body) != goAwayReason {
+		t.Fatalf("expected a going-away frame, got %s %q", f.Type, f.Body)
+	}
+	if _, err := protocol.ReadFrame(conn, nil); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+}
+
+func TestShutdownFlushesBroadcastConsumers(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Broadcast, logger)
+	defer b.Close()
+	tp := mustTopic(t, b, "telemetry")
+
+	conn := connectPipe(t, b, "CONSUMER telemetry ack=manual\n")
+	waitFor(t, func() bool { return tp.registry.GetConsumerCount() == 1 })
+	for _, m := range []string{"m1", "m2", "m3"} {
+		if err := b.publish(tp, []byte(m)); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+
+	done := shutdown(context.Background(), b)
+	for _, want := range []string{"m1", "m2", "m3"} {
+		if f := readTyped(t, conn); f.Type != protocol.FrameDeliver || string(f.Body) != want {
+			t.Fatalf("expected delivery %q, got %s %q", want, f.Type, f.Body)
+		}
+	}
+	expectGoAway(t, conn)
+	if err := <-done; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	// Connections made while draining are closed right away
+	client, server := net.Pipe()
+	defer client.Close()
+	go b.HandleConn(server)
+	if _, err := protocol.ReadFrame(client, nil); err == nil {
+		t.Fatal("expected a new connection to be refused")
+	}
+}
+
+func TestShutdownStopsReadingProducers(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Queue, logger)
+	defer b.Close()
+	tp := mustTopic(t, b, "jobs")
+
+	conn := connectPipe(t, b, "PRODUCER jobs confirm=true\n")
+	if err := protocol.WriteFrame(conn, []byte("a")); err != nil {
+		t.Fatalf("write frame: %v", err)
+	}
+	if f := readTyped(t, conn); f.Type != protocol.FrameAck {
+		t.Fatalf("expected an ack, got %s", f.Type)
+	}
+
+	// The producer is waiting for its next message when the drain interrupts it
+	done := shutdown(context.Background(), b)
+	expectGoAway(t, conn)
+	if err := <-done; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if tp.queue.Len() != 1 {
+		t.Fatalf("expected the confirmed message to stay queued, got %d", tp.queue.Len())
+	}
+}
+
+func TestShutdownWaitsForAcks(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Queue, logger)
+	defer b.Close()
+	tp := mustTopic(t, b, "jobs")
+
+	conn := connectPipe(t, b, "CONSUMER jobs ack=manual\n")
+	if err := b.publish(tp, []byte("a")); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	done := shutdown(context.Background(), b)
+	f := readTyped(t, conn)
+	if f.Type != protocol.FrameDeliver || string(f.Body) != "a" {
+		t.Fatalf("expected delivery of a, got %s %q", f.Type, f.Body)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned before the delivery was acked: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	sendTyped(t, conn, protocol.TypedFrame{Type: protocol.FrameAck, Tag: f.Tag})
+	expectGoAway(t, conn)
+	if err := <-done; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Queue, logger)
+	defer b.Close()
+	tp := mustTopic(t, b, "jobs")
+
+	conn := connectPipe(t, b, "CONSUMER jobs ack=manual\n")
+	if err := b.publish(tp, []byte("a")); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	readTyped(t, conn)
+
+	// The delivery is never acked, so the drain gives up and closes the connection
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := <-shutdown(ctx, b); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to pass, got %v", err)
+	}
+	if _, err := protocol.ReadFrame(conn, nil); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+	if tp.queue.Len() != 1 {
+		t.Fatalf("expected the unacked delivery to be requeued, got %d", tp.queue.Len())
+	}
+}
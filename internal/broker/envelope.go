@@ -0,0 +1,32 @@
+package broker
+
+import "encoding/json"
+
+// envelope holds the fields of a published message the broker itself looks at.
+// Messages are JSON objects in the message.Message format; anything else has an empty envelope.
+type envelope struct {
+	// ID identifies the message, e.g. in producer confirms and for deduplication
+	ID string `json:"id"`
+	// ProducerID and Seq identify a message by its producer's sequence number when it has no ID
+	ProducerID string  `json:"producer_id"`
+	Seq        *uint64 `json:"seq"`
+	// Timestamp is when the message was created, in RFC 3339 format
+	Timestamp string `json:"timestamp"`
+	// TTLMs is how long after Timestamp the message expires, overriding the topic's TTL
+	TTLMs int64 `json:"ttl_ms"`
+	// Priority is the message's level in a PriorityMessageQueue
+	Priority int `json:"priority"`
+	// DeliverAt is the RFC 3339 time the message should be delivered at
+	DeliverAt string `json:"deliver_at"`
+	// DelayMs delays delivery by that long after the broker receives the message, if DeliverAt is not set
+	DelayMs int64 `json:"delay_ms"`
+	// Key picks the message's partition in a PartitionedMessageQueue
+	Key string `json:"key"`
+}
+
+// parseEnvelope extracts the envelope of a published message
+func parseEnvelope(msg []byte) envelope {
+	var env envelope
+	_ = json.Unmarshal(msg, &env)
+	return env
+}
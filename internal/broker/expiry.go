@@ -0,0 +1,73 @@
+package broker
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// ttlField is looked for before parsing a message of a topic without a TTL, so only messages that
+// may carry their own TTL pay for the parse
+var ttlField = []byte(`"ttl_ms"`)
+
+// expiryPolicy decides when the messages of a topic expire
+type expiryPolicy struct {
+	// ttl applies to messages that do not carry their own ttl_ms; 0 means they never expire
+	ttl time.Duration
+}
+
+// expiryPolicy returns the expiry settings of a topic
+func (b *Broker) expiryPolicy(cfg TopicConfig) expiryPolicy {
+	ttlMs := cfg.TTLMs
+	if ttlMs == 0 {
+		ttlMs = b.cfg.MessageTTLMs
+	}
+	if ttlMs < 0 {
+		return expiryPolicy{}
+	}
+	return expiryPolicy{ttl: time.Duration(ttlMs) * time.Millisecond}
+}
+
+// expiresAt returns when a message expires: its TTL, or else the topic's, after its timestamp.
+// Messages without a timestamp or a TTL never expire.
+func (p expiryPolicy) expiresAt(msg []byte) (time.Time, bool) {
+	if p.ttl <= 0 && !bytes.Contains(msg, ttlField) {
+		return time.Time{}, false
+	}
+	env := parseEnvelope(msg)
+	ttl := p.ttl
+	if env.TTLMs > 0 {
+		ttl = time.Duration(env.TTLMs) * time.Millisecond
+	}
+	if ttl <= 0 || env.Timestamp == "" {
+		return time.Time{}, false
+	}
+	ts, err := time.Parse(time.RFC3339Nano, env.Timestamp)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return ts.Add(ttl), true
+}
+
+// discardExpired reports whether a message about to be delivered has expired, in which case the
+// caller drops it. Expired messages are counted; a queued message (one taken from the topic queue
+// or a group queue rather than a broadcast copy) is moved to the dead-letter topic instead of
+// being dropped when Config.DeadLetterExpired is set.
+func (b *Broker) discardExpired(t *topic, group string, msg []byte, queued bool) bool {
+	expiresAt, ok := t.expiry.expiresAt(msg)
+	if !ok || time.Now().Before(expiresAt) {
+		return false
+	}
+	n := t.expired.Add(1)
+	if queued && b.cfg.DeadLetterExpired && b.deadLettersEnabled(t.name) {
+		reason := fmt.Sprintf("expired at %s", expiresAt.UTC().Format(time.RFC3339Nano))
+		if err := b.deadLetter(DeadLetter{Topic: t.name, Group: group, Reason: reason, Payload: msg}); err != nil {
+			b.logger.Error("failed to dead-letter expired message, discarding it", "topic", t.name, "group", group, "error", err)
+		}
+		return true
+	}
+	if n == 1 || n%dropLogInterval == 0 {
+		b.logger.Warn("discarding expired messages", "topic", t.name, "group", group, "expired", n)
+	}
+	return true
+}
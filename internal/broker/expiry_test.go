@@ -0,0 +1,99 @@
+package broker
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+// timestamped returns a JSON message created age ago with an optional TTL
+func timestamped(id string, age time.Duration, ttlMs int64) string {
+	ts := time.Now().Add(-age).UTC().Format(time.RFC3339Nano)
+	return fmt.Sprintf(`{"id":%q,"timestamp":%q,"ttl_ms":%d}`, id, ts, ttlMs)
+}
+
+func TestExpiredQueuedMessagesAreDiscarded(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	cfg := Config{DefaultMode: Queue, Topics: map[string]TopicConfig{"jobs": {Mode: ModeOf(Queue), TTLMs: 60000}}}
+	b := NewBrokerWithConfig(cfg, logger)
+	defer b.Close()
+	publish(b, "jobs", timestamped("stale", 2*time.Minute, 0), timestamped("own-ttl", time.Second, 500), timestamped("fresh", 0, 0))
+
+	conn := connectPipe(t, b, "CONSUMER jobs ack=manual\n")
+	f := readTyped(t, conn)
+	if !strings.Contains(string(f.Body), `"fresh"`) {
+		t.Fatalf("expected only the fresh message, got %s", f.Body)
+	}
+	sendTyped(t, conn, protocol.TypedFrame{Type: protocol.FrameAck, Tag: f.Tag})
+	if s := b.Stats(); s[0].Expired != 2 {
+		t.Fatalf("expected 2 expired messages, got %+v", s)
+	}
+	if dt, _ := b.existingTopic("jobs.dlq"); dt != nil {
+		t.Fatal("expected expired messages to be discarded, not dead-lettered")
+	}
+}
+
+func TestExpiredMessagesDeadLettered(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBrokerWithConfig(Config{DefaultMode: Queue, MessageTTLMs: 1000, DeadLetterExpired: true}, logger)
+	defer b.Close()
+	publish(b, "jobs", timestamped("stale", time.Minute, 0), timestamped("fresh", 0, 0))
+
+	conn := connectPipe(t, b, "CONSUMER jobs\n")
+	if body, err := protocol.ReadFrame(conn, nil); err != nil || !strings.Contains(string(body), `"fresh"`) {
+		t.Fatalf("expected only the fresh message, got %s (err=%v)", body, err)
+	}
+	letters, _, err := b.DeadLetters("jobs", 0)
+	if err != nil || len(letters) != 1 || !strings.HasPrefix(letters[0].Reason, "expired at ") || !strings.Contains(string(letters[0].Payload), `"stale"`) {
+		t.Fatalf("expected the stale message to be dead-lettered, got %+v (err=%v)", letters, err)
+	}
+}
+
+func TestExpiredBroadcastMessagesAreSkipped(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Broadcast, logger)
+	defer b.Close()
+	tp := mustTopic(t, b, "telemetry")
+
+	conn := connectPipe(t, b, "CONSUMER telemetry\n")
+	waitFor(t, func() bool { return tp.registry.GetConsumerCount() == 1 })
+	go publish(b, "telemetry", timestamped("stale", time.Minute, 1000), timestamped("fresh", 0, 1000))
+	if body, err := protocol.ReadFrame(conn, nil); err != nil || !strings.Contains(string(body), `"fresh"`) {
+		t.Fatalf("expected only the fresh message, got %s (err=%v)", body, err)
+	}
+	if s := b.Stats(); s[0].Expired != 1 {
+		t.Fatalf("expected 1 expired delivery, got %+v", s)
+	}
+}
+
+func TestExpiryPolicy(t *testing.T) {
+	b := NewBrokerWithConfig(Config{MessageTTLMs: 1000}, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	now := time.Now()
+	ts := now.UTC().Format(time.RFC3339Nano)
+	cases := []struct {
+		name   string
+		cfg    TopicConfig
+		msg    string
+		want   time.Duration
+		expire bool
+	}{
+		{"broker default", TopicConfig{}, fmt.Sprintf(`{"timestamp":%q}`, ts), time.Second, true},
+		{"topic TTL", TopicConfig{TTLMs: 5000}, fmt.Sprintf(`{"timestamp":%q}`, ts), 5 * time.Second, true},
+		{"message TTL", TopicConfig{TTLMs: 5000}, fmt.Sprintf(`{"timestamp":%q,"ttl_ms":200}`, ts), 200 * time.Millisecond, true},
+		{"message TTL on topic without one", TopicConfig{TTLMs: -1}, fmt.Sprintf(`{"timestamp":%q,"ttl_ms":200}`, ts), 200 * time.Millisecond, true},
+		{"topic keeps forever", TopicConfig{TTLMs: -1}, fmt.Sprintf(`{"timestamp":%q}`, ts), 0, false},
+		{"no timestamp", TopicConfig{}, `{"id":"x"}`, 0, false},
+		{"not JSON", TopicConfig{}, "raw", 0, false},
+	}
+	for _, c := range cases {
+		at, ok := b.expiryPolicy(c.cfg).expiresAt([]byte(c.msg))
+		if ok != c.expire || (ok && at.Sub(now).Round(time.Millisecond) != c.want) {
+			t.Errorf("%s: expected expiry %v after now (%v), got %v (%v)", c.name, c.want, c.expire, at.Sub(now), ok)
+		}
+	}
+}
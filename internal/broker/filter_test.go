@@ -0,0 +1,68 @@
+package broker
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+// gpuMetrics are messages for two hosts, as the producer publishes them
+var gpuMetrics = []string{
+	`{"id":"1","type":"gpu_metric","payload":{"metric_name":"DCGM_FI_DEV_GPU_TEMP","Hostname":"lab-01"}}`,
+	`{"id":"2","type":"gpu_metric","payload":{"metric_name":"DCGM_FI_DEV_GPU_UTIL","Hostname":"mtv5-02"}}`,
+	`{"id":"3","type":"gpu_metric","payload":{"metric_name":"DCGM_FI_DEV_GPU_TEMP","Hostname":"mtv5-02"}}`,
+}
+
+// tempOnMtv5 matches only the third of gpuMetrics
+const tempOnMtv5 = `filter="metric_name == \"DCGM_FI_DEV_GPU_TEMP\" && Hostname =~ \"mtv5-.*\""`
+
+func TestBroadcastConsumerFilter(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Broadcast, logger)
+	defer b.Close()
+	tp := mustTopic(t, b, "telemetry")
+
+	conn := connectPipe(t, b, "CONSUMER telemetry "+tempOnMtv5+"\n")
+	waitFor(t, func() bool { return tp.registry.GetConsumerCount() == 1 })
+	go publish(b, "telemetry", gpuMetrics...)
+	if body, err := protocol.ReadFrame(conn, nil); err != nil || !strings.Contains(string(body), `"id":"3"`) {
+		t.Fatalf("expected only the matching message, got %s (err=%v)", body, err)
+	}
+}
+
+func TestReplayConsumerFilter(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Broadcast, logger)
+	defer b.Close()
+	publish(b, "telemetry", gpuMetrics...)
+	publish(b, "telemetry", `{"id":"4","payload":{"metric_name":"DCGM_FI_DEV_GPU_TEMP","Hostname":"mtv5-03"}}`)
+
+	conn := connectPipe(t, b, "CONSUMER telemetry from=earliest "+tempOnMtv5+"\n")
+	if got := readOffsets(t, conn, 2); !strings.HasPrefix(got, "[2:") || !strings.Contains(got, " 3:") {
+		t.Fatalf("expected the matching messages at offsets 2 and 3, got %s", got)
+	}
+}
+
+func TestConsumerFilterRejected(t *testing.T) {
+	if _, err := parseConsumerOptions(protocol.Handshake{Role: roleConsumer, Options: map[string]string{protocol.OptionFilter: "type =="}}); err == nil {
+		t.Error("expected an invalid filter to be rejected")
+	}
+	if _, err := parseConsumerOptions(protocol.Handshake{Role: roleConsumer, Options: map[string]string{protocol.OptionFilter: `type == "a"`, protocol.OptionGroup: "writers"}}); err == nil {
+		t.Error("expected a filter to be rejected for a consumer group")
+	}
+
+	// A queue consumer cannot skip messages without taking them from the other consumers
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Queue, logger)
+	defer b.Close()
+	_ = mustTopic(t, b, "jobs").queue.Enqueue([]byte(`{"type":"a"}`))
+	conn := connectPipe(t, b, `CONSUMER jobs filter="type == \"b\""`+"\n")
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := protocol.ReadFrame(conn, nil); err == nil {
+		t.Fatal("expected the queue consumer with a filter to be disconnected")
+	}
+}
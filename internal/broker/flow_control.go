@@ -0,0 +1,104 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+// defaultProducerCredits is used when Config.ProducerCredits is not set
+const defaultProducerCredits = 256
+
+// capacityPollInterval is how often a throttled producer's topic is checked for free space
+const capacityPollInterval = 10 * time.Millisecond
+
+// saturated reports whether a message published now would not fit in the topic's queue or in the
+// queue of one of its consumer groups
+func (t *topic) saturated() bool {
+	if t.mode == Queue && t.queue.IsFull() {
+		return true
+	}
+	for _, g := range t.consumerGroups() {
+		if g.queue.IsFull() {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForCapacity blocks while the topic is saturated so the producer stops being read and
+// backpressure reaches it instead of messages being dropped. It returns false if the topic was
+// closed while waiting, and stops waiting once the broker drains.
+func (b *Broker) waitForCapacity(t *topic) bool {
+	if !t.saturated() {
+		return true
+	}
+	start := time.Now()
+	b.logger.Warn("topic saturated, throttling producer", "topic", t.name)
+
+	ticker := time.NewTicker(capacityPollInterval)
+	defer ticker.Stop()
+	for t.saturated() {
+		select {
+		case <-t.log.done():
+			return false
+		case <-b.conns.draining:
+			return true
+		case <-ticker.C:
+		}
+	}
+	b.logger.Info("topic has capacity again, resuming producer", "topic", t.name, "throttled_for", time.Since(start))
+	return true
+}
+
+// producerCredits tracks the credits a flow-controlled producer still holds.
+// Credits are granted in batches: once half the window is used, the producer is topped back up to
+// the full window, but only while the topic has room.
+type producerCredits struct {
+	window    int
+	remaining int
+}
+
+// use spends the credit for one received message and reports whether the producer had one
+func (c *producerCredits) use() bool {
+	if c.remaining == 0 {
+		return false
+	}
+	c.remaining--
+	return true
+}
+
+// topUp grants the producer enough credits to fill its window once half of it is used
+func (c *producerCredits) topUp(writer FrameWriter) error {
+	if c.remaining > c.window/2 {
+		return nil
+	}
+	if err := grantCredits(writer, c.window-c.remaining); err != nil {
+		return err
+	}
+	c.remaining = c.window
+	return nil
+}
+
+// parseProducerFlow returns the credit window negotiated by a producer's handshake,
+// or 0 if the producer did not ask for flow control
+func (b *Broker) parseProducerFlow(hs protocol.Handshake) (int, error) {
+	switch v := hs.Option(protocol.OptionFlow, ""); v {
+	case "":
+		return 0, nil
+	case protocol.FlowCredit:
+		return b.cfg.ProducerCredits, nil
+	default:
+		return 0, fmt.Errorf("unknown flow control %q", v)
+	}
+}
+
+// grantCredits sends the producer a credit frame for n more messages
+func grantCredits(writer FrameWriter, n int) error {
+	frame := protocol.EncodeTypedFrame(protocol.TypedFrame{Type: protocol.FrameCredit, Tag: uint64(n)})
+	if err := writer.WriteFrame(frame); err != nil {
+		return fmt.Errorf("failed to grant producer credits: %w", err)
+	}
+	return nil
+}
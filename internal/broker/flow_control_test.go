@@ -0,0 +1,91 @@
+package broker
+
+import (
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+func TestProducerThrottledWhileQueueFull(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBrokerWithConfig(Config{DefaultMode: Queue, Storage: StorageConfig{MaxMessages: 2}}, logger)
+	defer b.Close()
+	q := mustTopic(t, b, "jobs").queue
+
+	conn := connectPipe(t, b, "PRODUCER jobs\n")
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for _, m := range []string{"m1", "m2", "m3"} {
+			if err := protocol.WriteFrame(conn, []byte(m)); err != nil {
+				return
+			}
+		}
+	}()
+
+	// The third message is not read, rather than dropped, until the queue has room
+	waitFor(t, func() bool { return q.Len() == 2 })
+	select {
+	case <-sent:
+		t.Fatal("expected the producer to be throttled while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if msg, _ := q.Dequeue(); string(msg) != "m1" {
+		t.Fatalf("expected m1, got %q", msg)
+	}
+	<-sent
+	waitFor(t, func() bool { return q.Len() == 2 })
+	_, _ = q.Dequeue()
+	if msg, _ := q.Dequeue(); string(msg) != "m3" {
+		t.Fatalf("expected m3 to be accepted once there was room, got %q", msg)
+	}
+}
+
+func TestProducerCreditFlowControl(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	cfg := Config{DefaultMode: Queue, ProducerCredits: 4, Storage: StorageConfig{MaxMessages: 4}}
+	b := NewBrokerWithConfig(cfg, logger)
+	defer b.Close()
+	q := mustTopic(t, b, "jobs").queue
+
+	conn := connectPipe(t, b, "PRODUCER jobs flow=credit\n")
+	if f := readTyped(t, conn); f.Type != protocol.FrameCredit || f.Tag != 4 {
+		t.Fatalf("expected an initial grant of 4 credits, got %+v", f)
+	}
+
+	// Spending half the window earns a top-up back to the full window
+	for _, m := range []string{"m1", "m2"} {
+		_ = protocol.WriteFrame(conn, []byte(m))
+	}
+	if f := readTyped(t, conn); f.Type != protocol.FrameCredit || f.Tag != 2 {
+		t.Fatalf("expected a top-up of 2 credits, got %+v", f)
+	}
+
+	// Once the queue is full no more credits are granted
+	for _, m := range []string{"m3", "m4"} {
+		_ = protocol.WriteFrame(conn, []byte(m))
+	}
+	waitFor(t, func() bool { return q.Len() == 4 })
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := protocol.ReadFrame(conn, nil); err == nil {
+		t.Fatal("expected no credits while the queue is full")
+	}
+
+	_, _ = q.Dequeue()
+	if f := readTyped(t, conn); f.Type != protocol.FrameCredit || f.Tag != 2 {
+		t.Fatalf("expected credits once the queue had room, got %+v", f)
+	}
+}
+
+func TestProducerRejectsUnknownFlowControl(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Queue, logger)
+	hs, _ := protocol.ParseHandshake("PRODUCER jobs flow=window")
+	if _, err := b.parseProducerFlow(hs); err == nil {
+		t.Fatal("expected unknown flow control to be rejected")
+	}
+}
@@ -0,0 +1,121 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// groupsDirName is the subdirectory of a topic's storage directory that holds its consumer groups
+const groupsDirName = "groups"
+
+// consumerGroup is a named set of competing consumers on a topic.
+// Every group receives its own copy of each message published to the topic, and within the group
+// the copies are handed out round-robin, so each message reaches exactly one member.
+type consumerGroup struct {
+	name       string
+	queue      MessageQueue
+	dispatcher *dispatcher
+}
+
+// close stops the group's dispatcher and closes its queue
+func (g *consumerGroup) close() {
+	g.dispatcher.close()
+	_ = g.queue.Close()
+}
+
+// validateGroupName checks a consumer group name; the rules are the same as for topic names
+func validateGroupName(name string) error {
+	return validateName("group", name)
+}
+
+// consumerGroups returns a snapshot of the topic's consumer groups
+func (t *topic) consumerGroups() []*consumerGroup {
+	t.groupsMu.Lock()
+	defer t.groupsMu.Unlock()
+	groups := make([]*consumerGroup, 0, len(t.groups))
+	for _, g := range t.groups {
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// publishToGroups copies a message into the queue of every consumer group on the topic.
+// Groups keep their queue while no member is connected, so members catch up when they return.
+// It returns an error naming the groups the message could not be copied to.
+func (b *Broker) publishToGroups(t *topic, msg []byte) error {
+	var errs []error
+	for _, g := range t.consumerGroups() {
+		if err := g.queue.Enqueue(msg); err != nil {
+			b.metrics.enqueueDrops.With(t.name).Inc()
+			b.logger.Warn("failed to enqueue message for consumer group", "topic", t.name, "group", g.name, "error", err)
+			errs = append(errs, fmt.Errorf("failed to enqueue for group %q: %w", g.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// getOrCreateGroup returns the named consumer group of a topic, creating it on first use.
+// A new group only receives messages published after it was created.
+func (b *Broker) getOrCreateGroup(t *topic, name string) (*consumerGroup, error) {
+	t.groupsMu.Lock()
+	defer t.groupsMu.Unlock()
+	if g, ok := t.groups[name]; ok {
+		return g, nil
+	}
+	g, err := b.openGroup(t, name)
+	if err != nil {
+		return nil, err
+	}
+	b.logger.Info("consumer group created", "topic", t.name, "group", name, "total_groups", len(t.groups))
+	return g, nil
+}
+
+// openGroup opens the group's queue in the configured storage and registers it on the topic.
+// The caller must hold t.groupsMu.
+func (b *Broker) openGroup(t *topic, name string) (*consumerGroup, error) {
+	queue, err := b.openQueue(b.groupDir(t.name, name), t.priorityLevels, t.partitions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open queue for consumer group %q: %w", name, err)
+	}
+	g := &consumerGroup{
+		name:       name,
+		queue:      queue,
+		dispatcher: newDispatcher(t.name, name, queue, b.redeliveryPolicy(t.name, name), b.logger),
+	}
+	t.groups[name] = g
+	return g, nil
+}
+
+// groupDir returns the disk storage directory of a consumer group
+func (b *Broker) groupDir(topicName, group string) string {
+	return filepath.Join(b.topicDir(topicName), groupsDirName, group)
+}
+
+// recoverGroups reopens the consumer groups persisted for a topic by disk storage
+func (b *Broker) recoverGroups(t *topic) error {
+	if b.cfg.Storage.Type != StorageDisk {
+		return nil
+	}
+	entries, err := os.ReadDir(filepath.Join(b.topicDir(t.name), groupsDirName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to list consumer groups of topic %q: %w", t.name, err)
+	}
+
+	t.groupsMu.Lock()
+	defer t.groupsMu.Unlock()
+	for _, e := range entries {
+		if !e.IsDir() || validateGroupName(e.Name()) != nil {
+			continue
+		}
+		if _, err := b.openGroup(t, e.Name()); err != nil {
+			return err
+		}
+		b.logger.Info("consumer group recovered", "topic", t.name, "group", e.Name())
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package broker
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+// groupMembers returns the number of consumers attached to a topic's consumer group
+func groupMembers(t *topic, name string) int {
+	t.groupsMu.Lock()
+	defer t.groupsMu.Unlock()
+	g, ok := t.groups[name]
+	if !ok {
+		return 0
+	}
+	return g.dispatcher.consumerCount()
+}
+
+// drainTyped reads n typed frames from conn, acks them and returns their bodies
+func drainTyped(t *testing.T, conn net.Conn, n int) []string {
+	t.Helper()
+	var bodies []string
+	for i := 0; i < n; i++ {
+		f := readTyped(t, conn)
+		sendTyped(t, conn, protocol.TypedFrame{Type: protocol.FrameAck, Tag: f.Tag})
+		bodies = append(bodies, string(f.Body))
+	}
+	return bodies
+}
+
+func TestConsumerGroupsEachReceiveEveryMessage(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Broadcast, logger)
+	defer b.Close()
+	tp := mustTopic(t, b, "telemetry")
+
+	writerA := connectPipe(t, b, "CONSUMER telemetry ack=manual group=writers\n")
+	writerB := connectPipe(t, b, "CONSUMER telemetry ack=manual group=writers\n")
+	alerts := connectPipe(t, b, "CONSUMER telemetry ack=manual group=alerts\n")
+	waitFor(t, func() bool { return groupMembers(tp, "writers") == 2 && groupMembers(tp, "alerts") == 1 })
+
+	var data []byte
+	data = append(data, "PRODUCER telemetry\n"...)
+	for i := 0; i < 4; i++ {
+		data = append(data, frameBytes([]byte(fmt.Sprintf("m%d", i)))...)
+	}
+	b.HandleConn(&simpleConn{readBuf: bytes.NewReader(data), writeBuf: &bytes.Buffer{}})
+
+	// The single alerts member sees the full stream in order
+	got := drainTyped(t, alerts, 4)
+	if fmt.Sprint(got) != "[m0 m1 m2 m3]" {
+		t.Fatalf("expected alerts group to receive every message, got %v", got)
+	}
+
+	// The writers split the stream between them; which member gets which message depends on timing
+	received := make(chan string, 4)
+	for _, conn := range []net.Conn{writerA, writerB} {
+		go func(conn net.Conn) {
+			for {
+				_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				body, err := protocol.ReadFrame(conn, nil)
+				if err != nil {
+					return
+				}
+				f, err := protocol.DecodeTypedFrame(body)
+				if err != nil {
+					return
+				}
+				_ = protocol.WriteFrame(conn, protocol.EncodeTypedFrame(protocol.TypedFrame{Type: protocol.FrameAck, Tag: f.Tag}))
+				received <- string(f.Body)
+			}
+		}(conn)
+	}
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		select {
+		case m := <-received:
+			seen[m] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("writers received only %d messages", i)
+		}
+	}
+	if len(seen) != 4 {
+		t.Fatalf("expected writers to share all 4 messages without duplicates, got %v", seen)
+	}
+}
+
+func TestConsumerGroupKeepsMessagesWhileEmpty(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Queue, logger)
+	defer b.Close()
+	tp := mustTopic(t, b, "jobs")
+
+	g, err := b.getOrCreateGroup(tp, "audit")
+	if err != nil {
+		t.Fatalf("getOrCreateGroup: %v", err)
+	}
+	data := append([]byte("PRODUCER jobs\n"), frameBytes([]byte("job-1"))...)
+	b.HandleConn(&simpleConn{readBuf: bytes.NewReader(data), writeBuf: &bytes.Buffer{}})
+
+	// The topic's own queue and the group's queue each hold a copy
+	if tp.queue.Len() != 1 || g.queue.Len() != 1 {
+		t.Fatalf("expected one copy per queue, got topic=%d group=%d", tp.queue.Len(), g.queue.Len())
+	}
+
+	conn := connectPipe(t, b, "CONSUMER jobs ack=manual group=audit\n")
+	if got := drainTyped(t, conn, 1); got[0] != "job-1" {
+		t.Fatalf("expected late group member to receive job-1, got %v", got)
+	}
+	if tp.queue.Len() != 1 {
+		t.Fatalf("expected group consumption to leave the topic queue alone, got %d", tp.queue.Len())
+	}
+}
+
+func TestConsumerGroupRejectsInvalidName(t *testing.T) {
+	hs, _ := protocol.ParseHandshake("CONSUMER jobs group=../etc")
+	if _, err := parseConsumerOptions(hs); err == nil {
+		t.Fatal("expected error for invalid group name")
+	}
+}
+
+func TestConsumerGroupsRecoveredFromDisk(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	cfg := Config{DefaultMode: Broadcast, Storage: StorageConfig{Type: StorageDisk, Dir: t.TempDir()}}
+
+	b := NewBrokerWithConfig(cfg, logger)
+	if _, err := b.getOrCreateGroup(mustTopic(t, b, "telemetry"), "writers"); err != nil {
+		t.Fatalf("getOrCreateGroup: %v", err)
+	}
+	data := append([]byte("PRODUCER telemetry\n"), frameBytes([]byte("persisted"))...)
+	b.HandleConn(&simpleConn{readBuf: bytes.NewReader(data), writeBuf: &bytes.Buffer{}})
+	b.Close()
+
+	restarted := NewBrokerWithConfig(cfg, logger)
+	defer restarted.Close()
+	if err := restarted.RecoverTopics(); err != nil {
+		t.Fatalf("RecoverTopics: %v", err)
+	}
+	tp := mustTopic(t, restarted, "telemetry")
+	groups := tp.consumerGroups()
+	if len(groups) != 1 || groups[0].name != "writers" {
+		t.Fatalf("expected writers group to be recovered, got %d groups", len(groups))
+	}
+	msg, err := groups[0].queue.Dequeue()
+	if err != nil || string(msg) != "persisted" {
+		t.Fatalf("expected persisted group message, got %q (err=%v)", msg, err)
+	}
+}
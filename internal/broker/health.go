@@ -0,0 +1,262 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultHighWaterPercent is the queue fill level above which the broker reports not ready
+	defaultHighWaterPercent = 90
+	// defaultHealthCheckTimeout bounds each liveness check
+	defaultHealthCheckTimeout = 2 * time.Second
+	// defaultMaxMessages is the capacity of a queue when StorageConfig.MaxMessages is not set
+	defaultMaxMessages = 10000
+)
+
+// HealthConfig tunes the readiness and liveness checks
+type HealthConfig struct {
+	// HighWaterPercent makes the broker not ready while any topic or group queue is at least that
+	// full (default 90); a negative value disables the check
+	HighWaterPercent int `json:"high_water_percent"`
+	// CheckTimeout bounds how long liveness waits for the accept loop and the broker's locks (default 2s)
+	CheckTimeout time.Duration `json:"-"`
+}
+
+// highWaterPercent returns the high-water mark, falling back to the default
+func (c HealthConfig) highWaterPercent() int {
+	if c.HighWaterPercent == 0 {
+		return defaultHighWaterPercent
+	}
+	return c.HighWaterPercent
+}
+
+// checkTimeout returns the liveness check timeout, falling back to the default
+func (c HealthConfig) checkTimeout() time.Duration {
+	if c.CheckTimeout <= 0 {
+		return defaultHealthCheckTimeout
+	}
+	return c.CheckTimeout
+}
+
+// HealthCheck is the result of one readiness or liveness check
+type HealthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// HealthReport is the outcome of a probe with the checks it ran
+type HealthReport struct {
+	// Status is "ok" or "unhealthy" for liveness, and "ready" or "not ready" for readiness
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// OK reports whether every check passed
+func (r HealthReport) OK() bool {
+	for _, c := range r.Checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// newHealthReport runs checks in order and sets the status to pass or fail
+func newHealthReport(pass, fail string, checks ...func() HealthCheck) HealthReport {
+	r := HealthReport{Status: pass}
+	for _, check := range checks {
+		r.Checks = append(r.Checks, check())
+	}
+	if !r.OK() {
+		r.Status = fail
+	}
+	return r
+}
+
+// healthCheck turns the error of a named check into its result
+func healthCheck(name string, err error) HealthCheck {
+	if err != nil {
+		return HealthCheck{Name: name, Error: err.Error()}
+	}
+	return HealthCheck{Name: name, OK: true}
+}
+
+// acceptLoop tracks the listener served by Serve
+type acceptLoop struct {
+	mu sync.Mutex
+	// addr is the listener's address while Serve runs, nil otherwise
+	addr net.Addr
+	// accepted counts accepted connections, so liveness can tell the loop is still accepting
+	accepted atomic.Uint64
+}
+
+// address returns the served listener's address, or nil when Serve is not running
+func (a *acceptLoop) address() net.Addr {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.addr
+}
+
+// setAddress records the served listener's address
+func (a *acceptLoop) setAddress(addr net.Addr) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.addr = addr
+}
+
+// Serve accepts connections on ln and handles each one in its own goroutine. It returns nil once
+// ln is closed. The broker reports ready only while Serve runs.
+func (b *Broker) Serve(ln net.Listener) error {
+	b.accept.setAddress(ln.Addr())
+	defer b.accept.setAddress(nil)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			b.logger.Error("failed to accept connection", "error", err)
+			continue
+		}
+		b.accept.accepted.Add(1)
+		b.logger.Debug("accepted connection", "remote_addr", conn.RemoteAddr())
+		go b.HandleConn(conn)
+	}
+}
+
+// BeginShutdown marks the broker as shutting down, so it reports not ready from then on
+func (b *Broker) BeginShutdown() {
+	b.shuttingDown.Store(true)
+}
+
+// Readiness reports whether the broker should receive clients: it is serving its listener, has
+// recovered persisted topics, is not shutting down, and no queue is above the high-water mark
+func (b *Broker) Readiness() HealthReport {
+	return newHealthReport("ready", "not ready",
+		func() HealthCheck {
+			var err error
+			if b.accept.address() == nil {
+				err = errors.New("not accepting connections")
+			}
+			return healthCheck("listener", err)
+		},
+		func() HealthCheck {
+			var err error
+			if !b.recovered.Load() {
+				err = errors.New("persisted topics not recovered yet")
+			}
+			return healthCheck("storage", err)
+		},
+		func() HealthCheck {
+			var err error
+			if b.shuttingDown.Load() {
+				err = errors.New("shutting down")
+			}
+			return healthCheck("shutdown", err)
+		},
+		func() HealthCheck { return healthCheck("queues", b.checkHighWater()) },
+	)
+}
+
+// Liveness reports whether the broker is still working: its accept loop accepts a connection and
+// its locks can be taken, each within the check timeout. A failing liveness probe means the
+// broker is wedged and should be restarted.
+func (b *Broker) Liveness() HealthReport {
+	timeout := b.cfg.Health.checkTimeout()
+	return newHealthReport("ok", "unhealthy",
+		func() HealthCheck { return healthCheck("accept_loop", b.checkAcceptLoop(timeout)) },
+		func() HealthCheck { return healthCheck("locks", b.checkLocks(timeout)) },
+	)
+}
+
+// checkHighWater fails if a topic or group queue is filled to the high-water mark or beyond
+func (b *Broker) checkHighWater() error {
+	percent := b.cfg.Health.highWaterPercent()
+	if percent < 0 {
+		return nil
+	}
+	capacity := b.cfg.Storage.MaxMessages
+	if capacity <= 0 {
+		capacity = defaultMaxMessages
+	}
+	limit := capacity * percent / 100
+	for _, s := range b.Stats() {
+		if s.Mode == Queue.String() && s.QueueDepth >= limit {
+			return fmt.Errorf("queue of topic %q holds %d of %d messages", s.Topic, s.QueueDepth, capacity)
+		}
+		for _, g := range s.Groups {
+			if g.QueueDepth >= limit {
+				return fmt.Errorf("queue of group %q on topic %q holds %d of %d messages", g.Group, s.Topic, g.QueueDepth, capacity)
+			}
+		}
+	}
+	return nil
+}
+
+// checkAcceptLoop connects to the served listener and waits for the accept loop to accept a
+// connection. The kernel completes TCP handshakes on its own, so a successful dial alone would
+// not show that the loop is still running. Before Serve starts there is nothing to check.
+func (b *Broker) checkAcceptLoop(timeout time.Duration) error {
+	addr := b.accept.address()
+	if addr == nil {
+		return nil
+	}
+	before := b.accept.accepted.Load()
+	conn, err := net.DialTimeout(addr.Network(), dialAddress(addr), timeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to listener: %w", err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(timeout)
+	for b.accept.accepted.Load() == before {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("accept loop did not accept a connection within %s", timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// dialAddress returns an address to dial a listener at; listeners bound to every interface are
+// dialed on the loopback interface
+func dialAddress(addr net.Addr) string {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok || !tcp.IP.IsUnspecified() {
+		return addr.String()
+	}
+	ip := net.IPv6loopback
+	if tcp.IP.To4() != nil {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	return net.JoinHostPort(ip.String(), fmt.Sprint(tcp.Port))
+}
+
+// checkLocks takes the locks of the topics, their queues, dispatchers and registries, the
+// subscriptions and the clients, and fails if that does not finish in time. A check that never
+// finishes is left running, and later checks fail until it does.
+func (b *Broker) checkLocks(timeout time.Duration) error {
+	if !b.lockCheck.CompareAndSwap(false, true) {
+		return errors.New("a previous check is still waiting for the broker's locks")
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer b.lockCheck.Store(false)
+		b.Stats()
+		b.subscriptions.lookup(multiLevelWildcard)
+		b.Clients()
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("broker locks not acquired within %s", timeout)
+	}
+}
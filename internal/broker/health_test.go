@@ -0,0 +1,134 @@
+package broker
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failedChecks returns the names of a report's failed checks
+func failedChecks(r HealthReport) string {
+	var names []string
+	for _, c := range r.Checks {
+		if !c.OK {
+			names = append(names, c.Name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// serve serves the broker on a loopback listener until the test ends
+func serve(t *testing.T, b *Broker, wrap func(net.Listener) net.Listener) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ln = wrap(ln)
+	done := make(chan error, 1)
+	go func() { done <- b.Serve(ln) }()
+	t.Cleanup(func() {
+		ln.Close()
+		if err := <-done; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+	})
+	waitFor(t, func() bool { return b.accept.address() != nil })
+}
+
+// stuckListener is a listener whose Accept blocks until it is closed, like a wedged accept loop
+type stuckListener struct {
+	net.Listener
+	closed chan struct{}
+}
+
+// Accept waits for the listener to be closed
+func (l *stuckListener) Accept() (net.Conn, error) {
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+// Close closes the listener and releases Accept
+func (l *stuckListener) Close() error {
+	close(l.closed)
+	return l.Listener.Close()
+}
+
+func TestReadinessFollowsBrokerState(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBrokerWithConfig(Config{
+		DefaultMode: Queue,
+		Storage:     StorageConfig{MaxMessages: 10},
+		Health:      HealthConfig{HighWaterPercent: 50},
+	}, logger)
+	defer b.Close()
+
+	if r := b.Readiness(); r.OK() || r.Status != "not ready" || failedChecks(r) != "listener,storage" {
+		t.Fatalf("expected not ready before recovery and Serve, got %+v", r)
+	}
+	if err := b.RecoverTopics(); err != nil {
+		t.Fatalf("RecoverTopics: %v", err)
+	}
+	serve(t, b, func(ln net.Listener) net.Listener { return ln })
+	if r := b.Readiness(); !r.OK() || r.Status != "ready" {
+		t.Fatalf("expected ready, got %+v", r)
+	}
+
+	// Five of ten messages reach the 50% high-water mark
+	publish(b, "jobs", "1", "2", "3", "4", "5")
+	if r := b.Readiness(); r.OK() || failedChecks(r) != "queues" {
+		t.Fatalf("expected the queue check to fail, got %+v", r)
+	}
+	if _, err := b.PurgeQueue("jobs", ""); err != nil {
+		t.Fatalf("PurgeQueue: %v", err)
+	}
+	if r := b.Readiness(); !r.OK() {
+		t.Fatalf("expected ready once the queue drained, got %+v", r)
+	}
+
+	b.BeginShutdown()
+	if r := b.Readiness(); r.OK() || failedChecks(r) != "shutdown" {
+		t.Fatalf("expected not ready while shutting down, got %+v", r)
+	}
+}
+
+func TestLivenessDetectsWedgedAcceptLoop(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBrokerWithConfig(Config{Health: HealthConfig{CheckTimeout: 200 * time.Millisecond}}, logger)
+	defer b.Close()
+
+	serve(t, b, func(ln net.Listener) net.Listener { return ln })
+	if r := b.Liveness(); !r.OK() || r.Status != "ok" {
+		t.Fatalf("expected live, got %+v", r)
+	}
+
+	stuck := NewBrokerWithConfig(Config{Health: HealthConfig{CheckTimeout: 200 * time.Millisecond}}, logger)
+	defer stuck.Close()
+	serve(t, stuck, func(ln net.Listener) net.Listener { return &stuckListener{Listener: ln, closed: make(chan struct{})} })
+	if r := stuck.Liveness(); r.OK() || r.Status != "unhealthy" || failedChecks(r) != "accept_loop" {
+		t.Fatalf("expected the accept loop check to fail, got %+v", r)
+	}
+}
+
+func TestLivenessDetectsHeldLocks(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBrokerWithConfig(Config{Health: HealthConfig{CheckTimeout: 100 * time.Millisecond}}, logger)
+	defer b.Close()
+
+	b.mu.Lock()
+	r := b.Liveness()
+	if r.OK() || failedChecks(r) != "locks" {
+		b.mu.Unlock()
+		t.Fatalf("expected the lock check to fail, got %+v", r)
+	}
+	// The first check is still waiting, so the next one fails without starting another
+	r = b.Liveness()
+	b.mu.Unlock()
+	if r.OK() || !strings.Contains(r.Checks[1].Error, "previous check") {
+		t.Fatalf("expected the pending check to be reported, got %+v", r)
+	}
+	waitFor(t, func() bool { return b.Liveness().OK() })
+}
@@ -1,6 +1,18 @@
 package broker
 
-import "log/slog"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// Errors returned by MessageQueue implementations
+var (
+	ErrQueueClosed = errors.New("queue is closed")
+	ErrQueueEmpty  = errors.New("queue is empty")
+	ErrQueueFull   = errors.New("queue full")
+)
 
 // Logger defines the logging interface used by the broker
 type Logger = *slog.Logger
@@ -38,14 +50,35 @@ func ParseDeliveryMode(s string) DeliveryMode {
 	}
 }
 
+// MarshalText implements encoding.TextMarshaler so modes read naturally in config files
+func (m DeliveryMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. Unlike ParseDeliveryMode it rejects unknown values.
+func (m *DeliveryMode) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "broadcast":
+		*m = Broadcast
+	case "queue":
+		*m = Queue
+	default:
+		return fmt.Errorf("unknown delivery mode %q", string(text))
+	}
+	return nil
+}
+
 // MessageQueue defines the interface for a message queue
 type MessageQueue interface {
 	// Enqueue adds a message to the queue
 	Enqueue(msg []byte) error
 
-	// Dequeue retrieves a message from the queue
+	// Dequeue retrieves a message from the queue without blocking; it returns ErrQueueEmpty if there is none
 	Dequeue() ([]byte, error)
 
+	// DequeueContext blocks until a message is available, ctx is done or the queue is closed
+	DequeueContext(ctx context.Context) ([]byte, error)
+
 	// IsFull checks if the queue is at capacity
 	IsFull() bool
 
@@ -56,11 +89,51 @@ type MessageQueue interface {
 	Close() error
 }
 
+// settlingQueue is implemented by queues that keep the messages dequeued for delivery until they
+// are settled, so a message delivered but not yet acknowledged is delivered again after a restart
+type settlingQueue interface {
+	// dequeueUnsettled is Dequeue, but the message is kept until it is settled
+	dequeueUnsettled() ([]byte, error)
+
+	// dequeueUnsettledContext is DequeueContext, but the message is kept until it is settled
+	dequeueUnsettledContext(ctx context.Context) ([]byte, error)
+
+	// settle releases a message dequeued unsettled once it was acked, requeued or dead-lettered
+	settle(msg []byte)
+}
+
+// dequeueFrom takes a message from q without blocking, unsettled if asked and q supports it
+func dequeueFrom(q MessageQueue, unsettled bool) ([]byte, error) {
+	if sq, ok := q.(settlingQueue); ok && unsettled {
+		return sq.dequeueUnsettled()
+	}
+	return q.Dequeue()
+}
+
+// dequeueForDelivery blocks like DequeueContext for a message to hand to a consumer; a settling
+// queue keeps it until settleIn is called
+func dequeueForDelivery(ctx context.Context, q MessageQueue) ([]byte, error) {
+	if sq, ok := q.(settlingQueue); ok {
+		return sq.dequeueUnsettledContext(ctx)
+	}
+	return q.DequeueContext(ctx)
+}
+
+// settleIn settles a message dequeued for delivery from q, if q keeps such messages
+func settleIn(q MessageQueue, msg []byte) {
+	if sq, ok := q.(settlingQueue); ok {
+		sq.settle(msg)
+	}
+}
+
 // ConsumerRegistry defines the interface for managing consumers
 type ConsumerRegistry interface {
 	// RegisterConsumer adds a channel for a consumer
 	RegisterConsumer(ch chan []byte) string
 
+	// RegisterConsumerWithPolicy adds a channel for a consumer with a slow consumer policy
+	RegisterConsumerWithPolicy(ch chan []byte, cfg SlowConsumerConfig) string
+
 	// UnregisterConsumer removes a consumer by ID
 	UnregisterConsumer(id string)
 
@@ -69,6 +142,9 @@ type ConsumerRegistry interface {
 
 	// GetConsumerCount returns the number of registered consumers
 	GetConsumerCount() int
+
+	// ConsumerStats returns the buffer usage and drop counter of every registered consumer
+	ConsumerStats() []ConsumerStats
 	// Close closes the registry and releases resources (closes consumer channels)
 	Close() error
 }
@@ -1,14 +1,17 @@
 package broker
 
 import (
-	"fmt"
+	"context"
+	"sync"
 )
 
 // MemoryMessageQueue is an in-memory queue implementation
 type MemoryMessageQueue struct {
-	queue  chan []byte
-	size   int
-	logger Logger
+	queue     chan []byte
+	size      int
+	logger    Logger
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 // NewMemoryMessageQueue creates a new in-memory message queue
@@ -20,13 +23,14 @@ func NewMemoryMessageQueue(size int, logger Logger) *MemoryMessageQueue {
 		queue:  make(chan []byte, size),
 		size:   size,
 		logger: logger,
+		closed: make(chan struct{}),
 	}
 }
 
 // Enqueue adds a message to the queue
 func (q *MemoryMessageQueue) Enqueue(msg []byte) error {
-	if q.queue == nil {
-		return fmt.Errorf("queue is closed")
+	if q.isClosed() {
+		return ErrQueueClosed
 	}
 
 	msgCopy := append([]byte(nil), msg...)
@@ -35,24 +39,37 @@ func (q *MemoryMessageQueue) Enqueue(msg []byte) error {
 		return nil
 	default:
 		q.logger.Warn("queue full, message dropped", "queue_size", q.size, "pending_messages", len(q.queue))
-		return fmt.Errorf("queue full")
+		return ErrQueueFull
 	}
 }
 
 // Dequeue retrieves a message from the queue
 func (q *MemoryMessageQueue) Dequeue() ([]byte, error) {
-	if q.queue == nil {
-		return nil, fmt.Errorf("queue is closed")
+	if q.isClosed() {
+		return nil, ErrQueueClosed
 	}
 
 	select {
-	case msg, ok := <-q.queue:
-		if !ok {
-			return nil, fmt.Errorf("queue is closed")
-		}
+	case msg := <-q.queue:
 		return msg, nil
 	default:
-		return nil, fmt.Errorf("queue is empty")
+		return nil, ErrQueueEmpty
+	}
+}
+
+// DequeueContext blocks until a message is available, ctx is done or the queue is closed
+func (q *MemoryMessageQueue) DequeueContext(ctx context.Context) ([]byte, error) {
+	if q.isClosed() {
+		return nil, ErrQueueClosed
+	}
+
+	select {
+	case msg := <-q.queue:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-q.closed:
+		return nil, ErrQueueClosed
 	}
 }
 
@@ -66,11 +83,27 @@ func (q *MemoryMessageQueue) Len() int {
 	return len(q.queue)
 }
 
-// Close closes the queue
+// Close closes the queue and discards any messages still in it
 func (q *MemoryMessageQueue) Close() error {
-	if q.queue != nil {
-		close(q.queue)
-		q.queue = nil
-	}
+	q.closeOnce.Do(func() {
+		close(q.closed)
+		for {
+			select {
+			case <-q.queue:
+			default:
+				return
+			}
+		}
+	})
 	return nil
 }
+
+// isClosed reports whether Close has been called
+func (q *MemoryMessageQueue) isClosed() bool {
+	select {
+	case <-q.closed:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,111 @@
+package broker
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/message-streaming-app/internal/prom"
+)
+
+// roleMetrics holds the counters of one client role, resolved once so the frame path does no lookups
+type roleMetrics struct {
+	messagesIn  *prom.Counter
+	messagesOut *prom.Counter
+	bytesIn     *prom.Counter
+	bytesOut    *prom.Counter
+	readErrors  *prom.Counter
+	connections *prom.Counter
+}
+
+// brokerMetrics holds the broker's Prometheus metrics
+type brokerMetrics struct {
+	registry     *prom.Registry
+	roles        map[string]*roleMetrics
+	enqueueDrops *prom.CounterVec
+	latency      *prom.HistogramVec
+}
+
+// newBrokerMetrics registers the broker's metrics. Gauges are read from b at every scrape.
+func newBrokerMetrics(b *Broker) *brokerMetrics {
+	r := prom.NewRegistry()
+	messagesIn := r.NewCounterVec("broker_messages_received_total", "Frames read from clients: messages from producers, acks and commits from consumers.", "role")
+	messagesOut := r.NewCounterVec("broker_messages_sent_total", "Frames written to clients: deliveries to consumers, confirms and credits to producers.", "role")
+	bytesIn := r.NewCounterVec("broker_received_bytes_total", "Bytes read from clients, handshakes and frame headers included.", "role")
+	bytesOut := r.NewCounterVec("broker_sent_bytes_total", "Bytes written to clients, frame headers included.", "role")
+	readErrors := r.NewCounterVec("broker_frame_read_errors_total", "Frame reads that failed other than by the client closing the connection.", "role")
+	connections := r.NewCounterVec("broker_connections_total", "Connections that completed their handshake.", "role")
+	m := &brokerMetrics{
+		registry:     r,
+		roles:        make(map[string]*roleMetrics),
+		enqueueDrops: r.NewCounterVec("broker_enqueue_drops_total", "Messages that could not be enqueued on a topic or consumer group queue.", "topic"),
+		latency:      r.NewHistogramVec("broker_delivery_latency_seconds", "Time from a message's timestamp to its delivery to a consumer.", prom.DefBuckets, "mode"),
+	}
+	for _, role := range []string{roleProducer, roleConsumer} {
+		label := roleLabel(role)
+		m.roles[role] = &roleMetrics{
+			messagesIn:  messagesIn.With(label),
+			messagesOut: messagesOut.With(label),
+			bytesIn:     bytesIn.With(label),
+			bytesOut:    bytesOut.With(label),
+			readErrors:  readErrors.With(label),
+			connections: connections.With(label),
+		}
+	}
+
+	r.NewGaugeFunc("broker_connections", "Connected clients.", []string{"role"}, func(emit func(float64, ...string)) {
+		counts := map[string]int{"producer": 0, "consumer": 0}
+		for _, c := range b.Clients() {
+			counts[c.Role]++
+		}
+		emit(float64(counts["consumer"]), "consumer")
+		emit(float64(counts["producer"]), "producer")
+	})
+	r.NewGaugeFunc("broker_queue_depth", "Messages waiting in a queue-mode topic's queue or a consumer group's queue.", []string{"topic", "group"}, func(emit func(float64, ...string)) {
+		for _, s := range b.Stats() {
+			if s.Mode == Queue.String() {
+				emit(float64(s.QueueDepth), s.Topic, "")
+			}
+			for _, g := range s.Groups {
+				emit(float64(g.QueueDepth), s.Topic, g.Group)
+			}
+		}
+	})
+	r.NewGaugeFunc("broker_consumers", "Consumers attached to a topic, or to one of its consumer groups.", []string{"topic", "group"}, func(emit func(float64, ...string)) {
+		for _, s := range b.Stats() {
+			emit(float64(s.Consumers), s.Topic, "")
+			for _, g := range s.Groups {
+				emit(float64(g.Consumers), s.Topic, g.Group)
+			}
+		}
+	})
+	return m
+}
+
+// roleLabel returns the metric label of a handshake role
+func roleLabel(role string) string {
+	if role == roleConsumer {
+		return "consumer"
+	}
+	return "producer"
+}
+
+// observeDelivery records how long after its timestamp a message was delivered in a mode
+// ("broadcast", "queue" or "group"). Messages without a timestamp are not observed.
+func (m *brokerMetrics) observeDelivery(mode string, msg []byte) {
+	var env struct {
+		Timestamp string `json:"timestamp"`
+	}
+	if json.Unmarshal(msg, &env) != nil || env.Timestamp == "" {
+		return
+	}
+	ts, err := time.Parse(time.RFC3339Nano, env.Timestamp)
+	if err != nil {
+		return
+	}
+	m.latency.With(mode).Observe(max(time.Since(ts).Seconds(), 0))
+}
+
+// Metrics returns the registry serving the broker's Prometheus metrics
+func (b *Broker) Metrics() *prom.Registry {
+	return b.metrics.registry
+}
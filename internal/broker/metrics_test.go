@@ -0,0 +1,62 @@
+package broker
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+// scrape returns the broker's metrics in the exposition format
+func scrape(t *testing.T, b *Broker) string {
+	t.Helper()
+	var out strings.Builder
+	if _, err := b.Metrics().WriteTo(&out); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	return out.String()
+}
+
+func TestBrokerMetrics(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBrokerWithConfig(Config{DefaultMode: Queue, Storage: StorageConfig{MaxMessages: 2}}, logger)
+	defer b.Close()
+
+	conn := connectPipe(t, b, "CONSUMER jobs\n")
+	waitFor(t, func() bool { return mustTopic(t, b, "jobs").dispatcher.consumerCount() == 1 })
+	msg := `{"id":"1","timestamp":"` + time.Now().UTC().Format(time.RFC3339Nano) + `"}`
+	go publish(b, "jobs", msg)
+	if _, err := protocol.ReadFrame(conn, nil); err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	waitFor(t, func() bool { return strings.Contains(scrape(t, b), `broker_messages_sent_total{role="consumer"} 1`) })
+
+	// Producers are not read while the queue is full, so the drop is forced by publishing directly
+	conn.Close()
+	waitFor(t, func() bool { return mustTopic(t, b, "jobs").dispatcher.consumerCount() == 0 })
+	publish(b, "jobs", "a")
+	_ = b.publish(mustTopic(t, b, "jobs"), []byte("b"))
+	if err := b.publish(mustTopic(t, b, "jobs"), []byte("c")); err == nil {
+		t.Fatal("expected the full queue to reject the message")
+	}
+
+	out := scrape(t, b)
+	for _, want := range []string{
+		`broker_messages_received_total{role="producer"} 2`,
+		`broker_received_bytes_total{role="consumer"} 14`,
+		`broker_connections_total{role="producer"} 2`,
+		`broker_connections{role="consumer"} 0`,
+		`broker_enqueue_drops_total{topic="jobs"} 1`,
+		`broker_queue_depth{topic="jobs",group=""} 2`,
+		`broker_consumers{topic="jobs",group=""} 0`,
+		`broker_delivery_latency_seconds_count{mode="queue"} 1`,
+		`broker_frame_read_errors_total{role="producer"} 0`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("expected %q in metrics:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package broker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+// offsetsDirName is the subdirectory of a topic's storage directory that holds committed offsets
+const offsetsDirName = "offsets"
+
+// offsetStore remembers the last offset each named consumer committed on a topic.
+// With disk storage every consumer's commit is kept in its own 8-byte file so it survives restarts.
+type offsetStore struct {
+	mu        sync.Mutex
+	dir       string
+	fsync     FsyncPolicy
+	committed map[string]uint64
+	files     map[string]*os.File
+	closed    bool
+}
+
+// openOffsetStore loads the commits persisted in dir; an empty dir keeps commits in memory only
+func openOffsetStore(dir string, fsync FsyncPolicy) (*offsetStore, error) {
+	s := &offsetStore{
+		dir:       dir,
+		fsync:     fsync,
+		committed: make(map[string]uint64),
+		files:     make(map[string]*os.File),
+	}
+	if dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create offsets directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list offsets directory: %w", err)
+	}
+	for _, e := range entries {
+		if e.IsDir() || validateConsumerID(e.Name()) != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read committed offset: %w", err)
+		}
+		// A file shorter than an offset was never fully written, so there is no commit to load
+		if len(data) == 8 {
+			s.committed[e.Name()] = binary.BigEndian.Uint64(data)
+		}
+	}
+	return s, nil
+}
+
+// commit records offset as the last message consumer id has processed
+func (s *offsetStore) commit(id string, offset uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fmt.Errorf("offset store is closed")
+	}
+
+	if s.dir != "" {
+		f, ok := s.files[id]
+		if !ok {
+			var err error
+			f, err = os.OpenFile(filepath.Join(s.dir, id), os.O_RDWR|os.O_CREATE, 0o644)
+			if err != nil {
+				return fmt.Errorf("failed to open committed offset: %w", err)
+			}
+			s.files[id] = f
+		}
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], offset)
+		if _, err := f.WriteAt(buf[:], 0); err != nil {
+			return fmt.Errorf("failed to persist committed offset: %w", err)
+		}
+		if s.fsync == FsyncAlways {
+			if err := f.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	s.committed[id] = offset
+	return nil
+}
+
+// committedOffset returns the last offset consumer id committed, if any
+func (s *offsetStore) committedOffset(id string) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offset, ok := s.committed[id]
+	return offset, ok
+}
+
+// close flushes and closes the commit files
+func (s *offsetStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var firstErr error
+	for id, f := range s.files {
+		if err := f.Sync(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		_ = f.Close()
+		delete(s.files, id)
+	}
+	return firstErr
+}
+
+// validateConsumerID checks a replaying consumer's ID; the rules are the same as for topic names
+func validateConsumerID(id string) error {
+	return validateName("consumer id", id)
+}
+
+// readCommits processes commit and nack frames from a replaying consumer until the connection
+// fails. Consumers without an ID cannot commit. Replayed messages are never redelivered, so a nack
+// moves the message at offset Tag straight to the dead-letter topic.
+func (b *Broker) readCommits(t *topic, id string, reader FrameReader) {
+	buf := make([]byte, 0, 1024)
+	for {
+		body, err := reader.ReadFrame(buf)
+		if err != nil {
+			if err != io.EOF {
+				b.logger.Debug("consumer read error", "topic", t.name, "error", err)
+			}
+			return
+		}
+		f, err := protocol.DecodeTypedFrame(body)
+		if err != nil {
+			b.logger.Warn("invalid frame from consumer", "topic", t.name, "consumer_id", id, "error", err)
+			continue
+		}
+		switch f.Type {
+		case protocol.FrameCommit:
+			if id == "" {
+				continue
+			}
+			if _, next := t.log.bounds(); f.Tag >= next {
+				b.logger.Warn("commit beyond end of topic log", "topic", t.name, "consumer_id", id, "offset", f.Tag, "next_offset", next)
+				continue
+			}
+			if err := t.offsets.commit(id, f.Tag); err != nil {
+				b.logger.Error("failed to commit offset", "topic", t.name, "consumer_id", id, "offset", f.Tag, "error", err)
+			}
+		case protocol.FrameNack:
+			b.deadLetterOffset(t, id, f.Tag, string(f.Body))
+		case protocol.FrameAck:
+			// Replayed messages stay in the log, so there is nothing to settle
+		default:
+			b.logger.Warn("unexpected frame from consumer", "topic", t.name, "consumer_id", id, "type", f.Type.String())
+		}
+	}
+}
+
+// deadLetterOffset moves a replayed message that a consumer rejected to the dead-letter topic
+func (b *Broker) deadLetterOffset(t *topic, id string, offset uint64, reason string) {
+	if !b.deadLettersEnabled(t.name) {
+		return
+	}
+	rec, err := t.log.read(offset)
+	if err != nil {
+		b.logger.Warn("nack for unavailable offset", "topic", t.name, "consumer_id", id, "offset", offset, "error", err)
+		return
+	}
+	dl := DeadLetter{Topic: t.name, ConsumerID: id, SourceOffset: &offset, Attempts: 1, Reason: reason, Payload: rec.msg}
+	if err := b.deadLetter(dl); err != nil {
+		b.logger.Error("failed to dead-letter message", "topic", t.name, "consumer_id", id, "offset", offset, "error", err)
+	}
+}
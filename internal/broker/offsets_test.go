@@ -0,0 +1,104 @@
+package broker
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+func TestOffsetStorePersistsCommits(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openOffsetStore(dir, FsyncAlways)
+	if err != nil {
+		t.Fatalf("openOffsetStore: %v", err)
+	}
+	if _, ok := s.committedOffset("writer"); ok {
+		t.Fatal("expected no commit for a new consumer")
+	}
+	_ = s.commit("writer", 7)
+	_ = s.commit("writer", 9)
+	if err := s.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// A torn commit file must not be mistaken for a commit
+	_ = os.WriteFile(filepath.Join(dir, "torn"), []byte{1, 2, 3}, 0o644)
+
+	s, err = openOffsetStore(dir, FsyncAlways)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.close()
+	if offset, ok := s.committedOffset("writer"); !ok || offset != 9 {
+		t.Fatalf("expected committed offset 9, got %d (ok=%v)", offset, ok)
+	}
+	if _, ok := s.committedOffset("torn"); ok {
+		t.Fatal("expected torn commit file to be ignored")
+	}
+}
+
+func TestReplayConsumerResumesFromCommit(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	cfg := Config{DefaultMode: Broadcast, Storage: StorageConfig{Type: StorageDisk, Dir: t.TempDir(), Fsync: FsyncAlways}}
+	b := NewBrokerWithConfig(cfg, logger)
+
+	publish(b, "events", "a", "b", "c")
+	tp := mustTopic(t, b, "events")
+
+	// A new ID starts at the oldest retained message
+	conn := connectPipe(t, b, "CONSUMER events id=writer\n")
+	if got := readOffsets(t, conn, 2); got != "[0:a 1:b]" {
+		t.Fatalf("unexpected first deliveries %s", got)
+	}
+	sendTyped(t, conn, protocol.TypedFrame{Type: protocol.FrameCommit, Tag: 1})
+	// Commits past the end of the log are ignored
+	sendTyped(t, conn, protocol.TypedFrame{Type: protocol.FrameCommit, Tag: 99})
+	waitFor(t, func() bool {
+		offset, ok := tp.offsets.committedOffset("writer")
+		return ok && offset == 1
+	})
+	conn.Close()
+
+	// Reconnecting resumes after the committed offset
+	conn = connectPipe(t, b, "CONSUMER events id=writer\n")
+	if got := readOffsets(t, conn, 1); got != "[2:c]" {
+		t.Fatalf("expected to resume at offset 2, got %s", got)
+	}
+	conn.Close()
+
+	// An explicit start position overrides the commit
+	conn = connectPipe(t, b, "CONSUMER events id=writer from=earliest\n")
+	if got := readOffsets(t, conn, 1); got != "[0:a]" {
+		t.Fatalf("expected from=earliest to override the commit, got %s", got)
+	}
+	conn.Close()
+	b.Close()
+
+	// Commits survive a broker restart
+	restarted := NewBrokerWithConfig(cfg, logger)
+	defer restarted.Close()
+	if err := restarted.RecoverTopics(); err != nil {
+		t.Fatalf("RecoverTopics: %v", err)
+	}
+	conn = connectPipe(t, restarted, "CONSUMER events id=writer\n")
+	if got := readOffsets(t, conn, 1); got != "[2:c]" {
+		t.Fatalf("expected to resume at offset 2 after restart, got %s", got)
+	}
+}
+
+func TestParseConsumerOptionsConsumerID(t *testing.T) {
+	hs, _ := protocol.ParseHandshake("CONSUMER events id=writer-1")
+	opts, err := parseConsumerOptions(hs)
+	if err != nil || opts.id != "writer-1" {
+		t.Fatalf("unexpected options %+v (err=%v)", opts, err)
+	}
+	for _, line := range []string{"CONSUMER events id=a/b", "CONSUMER events id=writer group=writers"} {
+		hs, _ := protocol.ParseHandshake(line)
+		if _, err := parseConsumerOptions(hs); err == nil {
+			t.Errorf("%q: expected error", line)
+		}
+	}
+}
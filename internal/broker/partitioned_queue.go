@@ -0,0 +1,200 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// MaxPartitions bounds the number of partitions of a PartitionedMessageQueue
+const MaxPartitions = 256
+
+// partitionsDirName is the subdirectory of a disk queue's directory holding one queue per partition
+const partitionsDirName = "partitions"
+
+// PartitionedMessageQueue is a MessageQueue split into partitions by message key. A message goes
+// to the partition its envelope's "key" hashes to, so all messages with the same key, such as the
+// metrics of one GPU, stay in one partition in publish order. Messages without a key are spread by
+// a hash of their contents. The dispatcher hands out each partition to a single consumer; Dequeue
+// and DequeueContext take messages from the partitions in turn for other readers.
+type PartitionedMessageQueue struct {
+	partitions  []MessageQueue
+	maxMessages int
+	logger      Logger
+
+	mu sync.Mutex
+	// next is the partition Dequeue tries first
+	next int
+	// notify is closed and replaced whenever a message is enqueued
+	notify chan struct{}
+	closed bool
+	done   chan struct{}
+}
+
+// NewPartitionedMessageQueue creates a partitioned queue on top of one queue per partition.
+// maxMessages bounds the undelivered messages across all partitions (default 10000).
+func NewPartitionedMessageQueue(partitions []MessageQueue, maxMessages int, logger Logger) (*PartitionedMessageQueue, error) {
+	if len(partitions) < 2 || len(partitions) > MaxPartitions {
+		return nil, fmt.Errorf("partitioned queue needs 2 to %d partitions, got %d", MaxPartitions, len(partitions))
+	}
+	if maxMessages <= 0 {
+		maxMessages = 10000
+	}
+	return &PartitionedMessageQueue{
+		partitions:  partitions,
+		maxMessages: maxMessages,
+		logger:      logger,
+		notify:      make(chan struct{}),
+		done:        make(chan struct{}),
+	}, nil
+}
+
+// partitionOf returns the partition of a message
+func (q *PartitionedMessageQueue) partitionOf(msg []byte) int {
+	h := fnv.New32a()
+	if key := parseEnvelope(msg).Key; key != "" {
+		_, _ = h.Write([]byte(key))
+	} else {
+		_, _ = h.Write(msg)
+	}
+	return int(h.Sum32() % uint32(len(q.partitions)))
+}
+
+// partition returns the queue of partition p
+func (q *PartitionedMessageQueue) partition(p int) MessageQueue {
+	return q.partitions[p]
+}
+
+// Enqueue adds a message to the queue of its partition
+func (q *PartitionedMessageQueue) Enqueue(msg []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	if n := q.lenLocked(); n >= q.maxMessages {
+		q.logger.Warn("queue full, message dropped", "queue_size", q.maxMessages, "pending_messages", n)
+		return ErrQueueFull
+	}
+	if err := q.partitions[q.partitionOf(msg)].Enqueue(msg); err != nil {
+		return err
+	}
+	close(q.notify)
+	q.notify = make(chan struct{})
+	return nil
+}
+
+// Dequeue retrieves a message from the next non-empty partition without blocking
+func (q *PartitionedMessageQueue) Dequeue() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+	return q.dequeueLocked(false)
+}
+
+// DequeueContext blocks until a message is available, ctx is done or the queue is closed
+func (q *PartitionedMessageQueue) DequeueContext(ctx context.Context) ([]byte, error) {
+	return q.dequeueContext(ctx, false)
+}
+
+// dequeueUnsettled implements settlingQueue
+func (q *PartitionedMessageQueue) dequeueUnsettled() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+	return q.dequeueLocked(true)
+}
+
+// dequeueUnsettledContext implements settlingQueue
+func (q *PartitionedMessageQueue) dequeueUnsettledContext(ctx context.Context) ([]byte, error) {
+	return q.dequeueContext(ctx, true)
+}
+
+// dequeueContext blocks until a message is available, ctx is done or the queue is closed
+func (q *PartitionedMessageQueue) dequeueContext(ctx context.Context, unsettled bool) ([]byte, error) {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return nil, ErrQueueClosed
+		}
+		msg, err := q.dequeueLocked(unsettled)
+		if !errors.Is(err, ErrQueueEmpty) {
+			q.mu.Unlock()
+			return msg, err
+		}
+		notify := q.notify
+		q.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-q.done:
+			return nil, ErrQueueClosed
+		}
+	}
+}
+
+// dequeueLocked takes a message from the first non-empty partition starting at next; an
+// unsettled message is kept by its partition until it is settled. The caller holds mu.
+func (q *PartitionedMessageQueue) dequeueLocked(unsettled bool) ([]byte, error) {
+	for i := range q.partitions {
+		p := (q.next + i) % len(q.partitions)
+		msg, err := dequeueFrom(q.partitions[p], unsettled)
+		if errors.Is(err, ErrQueueEmpty) {
+			continue
+		}
+		q.next = (p + 1) % len(q.partitions)
+		return msg, err
+	}
+	return nil, ErrQueueEmpty
+}
+
+// settle implements settlingQueue by settling the message in its partition
+func (q *PartitionedMessageQueue) settle(msg []byte) {
+	settleIn(q.partitions[q.partitionOf(msg)], msg)
+}
+
+// IsFull checks if the queue is at capacity
+func (q *PartitionedMessageQueue) IsFull() bool {
+	return q.Len() >= q.maxMessages
+}
+
+// Len returns the number of messages across all partitions
+func (q *PartitionedMessageQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.lenLocked()
+}
+
+// lenLocked sums the partition lengths. The caller holds mu.
+func (q *PartitionedMessageQueue) lenLocked() int {
+	n := 0
+	for _, pq := range q.partitions {
+		n += pq.Len()
+	}
+	return n
+}
+
+// Close closes the queue of every partition
+func (q *PartitionedMessageQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	close(q.done)
+	var errs []error
+	for _, pq := range q.partitions {
+		errs = append(errs, pq.Close())
+	}
+	return errors.Join(errs...)
+}
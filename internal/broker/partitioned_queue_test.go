@@ -0,0 +1,313 @@
+package broker
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+// newTestPartitionedQueue creates a partitioned queue over memory queues
+func newTestPartitionedQueue(t *testing.T, partitions, maxMessages int) *PartitionedMessageQueue {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	queues := make([]MessageQueue, partitions)
+	for p := range queues {
+		queues[p] = NewMemoryMessageQueue(maxMessages, logger)
+	}
+	q, err := NewPartitionedMessageQueue(queues, maxMessages, logger)
+	if err != nil {
+		t.Fatalf("NewPartitionedMessageQueue: %v", err)
+	}
+	return q
+}
+
+// keyed returns a JSON message with a partition key
+func keyed(key string, seq int) []byte {
+	return []byte(fmt.Sprintf(`{"id":"%s-%d","key":%q}`, key, seq, key))
+}
+
+// partitionsOf returns the partitions assigned to each consumer, in consumer order
+func partitionsOf(d *dispatcher, consumers ...*queueConsumer) []int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	counts := make([]int, len(consumers))
+	for _, a := range d.assignments {
+		for i, c := range consumers {
+			if a.owner == c {
+				counts[i]++
+			}
+		}
+	}
+	return counts
+}
+
+func TestPartitionedMessageQueue(t *testing.T) {
+	q := newTestPartitionedQueue(t, 4, 6)
+	for i := range 3 {
+		_ = q.Enqueue(keyed("gpu-a", i))
+		_ = q.Enqueue(keyed("gpu-b", i))
+	}
+	if err := q.Enqueue(keyed("gpu-c", 0)); err == nil {
+		t.Fatal("expected the queue to be full across partitions")
+	}
+	if !q.IsFull() || q.Len() != 6 {
+		t.Fatalf("expected 6 messages and a full queue, got %d", q.Len())
+	}
+
+	// Every message of a key lands in the same partition, in order
+	pa := q.partitionOf(keyed("gpu-a", 0))
+	for i := range 3 {
+		if p := q.partitionOf(keyed("gpu-a", i)); p != pa {
+			t.Fatalf("expected gpu-a-%d in partition %d, got %d", i, pa, p)
+		}
+	}
+	var ids []string
+	for q.partition(pa).Len() > 0 {
+		msg, _ := q.partition(pa).Dequeue()
+		if env := parseEnvelope(msg); env.Key == "gpu-a" {
+			ids = append(ids, env.ID)
+		}
+	}
+	if got := strings.Join(ids, " "); got != "gpu-a-0 gpu-a-1 gpu-a-2" {
+		t.Fatalf("expected gpu-a in order in partition %d, got %q", pa, got)
+	}
+	if n, _ := q.Dequeue(); n == nil {
+		t.Fatal("expected Dequeue to find the remaining messages in another partition")
+	}
+}
+
+func TestPartitionedDispatcherKeepsKeysOnOneConsumer(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	queue := newTestPartitionedQueue(t, 8, 1000)
+	d := newDispatcher("telemetry", "writers", queue, redeliveryPolicy{}, logger)
+	defer d.close()
+	consumers := []*queueConsumer{d.register(5), d.register(5)}
+	if got := partitionsOf(d, consumers...); got[0] != 4 || got[1] != 4 {
+		t.Fatalf("expected 4 partitions each, got %v", got)
+	}
+
+	keys := []string{"gpu-a", "gpu-b", "gpu-c", "gpu-d", "gpu-e", "gpu-f"}
+	for seq := range 5 {
+		for _, k := range keys {
+			_ = queue.Enqueue(keyed(k, seq))
+		}
+	}
+
+	// Each key is received by a single consumer, in publish order
+	owner := make(map[string]*queueConsumer)
+	next := make(map[string]int)
+	for received := 0; received < len(keys)*5; received++ {
+		var msg []byte
+		var c *queueConsumer
+		select {
+		case msg = <-consumers[0].out:
+			c = consumers[0]
+		case msg = <-consumers[1].out:
+			c = consumers[1]
+		case <-time.After(2 * time.Second):
+			t.Fatalf("received %d of %d messages", received, len(keys)*5)
+		}
+		env := parseEnvelope(msg)
+		if o, ok := owner[env.Key]; ok && o != c {
+			t.Fatalf("key %s received by consumers %s and %s", env.Key, o.id, c.id)
+		}
+		owner[env.Key] = c
+		if want := fmt.Sprintf("%s-%d", env.Key, next[env.Key]); env.ID != want {
+			t.Fatalf("expected %s, got %s", want, env.ID)
+		}
+		next[env.Key]++
+		c.release(msg)
+	}
+}
+
+func TestPartitionedDispatcherRebalances(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	queue := newTestPartitionedQueue(t, 6, 100)
+	d := newDispatcher("telemetry", "writers", queue, redeliveryPolicy{}, logger)
+	defer d.close()
+
+	a := d.register(10)
+	if got := partitionsOf(d, a); got[0] != 6 {
+		t.Fatalf("expected the only consumer to own every partition, got %v", got)
+	}
+	b := d.register(10)
+	c := d.register(10)
+	if got := partitionsOf(d, a, b, c); got[0] != 2 || got[1] != 2 || got[2] != 2 {
+		t.Fatalf("expected 2 partitions each after joins, got %v", got)
+	}
+
+	// A leave only moves the leaving consumer's partitions
+	before := make([]*queueConsumer, len(d.assignments))
+	for p, as := range d.assignments {
+		before[p] = as.owner
+	}
+	d.unregister(b)
+	if got := partitionsOf(d, a, c); got[0] != 3 || got[1] != 3 {
+		t.Fatalf("expected 3 partitions each after a leave, got %v", got)
+	}
+	for p, as := range d.assignments {
+		if before[p] != b && as.owner != before[p] {
+			t.Fatalf("partition %d moved from a remaining consumer", p)
+		}
+	}
+}
+
+func TestPartitionedDispatcherHandsOffAfterRelease(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	queue := newTestPartitionedQueue(t, 2, 100)
+	d := newDispatcher("telemetry", "writers", queue, redeliveryPolicy{}, logger)
+	defer d.close()
+
+	// Find a key for each partition
+	keyFor := make(map[int]string)
+	for i := 0; len(keyFor) < 2; i++ {
+		k := fmt.Sprintf("gpu-%d", i)
+		keyFor[queue.partitionOf(keyed(k, 0))] = k
+	}
+
+	a := d.register(1)
+	_ = queue.Enqueue(keyed(keyFor[1], 0))
+	first := <-a.out
+
+	// b takes over partition 1, but not while a still holds a message of it
+	b := d.register(1)
+	if got := partitionsOf(d, a, b); got[0] != 1 || got[1] != 1 {
+		t.Fatalf("expected 1 partition each, got %v", got)
+	}
+	_ = queue.Enqueue(keyed(keyFor[1], 1))
+	select {
+	case msg := <-b.out:
+		t.Fatalf("expected the new owner to wait for the handoff, got %s", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+	a.release(first)
+	if got := parseEnvelope(receiveRaw(t, b)).ID; got != keyFor[1]+"-1" {
+		t.Fatalf("expected %s-1 after the handoff, got %s", keyFor[1], got)
+	}
+}
+
+func TestPartitionedDispatcherPrefetchBelowPartitions(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	queue := newTestPartitionedQueue(t, 4, 100)
+	d := newDispatcher("telemetry", "writers", queue, redeliveryPolicy{}, logger)
+	defer d.close()
+
+	// Keys of two different partitions
+	keyFor := make(map[int]string)
+	for i := 0; len(keyFor) < 2; i++ {
+		k := fmt.Sprintf("gpu-%d", i)
+		if p := queue.partitionOf(keyed(k, 0)); keyFor[p] == "" {
+			keyFor[p] = k
+		}
+	}
+
+	// One slot for four partitions: the empty ones must not keep it from the busy ones
+	c := d.register(1)
+	for _, k := range keyFor {
+		for i := 0; i < 3; i++ {
+			_ = queue.Enqueue(keyed(k, i))
+		}
+	}
+	next := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		msg := receiveRaw(t, c)
+		id := parseEnvelope(msg).ID
+		key := id[:strings.LastIndex(id, "-")]
+		if want := fmt.Sprintf("%s-%d", key, next[key]); id != want {
+			t.Fatalf("expected %s, got %s", want, id)
+		}
+		next[key]++
+		c.release(msg)
+	}
+}
+
+func TestPartitionedTopicKeepsOrderWhenOwnerLeaves(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBrokerWithConfig(Config{
+		DefaultMode: Queue,
+		Topics:      map[string]TopicConfig{"telemetry": {Mode: ModeOf(Queue), Partitions: 2}},
+	}, logger)
+	defer b.Close()
+	tp := mustTopic(t, b, "telemetry")
+	queue := tp.queue.(*PartitionedMessageQueue)
+
+	// A key of partition 1, which moves to the second consumer when it joins
+	key := ""
+	for i := 0; key == ""; i++ {
+		if k := fmt.Sprintf("gpu-%d", i); queue.partitionOf(keyed(k, 0)) == 1 {
+			key = k
+		}
+	}
+
+	first := connectPipe(t, b, "CONSUMER telemetry ack=manual prefetch=3\n")
+	waitFor(t, func() bool { return tp.dispatcher.consumerCount() == 1 })
+	for i := 0; i < 6; i++ {
+		publish(b, "telemetry", string(keyed(key, i)))
+	}
+	// The first consumer reads one delivery; the next is being written and the third is buffered
+	if f := readTyped(t, first); parseEnvelope(f.Body).ID != key+"-0" {
+		t.Fatalf("expected %s-0, got %s", key, f.Body)
+	}
+	waitFor(t, func() bool { return tp.dispatcher.backlogLen() == 3 })
+
+	second := connectPipe(t, b, "CONSUMER telemetry ack=manual prefetch=3\n")
+	waitFor(t, func() bool { return tp.dispatcher.consumerCount() == 2 })
+	first.Close()
+
+	// The new owner gets the unacked and buffered messages back before the later ones
+	for i := 0; i < 6; i++ {
+		f := readTyped(t, second)
+		if got, want := parseEnvelope(f.Body).ID, fmt.Sprintf("%s-%d", key, i); got != want {
+			t.Fatalf("expected %s, got %s", want, got)
+		}
+		sendTyped(t, second, protocol.TypedFrame{Type: protocol.FrameAck, Tag: f.Tag})
+	}
+}
+
+// receiveRaw waits for one delivery on a queue consumer without freeing its slot
+func receiveRaw(t *testing.T, c *queueConsumer) []byte {
+	t.Helper()
+	select {
+	case msg := <-c.out:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatalf("consumer %s received nothing", c.id)
+		return nil
+	}
+}
+
+func TestPartitionedTopicDiskStorage(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	cfg := Config{
+		DefaultMode: Queue,
+		Storage:     StorageConfig{Type: StorageDisk, Dir: t.TempDir()},
+		Topics:      map[string]TopicConfig{"telemetry": {Mode: ModeOf(Queue), Partitions: 4}},
+	}
+	b := NewBrokerWithConfig(cfg, logger)
+	publish(b, "telemetry", string(keyed("gpu-a", 0)), string(keyed("gpu-a", 1)))
+	b.Close()
+
+	restarted := NewBrokerWithConfig(cfg, logger)
+	defer restarted.Close()
+	if err := restarted.RecoverTopics(); err != nil {
+		t.Fatalf("RecoverTopics: %v", err)
+	}
+	q, ok := mustTopic(t, restarted, "telemetry").queue.(*PartitionedMessageQueue)
+	if !ok {
+		t.Fatal("expected a partitioned queue")
+	}
+	p := q.partitionOf(keyed("gpu-a", 0))
+	if _, err := os.Stat(filepath.Join(cfg.Storage.Dir, "telemetry", partitionsDirName, strconv.Itoa(p))); err != nil {
+		t.Fatalf("expected a directory for partition %d: %v", p, err)
+	}
+	if got := q.partition(p).Len(); got != 2 {
+		t.Fatalf("expected both messages in partition %d after restart, got %d", p, got)
+	}
+}
@@ -0,0 +1,223 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// MaxPriorityLevels bounds the number of priority levels of a PriorityMessageQueue
+const MaxPriorityLevels = 10
+
+// priorityDirName is the subdirectory of a disk queue's directory holding one queue per priority level
+const priorityDirName = "priority"
+
+// defaultStarvationLimit is used when PriorityQueueOptions.StarvationLimit is not set
+const defaultStarvationLimit = 10
+
+// PriorityQueueOptions tunes a PriorityMessageQueue
+type PriorityQueueOptions struct {
+	// MaxMessages bounds the number of undelivered messages across all levels (default 10000)
+	MaxMessages int
+	// StarvationLimit is how many messages of higher levels may be dequeued while a lower level
+	// waits before that level is served once (default 10)
+	StarvationLimit int
+}
+
+// PriorityMessageQueue is a MessageQueue that keeps one queue per priority level and dequeues the
+// highest level first. A message's level is the "priority" field of its envelope, 0 (the lowest
+// and the default) to levels-1; values outside that range are clamped. So that a steady stream of
+// high-priority messages cannot starve the lower levels, a waiting level is served once it has been
+// passed over StarvationLimit times.
+type PriorityMessageQueue struct {
+	levels []MessageQueue
+	opts   PriorityQueueOptions
+	logger Logger
+
+	mu sync.Mutex
+	// skipped counts, per level, the dequeues from higher levels since the level was last served
+	// while it had messages waiting
+	skipped []int
+	// notify is closed and replaced whenever a message is enqueued
+	notify chan struct{}
+	closed bool
+	done   chan struct{}
+}
+
+// NewPriorityMessageQueue creates a priority queue on top of one queue per level, lowest first
+func NewPriorityMessageQueue(levels []MessageQueue, opts PriorityQueueOptions, logger Logger) (*PriorityMessageQueue, error) {
+	if len(levels) < 2 || len(levels) > MaxPriorityLevels {
+		return nil, fmt.Errorf("priority queue needs 2 to %d levels, got %d", MaxPriorityLevels, len(levels))
+	}
+	if opts.MaxMessages <= 0 {
+		opts.MaxMessages = 10000
+	}
+	if opts.StarvationLimit <= 0 {
+		opts.StarvationLimit = defaultStarvationLimit
+	}
+	return &PriorityMessageQueue{
+		levels:  levels,
+		opts:    opts,
+		logger:  logger,
+		skipped: make([]int, len(levels)),
+		notify:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// level returns the priority level of a message
+func (q *PriorityMessageQueue) level(msg []byte) int {
+	return min(max(parseEnvelope(msg).Priority, 0), len(q.levels)-1)
+}
+
+// Enqueue adds a message to the queue of its priority level
+func (q *PriorityMessageQueue) Enqueue(msg []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	if n := q.lenLocked(); n >= q.opts.MaxMessages {
+		q.logger.Warn("queue full, message dropped", "queue_size", q.opts.MaxMessages, "pending_messages", n)
+		return ErrQueueFull
+	}
+	if err := q.levels[q.level(msg)].Enqueue(msg); err != nil {
+		return err
+	}
+	close(q.notify)
+	q.notify = make(chan struct{})
+	return nil
+}
+
+// Dequeue retrieves the next message by priority without blocking
+func (q *PriorityMessageQueue) Dequeue() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+	return q.dequeueLocked(false)
+}
+
+// DequeueContext blocks until a message is available, ctx is done or the queue is closed
+func (q *PriorityMessageQueue) DequeueContext(ctx context.Context) ([]byte, error) {
+	return q.dequeueContext(ctx, false)
+}
+
+// dequeueUnsettled implements settlingQueue
+func (q *PriorityMessageQueue) dequeueUnsettled() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+	return q.dequeueLocked(true)
+}
+
+// dequeueUnsettledContext implements settlingQueue
+func (q *PriorityMessageQueue) dequeueUnsettledContext(ctx context.Context) ([]byte, error) {
+	return q.dequeueContext(ctx, true)
+}
+
+// dequeueContext blocks until a message is available, ctx is done or the queue is closed
+func (q *PriorityMessageQueue) dequeueContext(ctx context.Context, unsettled bool) ([]byte, error) {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return nil, ErrQueueClosed
+		}
+		msg, err := q.dequeueLocked(unsettled)
+		if !errors.Is(err, ErrQueueEmpty) {
+			q.mu.Unlock()
+			return msg, err
+		}
+		notify := q.notify
+		q.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-q.done:
+			return nil, ErrQueueClosed
+		}
+	}
+}
+
+// dequeueLocked takes a message from the level chosen by next; an unsettled message is kept by its
+// level until it is settled. The caller holds mu.
+func (q *PriorityMessageQueue) dequeueLocked(unsettled bool) ([]byte, error) {
+	lvl := q.next()
+	if lvl < 0 {
+		return nil, ErrQueueEmpty
+	}
+	for l := range lvl {
+		if q.levels[l].Len() > 0 {
+			q.skipped[l]++
+		}
+	}
+	q.skipped[lvl] = 0
+	return dequeueFrom(q.levels[lvl], unsettled)
+}
+
+// settle implements settlingQueue by settling the message in its level
+func (q *PriorityMessageQueue) settle(msg []byte) {
+	settleIn(q.levels[q.level(msg)], msg)
+}
+
+// next returns the level to serve: the highest starving level if any, otherwise the highest
+// non-empty level, or -1 if every level is empty. The caller holds mu.
+func (q *PriorityMessageQueue) next() int {
+	highest := -1
+	for l := len(q.levels) - 1; l >= 0; l-- {
+		if q.levels[l].Len() == 0 {
+			continue
+		}
+		if q.skipped[l] >= q.opts.StarvationLimit {
+			return l
+		}
+		if highest < 0 {
+			highest = l
+		}
+	}
+	return highest
+}
+
+// IsFull checks if the queue is at capacity
+func (q *PriorityMessageQueue) IsFull() bool {
+	return q.Len() >= q.opts.MaxMessages
+}
+
+// Len returns the number of messages across all levels
+func (q *PriorityMessageQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.lenLocked()
+}
+
+// lenLocked sums the level lengths. The caller holds mu.
+func (q *PriorityMessageQueue) lenLocked() int {
+	n := 0
+	for _, lq := range q.levels {
+		n += lq.Len()
+	}
+	return n
+}
+
+// Close closes the queue of every level
+func (q *PriorityMessageQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	close(q.done)
+	var errs []error
+	for _, lq := range q.levels {
+		errs = append(errs, lq.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,126 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestPriorityQueue creates a memory-backed priority queue
+func newTestPriorityQueue(t *testing.T, levels int, opts PriorityQueueOptions) *PriorityMessageQueue {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	queues := make([]MessageQueue, levels)
+	for l := range queues {
+		queues[l] = NewMemoryMessageQueue(opts.MaxMessages, logger)
+	}
+	q, err := NewPriorityMessageQueue(queues, opts, logger)
+	if err != nil {
+		t.Fatalf("NewPriorityMessageQueue: %v", err)
+	}
+	return q
+}
+
+// prioritized returns a JSON message with a priority
+func prioritized(id string, priority int) []byte {
+	return []byte(fmt.Sprintf(`{"id":%q,"priority":%d}`, id, priority))
+}
+
+// dequeueIDs dequeues n messages and returns their IDs
+func dequeueIDs(t *testing.T, q MessageQueue, n int) string {
+	t.Helper()
+	ids := ""
+	for range n {
+		msg, err := q.Dequeue()
+		if err != nil {
+			t.Fatalf("Dequeue: %v", err)
+		}
+		ids += parseEnvelope(msg).ID
+	}
+	return ids
+}
+
+func TestPriorityMessageQueueOrder(t *testing.T) {
+	q := newTestPriorityQueue(t, 3, PriorityQueueOptions{})
+	defer q.Close()
+	for _, msg := range [][]byte{prioritized("a", 0), prioritized("b", 0), prioritized("x", 2), prioritized("m", 1), prioritized("y", 9), []byte("raw")} {
+		if err := q.Enqueue(msg); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+	// Priorities above the top level are clamped to it, and messages without one are lowest
+	if got := dequeueIDs(t, q, 6); got != "xymab" {
+		t.Fatalf("expected xymab, got %q", got)
+	}
+	if _, err := q.Dequeue(); !errors.Is(err, ErrQueueEmpty) {
+		t.Fatalf("expected ErrQueueEmpty, got %v", err)
+	}
+}
+
+func TestPriorityMessageQueueDoesNotStarveLowLevels(t *testing.T) {
+	q := newTestPriorityQueue(t, 2, PriorityQueueOptions{StarvationLimit: 2})
+	defer q.Close()
+	_ = q.Enqueue(prioritized("l", 0))
+	_ = q.Enqueue(prioritized("L", 0))
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		_ = q.Enqueue(prioritized(id, 1))
+	}
+	if got := dequeueIDs(t, q, 7); got != "12l34L5" {
+		t.Fatalf("expected the low level to be served every third dequeue, got %q", got)
+	}
+}
+
+func TestPriorityMessageQueueCapacityAndBlocking(t *testing.T) {
+	q := newTestPriorityQueue(t, 2, PriorityQueueOptions{MaxMessages: 2})
+	_ = q.Enqueue(prioritized("a", 0))
+	_ = q.Enqueue(prioritized("b", 1))
+	if !q.IsFull() || q.Len() != 2 {
+		t.Fatalf("expected a full queue of 2, got %d", q.Len())
+	}
+	if err := q.Enqueue(prioritized("c", 1)); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+	_ = dequeueIDs(t, q, 2)
+
+	got := make(chan []byte)
+	go func() {
+		msg, _ := q.DequeueContext(context.Background())
+		got <- msg
+	}()
+	time.Sleep(20 * time.Millisecond)
+	_ = q.Enqueue(prioritized("d", 1))
+	if msg := <-got; parseEnvelope(msg).ID != "d" {
+		t.Fatalf("expected the blocked dequeue to get d, got %s", msg)
+	}
+
+	_ = q.Close()
+	if _, err := q.DequeueContext(context.Background()); !errors.Is(err, ErrQueueClosed) {
+		t.Fatalf("expected ErrQueueClosed, got %v", err)
+	}
+}
+
+func TestBrokerPriorityTopicOnDisk(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	cfg := Config{
+		DefaultMode: Queue,
+		Topics:      map[string]TopicConfig{"alerts": {Mode: ModeOf(Queue), PriorityLevels: 3}},
+		Storage:     StorageConfig{Type: StorageDisk, Dir: t.TempDir()},
+	}
+	b := NewBrokerWithConfig(cfg, logger)
+	publish(b, "alerts", string(prioritized("telemetry", 0)), string(prioritized("alert", 2)))
+	b.Close()
+
+	// Levels are kept on disk, so the order survives a restart
+	restarted := NewBrokerWithConfig(cfg, logger)
+	defer restarted.Close()
+	if err := restarted.RecoverTopics(); err != nil {
+		t.Fatalf("RecoverTopics: %v", err)
+	}
+	if got := dequeueIDs(t, mustTopic(t, restarted, "alerts").queue, 2); got != "alerttelemetry" {
+		t.Fatalf("expected the alert first, got %q", got)
+	}
+}
@@ -0,0 +1,134 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+// startKind selects how a replaying consumer's first offset is chosen
+type startKind int
+
+const (
+	startEarliest startKind = iota
+	startLatest
+	startOffset
+	startTime
+)
+
+// startPosition is where a replaying consumer starts reading the topic log
+type startPosition struct {
+	kind   startKind
+	offset uint64
+	time   time.Time
+}
+
+// parseStartPosition parses the value of the "from" handshake option
+func parseStartPosition(v string) (startPosition, error) {
+	switch v {
+	case protocol.FromEarliest:
+		return startPosition{kind: startEarliest}, nil
+	case protocol.FromLatest:
+		return startPosition{kind: startLatest}, nil
+	}
+	if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+		return startPosition{kind: startOffset, offset: n}, nil
+	}
+	if ts, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return startPosition{kind: startTime, time: ts}, nil
+	}
+	return startPosition{}, fmt.Errorf("invalid start position %q: want earliest, latest, an offset or an RFC 3339 time", v)
+}
+
+// resolve turns the position into an offset within the log's retained range.
+// Offsets older than the retention window start at the oldest retained message.
+func (p startPosition) resolve(log *topicLog) uint64 {
+	first, next := log.bounds()
+	switch p.kind {
+	case startLatest:
+		return next
+	case startOffset:
+		return min(max(p.offset, first), next)
+	case startTime:
+		return log.offsetForTime(p.time)
+	default:
+		return first
+	}
+}
+
+// replayStart returns where a replaying consumer starts: its explicit start position if it sent
+// one, otherwise just after the offset it last committed, otherwise the oldest retained message
+func (b *Broker) replayStart(t *topic, opts consumerOptions) uint64 {
+	if opts.from != nil {
+		return opts.from.resolve(t.log)
+	}
+	if committed, ok := t.offsets.committedOffset(opts.id); ok {
+		return startPosition{kind: startOffset, offset: committed + 1}.resolve(t.log)
+	}
+	return startPosition{kind: startEarliest}.resolve(t.log)
+}
+
+// handleConsumerReplay streams a topic's log to a consumer starting at a chosen offset, first the
+// retained history and then new messages as they are published. Every delivery is a typed frame
+// whose tag is the message offset. Replayed messages are read from the log rather than taken from
+// a queue, so acks are not needed; a consumer with an ID commits offsets instead. Messages that do
+// not match the consumer's filter are skipped, leaving gaps in the delivered offsets. Once the
+// broker drains and the consumer has caught up with the log, it is sent a going-away frame.
+func (b *Broker) handleConsumerReplay(t *topic, opts consumerOptions, reader FrameReader, writer FrameWriter) {
+	offset := b.replayStart(t, opts)
+	b.logger.Info("replay consumer subscribed", "topic", t.name, "consumer_id", opts.id, "start_offset", offset)
+
+	// The read side ends when the consumer disconnects
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.readCommits(t, opts.id, reader)
+	}()
+
+	for {
+		// Take the notification channel before reading so an append in between is not missed
+		changed := t.log.changed()
+		rec, err := t.log.read(offset)
+		if err != nil {
+			if !errors.Is(err, errOffsetOutOfRange) {
+				b.logger.Error("failed to read topic log", "topic", t.name, "offset", offset, "error", err)
+				return
+			}
+			first, next := t.log.bounds()
+			if offset < first {
+				// Retention dropped messages this consumer had not read yet
+				b.logger.Warn("replay consumer fell behind retention", "topic", t.name, "offset", offset, "first_offset", first)
+				offset = first
+				continue
+			}
+			if offset < next {
+				continue
+			}
+			select {
+			case <-changed:
+				continue
+			case <-done:
+				return
+			case <-t.log.done():
+				return
+			case <-b.conns.draining:
+				b.goAway(writer, true)
+				return
+			}
+		}
+
+		if !opts.matches(rec.msg) {
+			offset++
+			continue
+		}
+		frame := protocol.EncodeTypedFrame(protocol.TypedFrame{Type: protocol.FrameDeliver, Tag: rec.offset, Body: rec.msg})
+		if err := writer.WriteFrame(frame); err != nil {
+			b.logger.Error("consumer write error", "topic", t.name, "offset", offset, "error", err)
+			return
+		}
+		offset++
+	}
+}
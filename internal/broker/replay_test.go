@@ -0,0 +1,166 @@
+package broker
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+// publish sends messages to a topic through a producer connection
+func publish(b *Broker, topicName string, msgs ...string) {
+	data := []byte("PRODUCER " + topicName + "\n")
+	for _, m := range msgs {
+		data = append(data, frameBytes([]byte(m))...)
+	}
+	b.HandleConn(&simpleConn{readBuf: bytes.NewReader(data), writeBuf: &bytes.Buffer{}})
+}
+
+// readOffsets reads n deliveries and returns them as "offset:body" strings
+func readOffsets(t *testing.T, conn net.Conn, n int) string {
+	t.Helper()
+	var got []string
+	for i := 0; i < n; i++ {
+		f := readTyped(t, conn)
+		got = append(got, fmt.Sprintf("%d:%s", f.Tag, f.Body))
+	}
+	return fmt.Sprint(got)
+}
+
+func TestTopicLogRetention(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	l := newTopicLog(&memoryLog{}, 3, FsyncNever, 0, logger)
+	defer l.close()
+
+	for i := 0; i < 5; i++ {
+		offset, err := l.append([]byte(fmt.Sprintf("m%d", i)))
+		if err != nil || offset != uint64(i) {
+			t.Fatalf("append %d: offset=%d err=%v", i, offset, err)
+		}
+	}
+	if first, next := l.bounds(); first != 2 || next != 5 {
+		t.Fatalf("expected retained range [2,5), got [%d,%d)", first, next)
+	}
+	if _, err := l.read(1); err != errOffsetOutOfRange {
+		t.Fatalf("expected dropped offset to be out of range, got %v", err)
+	}
+	rec, err := l.read(4)
+	if err != nil || string(rec.msg) != "m4" || rec.timestamp.IsZero() {
+		t.Fatalf("unexpected record %+v (err=%v)", rec, err)
+	}
+}
+
+func TestTopicLogOffsetForTime(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	l := newTopicLog(&memoryLog{}, 100, FsyncNever, 0, logger)
+	defer l.close()
+
+	_, _ = l.append([]byte("old"))
+	time.Sleep(5 * time.Millisecond)
+	cut := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	_, _ = l.append([]byte("new-1"))
+	_, _ = l.append([]byte("new-2"))
+
+	if got := l.offsetForTime(cut); got != 1 {
+		t.Fatalf("expected offset 1 for cut time, got %d", got)
+	}
+	if got := l.offsetForTime(time.Now().Add(time.Hour)); got != 3 {
+		t.Fatalf("expected future time to map to the next offset, got %d", got)
+	}
+}
+
+func TestParseStartPosition(t *testing.T) {
+	for _, v := range []string{"earliest", "latest", "42", "2026-01-02T15:04:05Z"} {
+		if _, err := parseStartPosition(v); err != nil {
+			t.Errorf("parseStartPosition(%q): %v", v, err)
+		}
+	}
+	for _, v := range []string{"soon", "-1", "2026-01-02"} {
+		if _, err := parseStartPosition(v); err == nil {
+			t.Errorf("parseStartPosition(%q): expected error", v)
+		}
+	}
+
+	hs, _ := protocol.ParseHandshake("CONSUMER jobs group=writers from=earliest")
+	if _, err := parseConsumerOptions(hs); err == nil {
+		t.Error("expected error when combining from and group")
+	}
+}
+
+func TestReplayConsumerStartPositions(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Broadcast, logger)
+	defer b.Close()
+
+	publish(b, "events", "a", "b", "c")
+
+	earliest := connectPipe(t, b, "CONSUMER events from=earliest\n")
+	if got := readOffsets(t, earliest, 3); got != "[0:a 1:b 2:c]" {
+		t.Fatalf("earliest: unexpected history %s", got)
+	}
+
+	fromOffset := connectPipe(t, b, "CONSUMER events from=1\n")
+	if got := readOffsets(t, fromOffset, 2); got != "[1:b 2:c]" {
+		t.Fatalf("offset: unexpected history %s", got)
+	}
+
+	// Give the latest consumer time to subscribe before the next publish
+	latest := connectPipe(t, b, "CONSUMER events from=latest\n")
+	time.Sleep(20 * time.Millisecond)
+
+	// Once caught up, every replay consumer switches to live delivery
+	publish(b, "events", "d")
+	for name, conn := range map[string]net.Conn{"earliest": earliest, "offset": fromOffset, "latest": latest} {
+		if got := readOffsets(t, conn, 1); got != "[3:d]" {
+			t.Fatalf("%s: expected live message, got %s", name, got)
+		}
+	}
+}
+
+func TestReplayConsumerFromTime(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Queue, logger)
+	defer b.Close()
+
+	publish(b, "jobs", "before")
+	time.Sleep(5 * time.Millisecond)
+	cut := time.Now().UTC().Format(time.RFC3339Nano)
+	time.Sleep(5 * time.Millisecond)
+	publish(b, "jobs", "after")
+
+	conn := connectPipe(t, b, "CONSUMER jobs from="+cut+"\n")
+	if got := readOffsets(t, conn, 1); got != "[1:after]" {
+		t.Fatalf("expected replay from time to start at offset 1, got %s", got)
+	}
+	// Replaying does not consume from the queue
+	if q := mustTopic(t, b, "jobs").queue.Len(); q != 2 {
+		t.Fatalf("expected queue to keep both messages, got %d", q)
+	}
+}
+
+func TestReplayOffsetsSurviveRestart(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	cfg := Config{DefaultMode: Broadcast, Storage: StorageConfig{Type: StorageDisk, Dir: t.TempDir()}}
+
+	b := NewBrokerWithConfig(cfg, logger)
+	publish(b, "events", "a", "b")
+	b.Close()
+
+	restarted := NewBrokerWithConfig(cfg, logger)
+	defer restarted.Close()
+	if err := restarted.RecoverTopics(); err != nil {
+		t.Fatalf("RecoverTopics: %v", err)
+	}
+	publish(restarted, "events", "c")
+
+	conn := connectPipe(t, restarted, "CONSUMER events from=earliest\n")
+	if got := readOffsets(t, conn, 3); got != "[0:a 1:b 2:c]" {
+		t.Fatalf("expected offsets to continue after restart, got %s", got)
+	}
+}
@@ -0,0 +1,322 @@
+package broker
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// scheduledDirName is the subdirectory of a topic's storage directory that holds its scheduled messages
+const scheduledDirName = "scheduled"
+
+// Scheduled message store record kinds
+const (
+	// recordScheduled is followed by the due time in Unix nanoseconds and the message
+	recordScheduled byte = 's'
+	// recordReleased is followed by the offset of a scheduled record whose message was released
+	recordReleased byte = 'r'
+)
+
+// scheduleRetryInterval is how long a message the topic could not take is held before the next try
+const scheduleRetryInterval = time.Second
+
+// scheduleCompactInterval is how many releases happen between deletions of released records
+const scheduleCompactInterval = 1024
+
+// ErrTooManyScheduled is returned when a topic already holds its maximum of scheduled messages
+var ErrTooManyScheduled = errors.New("too many scheduled messages")
+
+// scheduleFields are looked for before parsing a message, so only messages that may ask for
+// delayed delivery pay for the parse
+var scheduleFields = [][]byte{[]byte(`"deliver_at"`), []byte(`"delay_ms"`)}
+
+// mayBeScheduled reports whether a message may ask for delayed delivery
+func mayBeScheduled(msg []byte) bool {
+	for _, f := range scheduleFields {
+		if bytes.Contains(msg, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliverAt returns when a message asked to be delivered: its deliver_at time, or else delay_ms
+// after now. It returns false for a message that should be delivered right away.
+func (e envelope) deliverAt(now time.Time) (time.Time, bool, error) {
+	if e.DeliverAt != "" {
+		due, err := time.Parse(time.RFC3339Nano, e.DeliverAt)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("invalid deliver_at %q: want an RFC 3339 time", e.DeliverAt)
+		}
+		return due, due.After(now), nil
+	}
+	if e.DelayMs > 0 {
+		return now.Add(time.Duration(e.DelayMs) * time.Millisecond), true, nil
+	}
+	return time.Time{}, false, nil
+}
+
+// scheduledMessage is a message waiting for its due time, with the offset of its record
+type scheduledMessage struct {
+	offset uint64
+	due    time.Time
+	msg    []byte
+}
+
+// scheduleHeap orders scheduled messages by due time, then by the order they were scheduled in
+type scheduleHeap []*scheduledMessage
+
+func (h scheduleHeap) Len() int { return len(h) }
+func (h scheduleHeap) Less(i, j int) bool {
+	if h[i].due.Equal(h[j].due) {
+		return h[i].offset < h[j].offset
+	}
+	return h[i].due.Before(h[j].due)
+}
+func (h scheduleHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *scheduleHeap) Push(x any)   { *h = append(*h, x.(*scheduledMessage)) }
+func (h *scheduleHeap) Pop() any {
+	old := *h
+	m := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return m
+}
+
+// scheduler holds a topic's delayed messages in a time-ordered heap and releases each one into
+// the topic when it is due. Every scheduled message is also written to a record store, followed
+// by a release record once it is delivered, so with disk storage the messages still pending
+// survive a restart. Records before the oldest pending message are deleted as releases go by.
+type scheduler struct {
+	topic   string
+	store   recordLog
+	fsync   FsyncPolicy
+	max     int
+	release func(msg []byte) error
+	logger  Logger
+
+	mu      sync.Mutex
+	pending scheduleHeap
+	// sinceCompact counts releases since released records were last deleted
+	sinceCompact int
+
+	// wake is signalled when a message is scheduled, in case it is due before the current head
+	wake    chan struct{}
+	closed  chan struct{}
+	stopped chan struct{}
+}
+
+// newScheduler recovers the messages still pending in store and starts releasing them through
+// release. max bounds the number of pending messages.
+func newScheduler(topic string, store recordLog, fsync FsyncPolicy, max int, release func(msg []byte) error, logger Logger) (*scheduler, error) {
+	s := &scheduler{
+		topic:   topic,
+		store:   store,
+		fsync:   fsync,
+		max:     max,
+		release: release,
+		logger:  logger,
+		wake:    make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	if len(s.pending) > 0 {
+		logger.Info("scheduled messages recovered", "topic", topic, "pending", len(s.pending))
+	}
+	go s.run()
+	return s, nil
+}
+
+// recover rebuilds the pending heap from the store: every scheduled record without a release record
+func (s *scheduler) recover() error {
+	byOffset := make(map[uint64]*scheduledMessage)
+	for offset := s.store.firstOffset(); offset < s.store.nextOffset(); offset++ {
+		rec, err := s.store.read(offset)
+		if err != nil {
+			return fmt.Errorf("failed to read scheduled message %d: %w", offset, err)
+		}
+		if len(rec) < 9 {
+			return fmt.Errorf("scheduled message record %d is too short", offset)
+		}
+		switch rec[0] {
+		case recordScheduled:
+			due := time.Unix(0, int64(binary.BigEndian.Uint64(rec[1:9])))
+			byOffset[offset] = &scheduledMessage{offset: offset, due: due, msg: rec[9:]}
+		case recordReleased:
+			delete(byOffset, binary.BigEndian.Uint64(rec[1:9]))
+		default:
+			return fmt.Errorf("scheduled message record %d has unknown kind %q", offset, rec[0])
+		}
+	}
+	for _, m := range byOffset {
+		s.pending = append(s.pending, m)
+	}
+	heap.Init(&s.pending)
+	return nil
+}
+
+// schedule stores a message to be released at due
+func (s *scheduler) schedule(due time.Time, msg []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosed() {
+		return ErrQueueClosed
+	}
+	if len(s.pending) >= s.max {
+		return ErrTooManyScheduled
+	}
+
+	rec := make([]byte, 9+len(msg))
+	rec[0] = recordScheduled
+	binary.BigEndian.PutUint64(rec[1:9], uint64(due.UnixNano()))
+	copy(rec[9:], msg)
+	offset, err := s.appendLocked(rec)
+	if err != nil {
+		return fmt.Errorf("failed to store scheduled message: %w", err)
+	}
+	heap.Push(&s.pending, &scheduledMessage{offset: offset, due: due, msg: rec[9:]})
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// appendLocked writes a record to the store, flushing it if the fsync policy asks for it.
+// The caller holds mu.
+func (s *scheduler) appendLocked(rec []byte) (uint64, error) {
+	offset, err := s.store.append(rec)
+	if err != nil {
+		return 0, err
+	}
+	if s.fsync == FsyncAlways {
+		if err := s.store.sync(); err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+// len returns the number of messages waiting to be released
+func (s *scheduler) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// run releases messages as they become due until the scheduler is closed
+func (s *scheduler) run() {
+	defer close(s.stopped)
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		wait := s.releaseDue(time.Now())
+		if wait > 0 {
+			timer.Reset(wait)
+		}
+		select {
+		case <-s.closed:
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+}
+
+// releaseDue releases every message due by now and returns how long until the next one is due,
+// or 0 if none is pending
+func (s *scheduler) releaseDue(now time.Time) time.Duration {
+	for {
+		s.mu.Lock()
+		if len(s.pending) == 0 || s.isClosed() {
+			s.mu.Unlock()
+			return 0
+		}
+		next := s.pending[0]
+		if next.due.After(now) {
+			s.mu.Unlock()
+			return next.due.Sub(now)
+		}
+		heap.Pop(&s.pending)
+		s.mu.Unlock()
+
+		if err := s.release(next.msg); err != nil {
+			s.logger.Warn("failed to release scheduled message, retrying", "topic", s.topic, "error", err)
+			next.due = now.Add(scheduleRetryInterval)
+			s.mu.Lock()
+			heap.Push(&s.pending, next)
+			s.mu.Unlock()
+			continue
+		}
+		s.released(next.offset)
+	}
+}
+
+// released records that the message scheduled at offset was delivered and periodically deletes
+// records that are no longer needed
+func (s *scheduler) released(offset uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rec [9]byte
+	rec[0] = recordReleased
+	binary.BigEndian.PutUint64(rec[1:], offset)
+	if _, err := s.appendLocked(rec[:]); err != nil {
+		s.logger.Error("failed to record release of scheduled message", "topic", s.topic, "error", err)
+		return
+	}
+
+	s.sinceCompact++
+	if s.sinceCompact < scheduleCompactInterval && len(s.pending) > 0 {
+		return
+	}
+	s.sinceCompact = 0
+	keep := s.store.nextOffset()
+	for _, m := range s.pending {
+		keep = min(keep, m.offset)
+	}
+	if err := s.store.truncateBefore(keep); err != nil {
+		s.logger.Warn("failed to delete released scheduled messages", "topic", s.topic, "error", err)
+	}
+}
+
+// close stops releasing messages and closes the store; pending messages stay in a disk store
+func (s *scheduler) close() error {
+	s.mu.Lock()
+	if s.isClosed() {
+		s.mu.Unlock()
+		return nil
+	}
+	close(s.closed)
+	s.mu.Unlock()
+	<-s.stopped
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.store.sync()
+	_ = s.store.close()
+	return err
+}
+
+// isClosed reports whether close has been called
+func (s *scheduler) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,80 @@
+package broker
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDelayedMessagesAreReleasedWhenDue(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Queue, logger)
+	defer b.Close()
+	q := mustTopic(t, b, "jobs").queue
+
+	soon := time.Now().Add(100 * time.Millisecond).UTC().Format(time.RFC3339Nano)
+	past := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano)
+	publish(b, "jobs",
+		fmt.Sprintf(`{"id":"at","deliver_at":%q}`, soon),
+		`{"id":"after","delay_ms":50}`,
+		fmt.Sprintf(`{"id":"past","deliver_at":%q}`, past),
+	)
+	if q.Len() != 1 {
+		t.Fatalf("expected only the message due in the past to be queued, got %d", q.Len())
+	}
+	if s := b.Stats(); s[0].Scheduled != 2 || s[0].Published != 1 {
+		t.Fatalf("expected 2 scheduled and 1 published message, got %+v", s)
+	}
+
+	waitFor(t, func() bool { return q.Len() == 3 })
+	if got := dequeueIDs(t, q, 3); got != "pastafterat" {
+		t.Fatalf("expected messages in due order, got %q", got)
+	}
+	if s := b.Stats(); s[0].Scheduled != 0 || s[0].Published != 3 {
+		t.Fatalf("expected every message released, got %+v", s)
+	}
+}
+
+func TestScheduledMessagesSurviveRestart(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	cfg := Config{DefaultMode: Queue, Storage: StorageConfig{Type: StorageDisk, Dir: t.TempDir()}}
+	b := NewBrokerWithConfig(cfg, logger)
+	publish(b, "jobs", `{"id":"released","delay_ms":1}`, `{"id":"pending","delay_ms":300}`)
+	waitFor(t, func() bool { return mustTopic(t, b, "jobs").queue.Len() == 1 })
+	b.Close()
+
+	// Only the message that was not released yet is released after the restart
+	restarted := NewBrokerWithConfig(cfg, logger)
+	defer restarted.Close()
+	if err := restarted.RecoverTopics(); err != nil {
+		t.Fatalf("RecoverTopics: %v", err)
+	}
+	q := mustTopic(t, restarted, "jobs").queue
+	if got := dequeueIDs(t, q, 1); got != "released" {
+		t.Fatalf("expected the released message to still be queued, got %q", got)
+	}
+	waitFor(t, func() bool { return q.Len() == 1 })
+	if got := dequeueIDs(t, q, 1); got != "pending" {
+		t.Fatalf("expected the pending message after the restart, got %q", got)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if q.Len() != 0 {
+		t.Fatalf("expected no message to be released twice, queue has %d", q.Len())
+	}
+}
+
+func TestInvalidDeliverAtIsRejected(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Queue, logger)
+	defer b.Close()
+	tp := mustTopic(t, b, "jobs")
+	if err := b.publish(tp, []byte(`{"id":"x","deliver_at":"tomorrow"}`)); err == nil {
+		t.Fatal("expected an invalid deliver_at to be rejected")
+	}
+	// The rejected message is not remembered as published
+	if err := b.publish(tp, []byte(`{"id":"x"}`)); err != nil || tp.queue.Len() != 1 {
+		t.Fatalf("expected the corrected message to be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,323 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Segment files are named after the offset of their first record, zero-padded so they sort naturally
+const (
+	segmentLogSuffix   = ".log"
+	segmentIndexSuffix = ".index"
+	segmentNameFormat  = "%020d"
+
+	// recordHeaderSize is the 4-byte payload length plus the 4-byte CRC32 of the payload
+	recordHeaderSize = 8
+	// indexEntrySize is one 8-byte file position per record
+	indexEntrySize = 8
+)
+
+// errOffsetOutOfRange is returned when reading an offset that is not in the log
+var errOffsetOutOfRange = errors.New("offset out of range")
+
+// segment is one append-only log file plus a dense index of record positions
+type segment struct {
+	base  uint64
+	log   *os.File
+	index *os.File
+	size  int64
+	count uint64
+}
+
+// segmentLog is an append-only record log split into segment files in one directory.
+// Every record gets a monotonically increasing offset; old segments can be dropped whole.
+type segmentLog struct {
+	mu           sync.Mutex
+	dir          string
+	segmentBytes int64
+	segments     []*segment
+}
+
+// openSegmentLog opens (or creates) the log in dir, repairing a torn tail left by a crash
+func openSegmentLog(dir string, segmentBytes int64) (*segmentLog, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list log directory: %w", err)
+	}
+
+	var bases []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentLogSuffix) {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, segmentLogSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		bases = append(bases, base)
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+
+	l := &segmentLog{dir: dir, segmentBytes: segmentBytes}
+	for i, base := range bases {
+		// Only the active (last) segment can have been cut short by a crash, so only it is rescanned
+		seg, err := l.openSegment(base, i == len(bases)-1)
+		if err != nil {
+			l.close()
+			return nil, err
+		}
+		l.segments = append(l.segments, seg)
+	}
+	if len(l.segments) == 0 {
+		seg, err := l.openSegment(0, false)
+		if err != nil {
+			return nil, err
+		}
+		l.segments = append(l.segments, seg)
+	}
+	return l, nil
+}
+
+// openSegment opens the files of one segment; recover rebuilds its index from the log contents
+func (l *segmentLog) openSegment(base uint64, recover bool) (*segment, error) {
+	name := filepath.Join(l.dir, fmt.Sprintf(segmentNameFormat, base))
+	logFile, err := os.OpenFile(name+segmentLogSuffix, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open segment: %w", err)
+	}
+	indexFile, err := os.OpenFile(name+segmentIndexSuffix, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		logFile.Close()
+		return nil, fmt.Errorf("failed to open segment index: %w", err)
+	}
+	seg := &segment{base: base, log: logFile, index: indexFile}
+
+	logInfo, err := logFile.Stat()
+	if err != nil {
+		seg.closeFiles()
+		return nil, err
+	}
+	indexInfo, err := indexFile.Stat()
+	if err != nil {
+		seg.closeFiles()
+		return nil, err
+	}
+
+	if recover || indexInfo.Size()%indexEntrySize != 0 {
+		if err := seg.rebuild(); err != nil {
+			seg.closeFiles()
+			return nil, fmt.Errorf("failed to recover segment %d: %w", base, err)
+		}
+		return seg, nil
+	}
+	seg.size = logInfo.Size()
+	seg.count = uint64(indexInfo.Size() / indexEntrySize)
+	return seg, nil
+}
+
+// rebuild scans the segment's log, truncates it after the last intact record and rewrites the index
+func (s *segment) rebuild() error {
+	if _, err := s.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(s.log)
+
+	var positions []byte
+	var pos int64
+	var header [recordHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			break
+		}
+		n := binary.BigEndian.Uint32(header[0:4])
+		if n > maxRecordSize {
+			break
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			break
+		}
+		positions = binary.BigEndian.AppendUint64(positions, uint64(pos))
+		pos += recordHeaderSize + int64(n)
+	}
+
+	if err := s.log.Truncate(pos); err != nil {
+		return err
+	}
+	if err := s.index.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.index.WriteAt(positions, 0); err != nil {
+		return err
+	}
+	s.size = pos
+	s.count = uint64(len(positions) / indexEntrySize)
+	return nil
+}
+
+// closeFiles closes the segment's log and index files
+func (s *segment) closeFiles() {
+	_ = s.log.Close()
+	_ = s.index.Close()
+}
+
+// maxMessageSize matches the protocol's maximum frame size
+const maxMessageSize = 1024 * 1024
+
+// maxRecordSize bounds a single record: one maximum-size message plus room for metadata stored with it
+const maxRecordSize = maxMessageSize + 1024
+
+// append writes a record at the end of the log and returns its offset
+func (l *segmentLog) append(payload []byte) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(payload) > maxRecordSize {
+		return 0, fmt.Errorf("record of %d bytes exceeds maximum size", len(payload))
+	}
+
+	active := l.segments[len(l.segments)-1]
+	if active.size >= l.segmentBytes && active.count > 0 {
+		if err := active.sync(); err != nil {
+			return 0, err
+		}
+		seg, err := l.openSegment(active.base+active.count, false)
+		if err != nil {
+			return 0, err
+		}
+		l.segments = append(l.segments, seg)
+		active = seg
+	}
+
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeaderSize:], payload)
+
+	if _, err := active.log.WriteAt(record, active.size); err != nil {
+		return 0, fmt.Errorf("failed to write record: %w", err)
+	}
+	var entry [indexEntrySize]byte
+	binary.BigEndian.PutUint64(entry[:], uint64(active.size))
+	if _, err := active.index.WriteAt(entry[:], int64(active.count*indexEntrySize)); err != nil {
+		return 0, fmt.Errorf("failed to write index entry: %w", err)
+	}
+
+	offset := active.base + active.count
+	active.size += int64(len(record))
+	active.count++
+	return offset, nil
+}
+
+// read returns the payload of the record at offset
+func (l *segmentLog) read(offset uint64) ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	i := sort.Search(len(l.segments), func(i int) bool { return l.segments[i].base > offset }) - 1
+	if i < 0 {
+		return nil, errOffsetOutOfRange
+	}
+	seg := l.segments[i]
+	if offset >= seg.base+seg.count {
+		return nil, errOffsetOutOfRange
+	}
+
+	var entry [indexEntrySize]byte
+	if _, err := seg.index.ReadAt(entry[:], int64((offset-seg.base)*indexEntrySize)); err != nil {
+		return nil, fmt.Errorf("failed to read index entry: %w", err)
+	}
+	pos := int64(binary.BigEndian.Uint64(entry[:]))
+
+	var header [recordHeaderSize]byte
+	if _, err := seg.log.ReadAt(header[:], pos); err != nil {
+		return nil, fmt.Errorf("failed to read record header: %w", err)
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if _, err := seg.log.ReadAt(payload, pos+recordHeaderSize); err != nil {
+		return nil, fmt.Errorf("failed to read record: %w", err)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, fmt.Errorf("record %d is corrupt", offset)
+	}
+	return payload, nil
+}
+
+// firstOffset returns the offset of the oldest record still in the log
+func (l *segmentLog) firstOffset() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.segments[0].base
+}
+
+// nextOffset returns the offset the next appended record will get
+func (l *segmentLog) nextOffset() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	active := l.segments[len(l.segments)-1]
+	return active.base + active.count
+}
+
+// truncateBefore deletes whole segments whose records all have offsets below offset.
+// The active segment is always kept.
+func (l *segmentLog) truncateBefore(offset uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for len(l.segments) > 1 && l.segments[1].base <= offset {
+		seg := l.segments[0]
+		seg.closeFiles()
+		name := filepath.Join(l.dir, fmt.Sprintf(segmentNameFormat, seg.base))
+		if err := os.Remove(name + segmentLogSuffix); err != nil {
+			return err
+		}
+		if err := os.Remove(name + segmentIndexSuffix); err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
+	}
+	return nil
+}
+
+// sync flushes the active segment to stable storage
+func (l *segmentLog) sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.segments[len(l.segments)-1].sync()
+}
+
+// sync flushes the segment's log and index files
+func (s *segment) sync() error {
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	return s.index.Sync()
+}
+
+// close closes every segment
+func (l *segmentLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, seg := range l.segments {
+		seg.closeFiles()
+	}
+	l.segments = nil
+	return nil
+}
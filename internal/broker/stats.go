@@ -0,0 +1,124 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// TopicStats holds the publish counters of a topic since the broker started
+type TopicStats struct {
+	// Topic is the topic name
+	Topic string `json:"topic"`
+	// Mode is the topic's delivery mode
+	Mode string `json:"mode"`
+	// Published is the number of messages accepted from producers
+	Published uint64 `json:"published"`
+	// Duplicates is the number of messages dropped because their ID was published within the dedup window
+	Duplicates uint64 `json:"duplicates"`
+	// DedupEntries is the number of message IDs currently remembered for deduplication
+	DedupEntries int `json:"dedup_entries"`
+	// Scheduled is the number of messages waiting for their delivery time
+	Scheduled int `json:"scheduled"`
+	// Expired is the number of deliveries discarded, or dead-lettered, because the message had expired
+	Expired uint64 `json:"expired"`
+	// QueueDepth is the number of messages waiting in the topic queue; always 0 in broadcast mode
+	QueueDepth int `json:"queue_depth"`
+	// Consumers is the number of consumers attached to the topic itself, outside of groups
+	Consumers int `json:"consumers"`
+	// Groups holds the queue depth and members of each consumer group, ordered by name
+	Groups []GroupStats `json:"groups"`
+}
+
+// GroupStats holds the queue depth and member count of a consumer group
+type GroupStats struct {
+	// Group is the group name
+	Group string `json:"group"`
+	// QueueDepth is the number of messages waiting in the group's queue
+	QueueDepth int `json:"queue_depth"`
+	// Consumers is the number of connected members
+	Consumers int `json:"consumers"`
+}
+
+// stats returns the topic's counters
+func (t *topic) stats() TopicStats {
+	s := TopicStats{
+		Topic:      t.name,
+		Mode:       t.mode.String(),
+		Published:  t.published.Load(),
+		Duplicates: t.duplicates.Load(),
+		Expired:    t.expired.Load(),
+		QueueDepth: t.queue.Len(),
+		Groups:     []GroupStats{},
+	}
+	if t.dispatcher != nil {
+		s.Consumers = t.dispatcher.consumerCount()
+	} else {
+		s.Consumers = t.registry.GetConsumerCount()
+	}
+	for _, g := range t.consumerGroups() {
+		s.Groups = append(s.Groups, GroupStats{Group: g.name, QueueDepth: g.queue.Len(), Consumers: g.dispatcher.consumerCount()})
+	}
+	sort.Slice(s.Groups, func(i, j int) bool { return s.Groups[i].Group < s.Groups[j].Group })
+	if t.dedup != nil {
+		s.DedupEntries = t.dedup.len()
+	}
+	if t.scheduler != nil {
+		s.Scheduled = t.scheduler.len()
+	}
+	return s
+}
+
+// Stats returns the counters of every topic, ordered by name
+func (b *Broker) Stats() []TopicStats {
+	b.mu.RLock()
+	stats := make([]TopicStats, 0, len(b.topics))
+	for _, t := range b.topics {
+		stats = append(stats, t.stats())
+	}
+	b.mu.RUnlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Topic < stats[j].Topic })
+	return stats
+}
+
+// PurgeQueue discards every message waiting in a topic's queue, or in one of its consumer groups'
+// queues, and returns how many were discarded. Messages already handed to consumers are not
+// affected, and broadcast topics have no queue to purge.
+func (b *Broker) PurgeQueue(topicName, group string) (int, error) {
+	t, err := b.existingTopic(topicName)
+	if err != nil {
+		return 0, err
+	}
+	if t == nil {
+		return 0, fmt.Errorf("topic %q does not exist", topicName)
+	}
+
+	queue, d := t.queue, t.dispatcher
+	if group != "" {
+		t.groupsMu.Lock()
+		g, ok := t.groups[group]
+		t.groupsMu.Unlock()
+		if !ok {
+			return 0, fmt.Errorf("consumer group %q of topic %q does not exist", group, topicName)
+		}
+		queue, d = g.queue, g.dispatcher
+	} else if t.mode != Queue {
+		return 0, fmt.Errorf("topic %q is in %s mode and has no queue", topicName, t.mode)
+	}
+
+	n := 0
+	for {
+		msg, err := queue.Dequeue()
+		if errors.Is(err, ErrQueueEmpty) {
+			break
+		}
+		if err != nil {
+			return n, fmt.Errorf("failed to purge queue: %w", err)
+		}
+		// Purged messages were never delivered, so there is no delivered copy to settle
+		d.attempts.forget(msg)
+		n++
+	}
+	b.logger.Warn("queue purged", "topic", topicName, "group", group, "purged", n)
+	return n, nil
+}
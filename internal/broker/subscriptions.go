@@ -0,0 +1,267 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+const (
+	// singleLevelWildcard matches exactly one level of a hierarchical topic name
+	singleLevelWildcard = "+"
+	// multiLevelWildcard matches any number of trailing levels, including none; it must be the last level
+	multiLevelWildcard = "#"
+)
+
+// isWildcard reports whether a subscription names topics by pattern rather than a single topic
+func isWildcard(name string) bool {
+	return strings.ContainsAny(name, singleLevelWildcard+multiLevelWildcard)
+}
+
+// validateSubscription checks a wildcard subscription: levels separated by "/" that are each a
+// valid topic level, "+", or "#" as the last level
+func validateSubscription(pattern string) error {
+	if len(pattern) > maxTopicNameLength {
+		return fmt.Errorf("subscription exceeds %d characters", maxTopicNameLength)
+	}
+	levels := strings.Split(pattern, topicLevelSeparator)
+	for i, level := range levels {
+		switch {
+		case level == singleLevelWildcard:
+		case level == multiLevelWildcard:
+			if i != len(levels)-1 {
+				return fmt.Errorf("invalid subscription %q: %s must be the last level", pattern, multiLevelWildcard)
+			}
+		default:
+			if err := validateName("topic level", level); err != nil {
+				return fmt.Errorf("invalid subscription %q: %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// subscription is a wildcard pattern with the consumers that subscribed to it. Consumers of one
+// pattern share a registry, as the consumers of a broadcast topic do.
+type subscription struct {
+	pattern  string
+	registry *BroadcastRegistry
+	// nextTag generates delivery tags for consumers that use typed frames
+	nextTag atomic.Uint64
+	// expired counts deliveries discarded because the message expired in a consumer's buffer
+	expired atomic.Uint64
+}
+
+// trieNode is one topic level of the subscription trie
+type trieNode struct {
+	children map[string]*trieNode
+	// sub is the subscription whose pattern ends at this node, if any
+	sub *subscription
+}
+
+// subscriptionTrie indexes wildcard subscriptions level by level, so the subscriptions matching a
+// published topic are found by walking the topic's levels instead of testing every pattern
+type subscriptionTrie struct {
+	mu     sync.RWMutex
+	root   *trieNode
+	size   atomic.Int64
+	logger Logger
+}
+
+// newSubscriptionTrie creates an empty trie
+func newSubscriptionTrie(logger Logger) *subscriptionTrie {
+	return &subscriptionTrie{root: &trieNode{}, logger: logger}
+}
+
+// subscribe registers a consumer channel for a pattern and returns the pattern's subscription
+// and the consumer's ID
+func (s *subscriptionTrie) subscribe(pattern string, ch chan []byte, cfg SlowConsumerConfig) (*subscription, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.root
+	for _, level := range strings.Split(pattern, topicLevelSeparator) {
+		child, ok := n.children[level]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*trieNode)
+			}
+			child = &trieNode{}
+			n.children[level] = child
+		}
+		n = child
+	}
+	if n.sub == nil {
+		n.sub = &subscription{pattern: pattern, registry: NewBroadcastRegistry(s.logger)}
+		s.size.Add(1)
+		s.logger.Info("wildcard subscription created", "subscription", pattern, "total_subscriptions", s.size.Load())
+	}
+	return n.sub, n.sub.registry.RegisterConsumerWithPolicy(ch, cfg)
+}
+
+// unsubscribe removes a consumer, and the subscription with it once it has no consumers left
+func (s *subscriptionTrie) unsubscribe(sub *subscription, consumerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub.registry.UnregisterConsumer(consumerID)
+	if sub.registry.GetConsumerCount() > 0 {
+		return
+	}
+	if s.lookupLocked(sub.pattern) != sub {
+		// Already removed by close
+		return
+	}
+	s.root.remove(sub, strings.Split(sub.pattern, topicLevelSeparator))
+	s.size.Add(-1)
+	s.logger.Info("wildcard subscription removed", "subscription", sub.pattern, "total_subscriptions", s.size.Load())
+}
+
+// remove detaches sub from the node reached by levels and prunes nodes left empty.
+// It reports whether n itself is now empty.
+func (n *trieNode) remove(sub *subscription, levels []string) bool {
+	if len(levels) == 0 {
+		if n.sub == sub {
+			n.sub = nil
+		}
+	} else if child, ok := n.children[levels[0]]; ok && child.remove(sub, levels[1:]) {
+		delete(n.children, levels[0])
+	}
+	return n.sub == nil && len(n.children) == 0
+}
+
+// match returns the subscriptions whose pattern matches a topic name
+func (s *subscriptionTrie) match(topicName string) []*subscription {
+	if s.size.Load() == 0 {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.root.match(strings.Split(topicName, topicLevelSeparator), nil)
+}
+
+// match appends the subscriptions below n that match the remaining levels of a topic name
+func (n *trieNode) match(levels []string, out []*subscription) []*subscription {
+	if child, ok := n.children[multiLevelWildcard]; ok && child.sub != nil {
+		out = append(out, child.sub)
+	}
+	if len(levels) == 0 {
+		if n.sub != nil {
+			out = append(out, n.sub)
+		}
+		return out
+	}
+	if child, ok := n.children[levels[0]]; ok {
+		out = child.match(levels[1:], out)
+	}
+	if child, ok := n.children[singleLevelWildcard]; ok {
+		out = child.match(levels[1:], out)
+	}
+	return out
+}
+
+// publish copies a message published to a topic to the consumers of every matching subscription.
+// Dead-letter topics are never matched, so a "#" subscription does not mix dead letters into the stream.
+func (s *subscriptionTrie) publish(topicName string, msg []byte) {
+	if isDeadLetterTopic(topicName) {
+		return
+	}
+	for _, sub := range s.match(topicName) {
+		// Consumers that missed the message are logged by the registry
+		if err := sub.registry.BroadcastMessage(msg); err != nil && !errors.Is(err, ErrConsumerFull) {
+			s.logger.Warn("failed to deliver message to wildcard subscription", "topic", topicName, "subscription", sub.pattern, "error", err)
+		}
+	}
+}
+
+// lookup returns the subscription of a pattern, or nil if nobody subscribed to it
+func (s *subscriptionTrie) lookup(pattern string) *subscription {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lookupLocked(pattern)
+}
+
+// lookupLocked is lookup for callers that hold mu
+func (s *subscriptionTrie) lookupLocked(pattern string) *subscription {
+	n := s.root
+	for _, level := range strings.Split(pattern, topicLevelSeparator) {
+		if n = n.children[level]; n == nil {
+			return nil
+		}
+	}
+	return n.sub
+}
+
+// close disconnects the consumers of every subscription
+func (s *subscriptionTrie) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.root.closeAll()
+	s.root = &trieNode{}
+	s.size.Store(0)
+}
+
+// closeAll closes the registries of n and of every node below it
+func (n *trieNode) closeAll() {
+	if n.sub != nil {
+		_ = n.sub.registry.Close()
+	}
+	for _, child := range n.children {
+		child.closeAll()
+	}
+}
+
+// handleConsumerWildcard delivers to a consumer a copy of every message published to a topic that
+// matches its wildcard subscription, whatever the topic's delivery mode, as a broadcast consumer
+// of that topic would receive it. Deliveries are live only, so groups and replay are rejected.
+// Messages expire by their own TTL or the broker's default, since topic TTLs differ between the
+// matched topics.
+func (b *Broker) handleConsumerWildcard(pattern string, hs protocol.Handshake, reader FrameReader, writer FrameWriter) {
+	defer b.logger.Info("consumer connection closed", "subscription", pattern)
+
+	opts, err := parseConsumerOptions(hs)
+	if err == nil && (opts.group != "" || opts.from != nil || opts.id != "") {
+		err = errors.New("wildcard subscriptions cannot join a group or replay")
+	}
+	if err != nil {
+		b.logger.Error("invalid consumer options", "subscription", pattern, "error", err)
+		return
+	}
+	if opts.filter != nil {
+		b.logger.Info("consumer filter set", "subscription", pattern, "filter", opts.filter.String())
+	}
+
+	ch := newConsumerChannel()
+	sub, consumerID := b.subscriptions.subscribe(pattern, ch, b.slowConsumerConfig(opts))
+	defer b.subscriptions.unsubscribe(sub, consumerID)
+
+	policy := b.expiryPolicy(TopicConfig{})
+	expired := func(msg []byte) bool {
+		expiresAt, ok := policy.expiresAt(msg)
+		if !ok || time.Now().Before(expiresAt) {
+			return false
+		}
+		if n := sub.expired.Add(1); n == 1 || n%dropLogInterval == 0 {
+			b.logger.Warn("discarding expired messages", "subscription", pattern, "expired", n)
+		}
+		return true
+	}
+	b.writeBroadcast(pattern, consumerID, ch, &sub.nextTag, expired, opts, reader, writer)
+}
+
+// wildcardConsumerStats returns the buffer usage and drop counter of each consumer of a wildcard
+// subscription; it returns nil if nobody is subscribed to the pattern
+func (b *Broker) wildcardConsumerStats(pattern string) ([]ConsumerStats, error) {
+	if err := validateSubscription(pattern); err != nil {
+		return nil, err
+	}
+	sub := b.subscriptions.lookup(pattern)
+	if sub == nil {
+		return nil, nil
+	}
+	return sub.registry.ConsumerStats(), nil
+}
@@ -0,0 +1,147 @@
+package broker
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+// matchedPatterns returns the sorted patterns of the subscriptions matching a topic
+func matchedPatterns(s *subscriptionTrie, topicName string) string {
+	var patterns []string
+	for _, sub := range s.match(topicName) {
+		patterns = append(patterns, sub.pattern)
+	}
+	sort.Strings(patterns)
+	return strings.Join(patterns, " ")
+}
+
+func TestSubscriptionTrieMatch(t *testing.T) {
+	s := newSubscriptionTrie(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	ids := make(map[string]string)
+	subs := make(map[string]*subscription)
+	for _, p := range []string{"telemetry/#", "telemetry/h1/#", "telemetry/+/+/temp", "telemetry/h1/0/temp", "#", "+/h2"} {
+		subs[p], ids[p] = s.subscribe(p, make(chan []byte, 1), SlowConsumerConfig{})
+	}
+
+	cases := map[string]string{
+		"telemetry/h1/0/temp": "# telemetry/# telemetry/+/+/temp telemetry/h1/# telemetry/h1/0/temp",
+		"telemetry/h2/3/temp": "# telemetry/# telemetry/+/+/temp",
+		"telemetry/h1/0/util": "# telemetry/# telemetry/h1/#",
+		"telemetry/h1":        "# telemetry/# telemetry/h1/#",
+		"telemetry":           "# telemetry/#",
+		"alerts/h2":           "# +/h2",
+		"alerts/h2/x":         "#",
+	}
+	for topicName, want := range cases {
+		if got := matchedPatterns(s, topicName); got != want {
+			t.Errorf("match(%q) = %q, want %q", topicName, got, want)
+		}
+	}
+
+	// The last consumer leaving removes the subscription and prunes its branch
+	s.unsubscribe(subs["telemetry/h1/0/temp"], ids["telemetry/h1/0/temp"])
+	s.unsubscribe(subs["telemetry/h1/#"], ids["telemetry/h1/#"])
+	if got := matchedPatterns(s, "telemetry/h1/0/temp"); got != "# telemetry/# telemetry/+/+/temp" {
+		t.Errorf("unexpected matches after unsubscribing: %q", got)
+	}
+	if _, ok := s.root.children["telemetry"].children["h1"]; ok {
+		t.Error("expected the telemetry/h1 branch to be pruned")
+	}
+	if s.size.Load() != 4 {
+		t.Errorf("expected 4 subscriptions, got %d", s.size.Load())
+	}
+}
+
+func TestValidateSubscription(t *testing.T) {
+	for _, p := range []string{"#", "telemetry/+", "telemetry/+/+/temp", "telemetry/h1/#", "+/+"} {
+		if err := validateSubscription(p); err != nil {
+			t.Errorf("validateSubscription(%q) returned error: %v", p, err)
+		}
+	}
+	for _, p := range []string{"telemetry/#/temp", "telemetry/h+", "telemetry//+", "+/", "telemetry/a b/#"} {
+		if err := validateSubscription(p); err == nil {
+			t.Errorf("validateSubscription(%q) expected error", p)
+		}
+	}
+}
+
+func TestWildcardConsumerReceivesMatchingTopics(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBrokerWithConfig(Config{DefaultMode: Broadcast, Topics: map[string]TopicConfig{"telemetry/h1/1/temp": {Mode: ModeOf(Queue)}}}, logger)
+	defer b.Close()
+
+	conn := connectPipe(t, b, "CONSUMER telemetry/h1/+/temp\n")
+	waitFor(t, func() bool { return b.subscriptions.lookup("telemetry/h1/+/temp") != nil })
+	go func() {
+		publish(b, "telemetry/h1/0/util", "util")
+		publish(b, "telemetry/h2/0/temp", "other host")
+		publish(b, "telemetry/h1/0/temp", "gpu0")
+		// Queue topics deliver a copy to wildcard subscribers and still queue the message
+		publish(b, "telemetry/h1/1/temp", "gpu1")
+	}()
+	for _, want := range []string{"gpu0", "gpu1"} {
+		if body, err := protocol.ReadFrame(conn, nil); err != nil || string(body) != want {
+			t.Fatalf("expected %q, got %q (err=%v)", want, body, err)
+		}
+	}
+	if q := mustTopic(t, b, "telemetry/h1/1/temp").queue; q.Len() != 1 {
+		t.Fatalf("expected the queue topic to keep its message, got %d", q.Len())
+	}
+	if stats, err := b.BroadcastConsumerStats("telemetry/h1/+/temp"); err != nil || len(stats) != 1 {
+		t.Fatalf("expected 1 wildcard consumer, got %+v (err=%v)", stats, err)
+	}
+
+	// Like a broadcast consumer, the subscriber is noticed gone at its next delivery
+	conn.Close()
+	publish(b, "telemetry/h1/0/temp", "after close")
+	waitFor(t, func() bool { return b.subscriptions.lookup("telemetry/h1/+/temp") == nil })
+}
+
+func TestWildcardSubscriptionRejections(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	b := NewBroker(Broadcast, logger)
+	defer b.Close()
+
+	// Producers publish to one topic, and wildcard consumers cannot join groups or replay
+	for _, hs := range []string{"PRODUCER telemetry/+\n", "CONSUMER telemetry/# group=writers\n", "CONSUMER telemetry/# from=earliest\n", "CONSUMER telemetry/#/temp\n"} {
+		b.HandleConn(&simpleConn{readBuf: bytes.NewReader([]byte(hs)), writeBuf: &bytes.Buffer{}})
+	}
+	if topics := b.Topics(); len(topics) != 0 {
+		t.Fatalf("expected no topics to be created, got %v", topics)
+	}
+	if b.subscriptions.size.Load() != 0 {
+		t.Fatal("expected no subscription to remain")
+	}
+}
+
+func TestHierarchicalTopicDiskStorage(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	cfg := Config{DefaultMode: Queue, Storage: StorageConfig{Type: StorageDisk, Dir: t.TempDir()}}
+	b := NewBrokerWithConfig(cfg, logger)
+	publish(b, "telemetry/h1", "parent")
+	publish(b, "telemetry/h1/log", "child")
+	b.Close()
+
+	// Each topic gets one escaped directory, so a child level cannot collide with a parent's files
+	if _, err := os.Stat(filepath.Join(cfg.Storage.Dir, "telemetry%2Fh1%2Flog")); err != nil {
+		t.Fatalf("expected an escaped topic directory: %v", err)
+	}
+
+	restarted := NewBrokerWithConfig(cfg, logger)
+	defer restarted.Close()
+	if err := restarted.RecoverTopics(); err != nil {
+		t.Fatalf("RecoverTopics: %v", err)
+	}
+	for name, want := range map[string]string{"telemetry/h1": "parent", "telemetry/h1/log": "child"} {
+		if msg, err := mustTopic(t, restarted, name).queue.Dequeue(); err != nil || string(msg) != want {
+			t.Fatalf("expected %q on %s after restart, got %q (err=%v)", want, name, msg, err)
+		}
+	}
+}
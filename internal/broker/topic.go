@@ -0,0 +1,402 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultTopic is used when a client sends a bare role line without a topic name
+const DefaultTopic = "default"
+
+// maxTopicNameLength bounds topic names accepted in the handshake
+const maxTopicNameLength = 249
+
+// topic holds the consumer registry and message queue backing a single named stream
+type topic struct {
+	name     string
+	mode     DeliveryMode
+	registry ConsumerRegistry
+	queue    MessageQueue
+
+	// log retains recent messages with their offsets for replaying consumers
+	log *topicLog
+	// offsets holds the offsets committed by replaying consumers that send an ID
+	offsets *offsetStore
+
+	// dispatcher hands queued messages to competing consumers; only set for Queue topics
+	dispatcher *dispatcher
+
+	// groups holds the consumer groups that joined the topic, by name
+	groupsMu sync.Mutex
+	groups   map[string]*consumerGroup
+
+	// nextTag generates delivery tags for consumers that use typed frames
+	nextTag atomic.Uint64
+
+	// dedup remembers recently published message IDs; nil when deduplication is disabled
+	dedup *dedupIndex
+	// expiry decides when messages are too old to deliver
+	expiry expiryPolicy
+	// priorityLevels is the number of priority levels of the topic's queues, or 0 for FIFO queues
+	priorityLevels int
+	// partitions is the number of partitions of the topic's queues, or 0 for unpartitioned queues
+	partitions int
+	// scheduler holds messages published for later delivery until they are due
+	scheduler *scheduler
+
+	// published, duplicates and expired count accepted, deduplicated and expired messages for TopicStats
+	published  atomic.Uint64
+	duplicates atomic.Uint64
+	expired    atomic.Uint64
+}
+
+// newTopic creates a topic with its own registry around the given queue, log and offset store
+func newTopic(name string, cfg TopicConfig, queue MessageQueue, log *topicLog, offsets *offsetStore, policy redeliveryPolicy, logger Logger) *topic {
+	t := &topic{
+		name:     name,
+		mode:     *cfg.Mode,
+		registry: NewBroadcastRegistry(logger),
+		queue:    queue,
+		log:      log,
+		offsets:  offsets,
+		groups:   make(map[string]*consumerGroup),
+	}
+	if t.mode == Queue {
+		t.dispatcher = newDispatcher(name, "", t.queue, policy, logger)
+	}
+	return t
+}
+
+// close releases the topic's scheduler, consumer groups, dispatcher, registry, queue, log and offsets
+func (t *topic) close() {
+	// Stop releasing scheduled messages first, so none is released into a closed queue
+	if t.scheduler != nil {
+		_ = t.scheduler.close()
+	}
+
+	t.groupsMu.Lock()
+	for name, g := range t.groups {
+		g.close()
+		delete(t.groups, name)
+	}
+	t.groupsMu.Unlock()
+
+	if t.dispatcher != nil {
+		t.dispatcher.close()
+	}
+	_ = t.queue.Close()
+	_ = t.log.close()
+	_ = t.offsets.close()
+	_ = t.registry.Close()
+}
+
+// topicLevelSeparator splits hierarchical topic names such as "telemetry/<host>/<gpu>/<metric>"
+const topicLevelSeparator = "/"
+
+// validateTopicName checks that a topic name is non-empty, bounded and made of levels separated by
+// "/" that each use only [A-Za-z0-9._-]
+func validateTopicName(name string) error {
+	if len(name) > maxTopicNameLength {
+		return fmt.Errorf("topic name exceeds %d characters", maxTopicNameLength)
+	}
+	if !strings.Contains(name, topicLevelSeparator) {
+		return validateName("topic", name)
+	}
+	for _, level := range strings.Split(name, topicLevelSeparator) {
+		if err := validateName("topic level", level); err != nil {
+			return fmt.Errorf("invalid topic name %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// topicDir returns the disk storage directory of a topic. The "/" of hierarchical names is escaped,
+// so every topic gets one directory directly under the storage directory.
+func (b *Broker) topicDir(name string) string {
+	return filepath.Join(b.cfg.Storage.Dir, url.PathEscape(name))
+}
+
+// validateName applies the topic naming rules to a name of the given kind.
+// Names are also used as directory names by disk storage, which is why "." and ".." are reserved.
+func validateName(kind, name string) error {
+	if name == "" {
+		return fmt.Errorf("%s name is empty", kind)
+	}
+	if len(name) > maxTopicNameLength {
+		return fmt.Errorf("%s name exceeds %d characters", kind, maxTopicNameLength)
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("%s name %q is reserved", kind, name)
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == '-':
+		default:
+			return fmt.Errorf("%s name %q contains invalid character %q", kind, name, c)
+		}
+	}
+	return nil
+}
+
+// getOrCreateTopic returns the named topic, creating it on first use
+func (b *Broker) getOrCreateTopic(name string) (*topic, error) {
+	b.mu.RLock()
+	t, ok := b.topics[name]
+	b.mu.RUnlock()
+	if ok {
+		return t, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if t, ok := b.topics[name]; ok {
+		return t, nil
+	}
+	t, err := b.openTopic(name, b.cfg.topicConfig(name))
+	if err != nil {
+		return nil, err
+	}
+	b.topics[name] = t
+	b.logger.Info("topic created", "topic", name, "delivery_mode", t.mode.String(), "total_topics", len(b.topics))
+	return t, nil
+}
+
+// existingTopic returns the named topic, or nil if it has not been created yet
+func (b *Broker) existingTopic(name string) (*topic, error) {
+	if err := validateTopicName(name); err != nil {
+		return nil, err
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.topics[name], nil
+}
+
+// BroadcastConsumerStats returns the buffer usage and drop counter of each live broadcast consumer
+// of a topic, or of each consumer of a wildcard subscription; it returns nil if the topic has not
+// been created yet or nobody is subscribed to the pattern
+func (b *Broker) BroadcastConsumerStats(name string) ([]ConsumerStats, error) {
+	if isWildcard(name) {
+		return b.wildcardConsumerStats(name)
+	}
+	t, err := b.existingTopic(name)
+	if err != nil || t == nil {
+		return nil, err
+	}
+	return t.registry.ConsumerStats(), nil
+}
+
+// CreateTopic declares a topic with explicit settings before any client uses it.
+// It fails if the name is invalid or the topic already exists.
+func (b *Broker) CreateTopic(name string, cfg TopicConfig) error {
+	if err := validateTopicName(name); err != nil {
+		return err
+	}
+	if err := cfg.validate(); err != nil {
+		return fmt.Errorf("invalid topic config: %w", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.topics[name]; ok {
+		return fmt.Errorf("topic %q already exists", name)
+	}
+	t, err := b.openTopic(name, b.cfg.withDefaultMode(cfg))
+	if err != nil {
+		return err
+	}
+	b.topics[name] = t
+	b.logger.Info("topic created", "topic", name, "delivery_mode", t.mode.String(), "total_topics", len(b.topics))
+	return nil
+}
+
+// openTopic builds a topic, its queue, its log and its offset store. Queue-mode topics use the
+// configured storage; broadcast topics never queue messages, so they always get a memory queue.
+// Consumer groups persisted by disk storage are reopened with the topic.
+func (b *Broker) openTopic(name string, cfg TopicConfig) (*topic, error) {
+	log, err := b.openLog(filepath.Join(b.topicDir(name), logDirName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log for topic %q: %w", name, err)
+	}
+	offsetsDir := ""
+	if b.cfg.Storage.Type == StorageDisk {
+		offsetsDir = filepath.Join(b.topicDir(name), offsetsDirName)
+	}
+	offsets, err := openOffsetStore(offsetsDir, b.cfg.Storage.Fsync)
+	if err != nil {
+		_ = log.close()
+		return nil, fmt.Errorf("failed to open offsets for topic %q: %w", name, err)
+	}
+
+	var queue MessageQueue
+	if *cfg.Mode == Queue {
+		q, err := b.openQueue(b.topicDir(name), cfg.PriorityLevels, cfg.Partitions)
+		if err != nil {
+			_ = log.close()
+			_ = offsets.close()
+			return nil, fmt.Errorf("failed to open queue for topic %q: %w", name, err)
+		}
+		queue = q
+	} else {
+		queue = NewMemoryMessageQueue(b.cfg.Storage.MaxMessages, b.logger)
+	}
+
+	t := newTopic(name, cfg, queue, log, offsets, b.redeliveryPolicy(name, ""), b.logger)
+	t.dedup = newDedupIndex(b.cfg.Dedup)
+	t.expiry = b.expiryPolicy(cfg)
+	t.priorityLevels = cfg.PriorityLevels
+	t.partitions = cfg.Partitions
+	if err := b.recoverGroups(t); err != nil {
+		t.close()
+		return nil, err
+	}
+	if t.scheduler, err = b.openScheduler(t); err != nil {
+		t.close()
+		return nil, fmt.Errorf("failed to open scheduled messages for topic %q: %w", name, err)
+	}
+	return t, nil
+}
+
+// openScheduler opens the store of a topic's scheduled messages in the configured storage and
+// starts releasing them. A released message is published like any other, but is held back while
+// the topic is saturated.
+func (b *Broker) openScheduler(t *topic) (*scheduler, error) {
+	opts := b.cfg.Storage.diskOptions().withDefaults()
+	var store recordLog = &memoryLog{}
+	if b.cfg.Storage.Type == StorageDisk {
+		segments, err := openSegmentLog(filepath.Join(b.topicDir(t.name), scheduledDirName), opts.SegmentBytes)
+		if err != nil {
+			return nil, err
+		}
+		store = segments
+	}
+	release := func(msg []byte) error {
+		if t.saturated() {
+			return errors.New("topic is saturated")
+		}
+		if err := b.store(t, msg); err != nil {
+			return err
+		}
+		t.published.Add(1)
+		return nil
+	}
+	s, err := newScheduler(t.name, store, opts.Fsync, opts.MaxMessages, release, b.logger)
+	if err != nil {
+		_ = store.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// openQueue opens a queue in the configured storage, split into partitions if there are more than
+// one, and with priorityLevels levels in each partition if there are more than one; dir is only
+// used by disk storage, which keeps each partition and level in its own subdirectory
+func (b *Broker) openQueue(dir string, priorityLevels, partitions int) (MessageQueue, error) {
+	if partitions > 1 {
+		queues := make([]MessageQueue, 0, partitions)
+		for p := range partitions {
+			q, err := b.openQueue(filepath.Join(dir, partitionsDirName, strconv.Itoa(p)), priorityLevels, 0)
+			if err != nil {
+				for _, opened := range queues {
+					_ = opened.Close()
+				}
+				return nil, err
+			}
+			queues = append(queues, q)
+		}
+		return NewPartitionedMessageQueue(queues, b.cfg.Storage.MaxMessages, b.logger)
+	}
+	if priorityLevels <= 1 {
+		return b.openFIFOQueue(dir)
+	}
+
+	levels := make([]MessageQueue, 0, priorityLevels)
+	for l := range priorityLevels {
+		q, err := b.openFIFOQueue(filepath.Join(dir, priorityDirName, strconv.Itoa(l)))
+		if err != nil {
+			for _, opened := range levels {
+				_ = opened.Close()
+			}
+			return nil, err
+		}
+		levels = append(levels, q)
+	}
+	opts := PriorityQueueOptions{MaxMessages: b.cfg.Storage.MaxMessages}
+	return NewPriorityMessageQueue(levels, opts, b.logger)
+}
+
+// openFIFOQueue opens a single-level queue in the configured storage
+func (b *Broker) openFIFOQueue(dir string) (MessageQueue, error) {
+	if b.cfg.Storage.Type != StorageDisk {
+		return NewMemoryMessageQueue(b.cfg.Storage.MaxMessages, b.logger), nil
+	}
+	return NewDiskMessageQueue(dir, b.cfg.Storage.diskOptions(), b.logger)
+}
+
+// openLog opens a topic log in the configured storage; dir is only used by disk storage
+func (b *Broker) openLog(dir string) (*topicLog, error) {
+	s := b.cfg.Storage
+	if s.Type != StorageDisk {
+		return newTopicLog(&memoryLog{}, s.RetentionMessages, FsyncNever, 0, b.logger), nil
+	}
+	opts := s.diskOptions().withDefaults()
+	records, err := openSegmentLog(dir, opts.SegmentBytes)
+	if err != nil {
+		return nil, err
+	}
+	return newTopicLog(records, s.RetentionMessages, opts.Fsync, opts.FsyncInterval, b.logger), nil
+}
+
+// RecoverTopics opens every topic found in the disk storage directory, so messages persisted
+// before a restart are delivered and replayable without waiting for a client to name the topic.
+// It does nothing for memory storage.
+func (b *Broker) RecoverTopics() error {
+	if err := b.recoverTopics(); err != nil {
+		return err
+	}
+	b.recovered.Store(true)
+	return nil
+}
+
+// recoverTopics reopens the topics found in the storage directory
+func (b *Broker) recoverTopics() error {
+	if b.cfg.Storage.Type != StorageDisk {
+		return nil
+	}
+	entries, err := os.ReadDir(b.cfg.Storage.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to list storage directory: %w", err)
+	}
+
+	for _, e := range entries {
+		name, err := url.PathUnescape(e.Name())
+		if err != nil || !e.IsDir() || validateTopicName(name) != nil {
+			continue
+		}
+		if _, err := b.getOrCreateTopic(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Topics returns the names of all topics created so far
+func (b *Broker) Topics() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	names := make([]string, 0, len(b.topics))
+	for name := range b.topics {
+		names = append(names, name)
+	}
+	return names
+}
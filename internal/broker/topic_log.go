@@ -0,0 +1,274 @@
+package broker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// logDirName is the subdirectory of a topic's storage directory that holds its retention log
+const logDirName = "log"
+
+// defaultRetentionMessages is used when StorageConfig.RetentionMessages is not set
+const defaultRetentionMessages = 10000
+
+// logTimestampSize is the 8-byte publish time stored in front of each retained message
+const logTimestampSize = 8
+
+// recordLog is an append-only store of records addressed by offset.
+// segmentLog is the disk implementation and memoryLog the in-memory one.
+type recordLog interface {
+	append(payload []byte) (uint64, error)
+	read(offset uint64) ([]byte, error)
+	firstOffset() uint64
+	nextOffset() uint64
+	truncateBefore(offset uint64) error
+	sync() error
+	close() error
+}
+
+// logRecord is one retained message with the offset and time it was published at
+type logRecord struct {
+	offset    uint64
+	timestamp time.Time
+	msg       []byte
+}
+
+// topicLog retains the most recent messages published to a topic so consumers can replay them.
+// Every published message gets the next offset; offsets never repeat, even across restarts with
+// disk storage. Old messages are dropped once more than retention are held.
+type topicLog struct {
+	mu        sync.Mutex
+	records   recordLog
+	retention uint64
+	fsync     FsyncPolicy
+	lastTime  int64
+
+	// notify is closed and replaced whenever a message is appended
+	notify chan struct{}
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// newTopicLog wraps a record store with timestamps, retention and append notifications
+func newTopicLog(records recordLog, retention int, fsync FsyncPolicy, fsyncInterval time.Duration, logger Logger) *topicLog {
+	if retention <= 0 {
+		retention = defaultRetentionMessages
+	}
+	l := &topicLog{
+		records:   records,
+		retention: uint64(retention),
+		fsync:     fsync,
+		notify:    make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+	if next := records.nextOffset(); next > records.firstOffset() {
+		if last, err := l.readLocked(next - 1); err == nil {
+			l.lastTime = last.timestamp.UnixNano()
+		}
+	}
+	if fsync == FsyncInterval {
+		if fsyncInterval <= 0 {
+			fsyncInterval = time.Second
+		}
+		l.wg.Add(1)
+		go l.syncLoop(fsyncInterval, logger)
+	}
+	return l
+}
+
+// append stores a message and returns the offset assigned to it
+func (l *topicLog) append(msg []byte) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.isClosed() {
+		return 0, ErrQueueClosed
+	}
+
+	// Timestamps never go backwards so that seeking by time can binary search
+	now := time.Now().UnixNano()
+	if now < l.lastTime {
+		now = l.lastTime
+	}
+	payload := make([]byte, logTimestampSize+len(msg))
+	binary.BigEndian.PutUint64(payload, uint64(now))
+	copy(payload[logTimestampSize:], msg)
+
+	offset, err := l.records.append(payload)
+	if err != nil {
+		return 0, err
+	}
+	l.lastTime = now
+	if l.fsync == FsyncAlways {
+		if err := l.records.sync(); err != nil {
+			return 0, err
+		}
+	}
+	if next := offset + 1; next > l.retention {
+		if err := l.records.truncateBefore(next - l.retention); err != nil {
+			return 0, fmt.Errorf("failed to apply retention: %w", err)
+		}
+	}
+
+	close(l.notify)
+	l.notify = make(chan struct{})
+	return offset, nil
+}
+
+// read returns the record at offset, or errOffsetOutOfRange if it is not retained
+func (l *topicLog) read(offset uint64) (logRecord, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.isClosed() {
+		return logRecord{}, ErrQueueClosed
+	}
+	return l.readLocked(offset)
+}
+
+func (l *topicLog) readLocked(offset uint64) (logRecord, error) {
+	payload, err := l.records.read(offset)
+	if err != nil {
+		return logRecord{}, err
+	}
+	if len(payload) < logTimestampSize {
+		return logRecord{}, fmt.Errorf("record %d is too short", offset)
+	}
+	return logRecord{
+		offset:    offset,
+		timestamp: time.Unix(0, int64(binary.BigEndian.Uint64(payload))),
+		msg:       payload[logTimestampSize:],
+	}, nil
+}
+
+// bounds returns the oldest retained offset and the offset the next message will get.
+// A closed log is empty.
+func (l *topicLog) bounds() (first, next uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.isClosed() {
+		return 0, 0
+	}
+	return l.records.firstOffset(), l.records.nextOffset()
+}
+
+// offsetForTime returns the offset of the first retained message published at or after ts
+func (l *topicLog) offsetForTime(ts time.Time) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.isClosed() {
+		return 0
+	}
+	first, next := l.records.firstOffset(), l.records.nextOffset()
+	i := sort.Search(int(next-first), func(i int) bool {
+		rec, err := l.readLocked(first + uint64(i))
+		return err != nil || !rec.timestamp.Before(ts)
+	})
+	return first + uint64(i)
+}
+
+// changed returns a channel that is closed by the next append
+func (l *topicLog) changed() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.notify
+}
+
+// done returns a channel that is closed when the log is closed
+func (l *topicLog) done() <-chan struct{} {
+	return l.closed
+}
+
+// close flushes and closes the log
+func (l *topicLog) close() error {
+	l.mu.Lock()
+	if l.isClosed() {
+		l.mu.Unlock()
+		return nil
+	}
+	close(l.closed)
+	l.mu.Unlock()
+	l.wg.Wait()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.records.sync()
+	_ = l.records.close()
+	return err
+}
+
+// syncLoop periodically flushes the log for FsyncInterval
+func (l *topicLog) syncLoop(interval time.Duration, logger Logger) {
+	defer l.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.closed:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			if err := l.records.sync(); err != nil {
+				logger.Error("topic log fsync failed", "error", err)
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// isClosed reports whether close has been called
+func (l *topicLog) isClosed() bool {
+	select {
+	case <-l.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// memoryLog is a recordLog held in memory; its offsets restart from zero with the process
+type memoryLog struct {
+	base    uint64
+	records [][]byte
+}
+
+func (m *memoryLog) append(payload []byte) (uint64, error) {
+	m.records = append(m.records, payload)
+	return m.base + uint64(len(m.records)) - 1, nil
+}
+
+func (m *memoryLog) read(offset uint64) ([]byte, error) {
+	if offset < m.base || offset >= m.nextOffset() {
+		return nil, errOffsetOutOfRange
+	}
+	return m.records[offset-m.base], nil
+}
+
+func (m *memoryLog) firstOffset() uint64 { return m.base }
+
+func (m *memoryLog) nextOffset() uint64 { return m.base + uint64(len(m.records)) }
+
+func (m *memoryLog) truncateBefore(offset uint64) error {
+	if offset <= m.base {
+		return nil
+	}
+	if offset > m.nextOffset() {
+		offset = m.nextOffset()
+	}
+	n := offset - m.base
+	// Drop references to the removed records so their memory can be reclaimed
+	for i := uint64(0); i < n; i++ {
+		m.records[i] = nil
+	}
+	m.records = m.records[n:]
+	m.base = offset
+	return nil
+}
+
+func (m *memoryLog) sync() error { return nil }
+
+func (m *memoryLog) close() error {
+	m.records = nil
+	return nil
+}
@@ -0,0 +1,339 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MaxExpressionLength bounds the size of a filter expression
+const MaxExpressionLength = 4096
+
+// Filter is a compiled filter expression that decides whether a message is delivered.
+//
+// An expression compares fields with literals and combines comparisons with &&, || and !, e.g.
+//
+//	metric_name == "DCGM_FI_DEV_GPU_TEMP" && Hostname =~ "mtv5-.*"
+//
+// A field is looked up in the message first (id, type, source, timestamp, ...) and then in its
+// payload; "payload." selects a payload field explicitly and dots walk into nested objects, e.g.
+// labels_raw.gpu. Literals are double-quoted strings, numbers, true and false.
+// The operators are == != < <= > >= and the unanchored regular expression matches =~ and !~.
+// Ordering compares numerically when both sides are numbers, including numeric strings such as
+// CSV values, and lexically otherwise. A comparison on a field the message does not have is false.
+type Filter struct {
+	expr string
+	root node
+}
+
+// Parse compiles a filter expression
+func Parse(expr string) (*Filter, error) {
+	if len(expr) > MaxExpressionLength {
+		return nil, fmt.Errorf("filter expression longer than %d bytes", MaxExpressionLength)
+	}
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter expression: %w", err)
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err == nil && p.peek().kind != tokEOF {
+		err = fmt.Errorf("unexpected token at %d", p.peek().pos)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter expression: %w", err)
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// String returns the expression the filter was parsed from
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// Match reports whether a message matches the filter. Messages that are not JSON objects never match.
+func (f *Filter) Match(msg []byte) bool {
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil {
+		return false
+	}
+	return f.root.eval(doc)
+}
+
+// node is a node of a parsed expression
+type node interface {
+	eval(doc map[string]any) bool
+}
+
+// andNode matches when both sides match
+type andNode struct{ left, right node }
+
+func (n andNode) eval(doc map[string]any) bool { return n.left.eval(doc) && n.right.eval(doc) }
+
+// orNode matches when either side matches
+type orNode struct{ left, right node }
+
+func (n orNode) eval(doc map[string]any) bool { return n.left.eval(doc) || n.right.eval(doc) }
+
+// notNode matches when its operand does not
+type notNode struct{ operand node }
+
+func (n notNode) eval(doc map[string]any) bool { return !n.operand.eval(doc) }
+
+// compareNode compares a field with a literal
+type compareNode struct {
+	path []string
+	op   string
+	lit  token
+	re   *regexp.Regexp
+}
+
+func (n compareNode) eval(doc map[string]any) bool {
+	v, ok := lookup(doc, n.path)
+	if !ok && n.path[0] != "payload" {
+		if payload, isObject := doc["payload"].(map[string]any); isObject {
+			v, ok = lookup(payload, n.path)
+		}
+	}
+	if !ok || v == nil {
+		return false
+	}
+
+	switch n.op {
+	case "=~":
+		s, ok := scalarString(v)
+		return ok && n.re.MatchString(s)
+	case "!~":
+		s, ok := scalarString(v)
+		return ok && !n.re.MatchString(s)
+	}
+
+	var cmp int
+	switch n.lit.kind {
+	case tokBool:
+		b, ok := v.(bool)
+		if !ok || (n.op != "==" && n.op != "!=") {
+			return false
+		}
+		if b == (n.lit.text == "true") {
+			cmp = 0
+		} else {
+			cmp = 1
+		}
+	case tokNumber:
+		f, ok := number(v)
+		if !ok {
+			return false
+		}
+		cmp = compareFloats(f, n.lit.num)
+	default:
+		s, ok := scalarString(v)
+		if !ok {
+			return false
+		}
+		if f, isNum := number(v); isNum {
+			if lit, err := strconv.ParseFloat(n.lit.text, 64); err == nil && n.op != "==" && n.op != "!=" {
+				cmp = compareFloats(f, lit)
+				break
+			}
+		}
+		cmp = strings.Compare(s, n.lit.text)
+	}
+
+	switch n.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+// lookup walks a dotted path through nested objects
+func lookup(doc map[string]any, path []string) (any, bool) {
+	var v any = doc
+	for _, key := range path {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// scalarString returns a string, number or bool value as a string
+func scalarString(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
+
+// number returns a number or numeric string value as a float
+func number(v any) (float64, bool) {
+	var s string
+	switch v := v.(type) {
+	case json.Number:
+		s = v.String()
+	case string:
+		s = strings.TrimSpace(v)
+	default:
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
+
+// compareFloats returns -1, 0 or 1 like strings.Compare
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// parser is a recursive descent parser over the tokens of an expression:
+//
+//	or      = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | "(" or ")" | field op literal
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// peek returns the current token
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+// next returns the current token and advances past it
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// parseOr parses a disjunction
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+// parseAnd parses a conjunction
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokAnd {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+// parseUnary parses a negation, a parenthesized expression or a comparison
+func (p *parser) parseUnary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNot:
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand}, nil
+	case tokLParen:
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokRParen {
+			return nil, fmt.Errorf("expected ) at %d", closing.pos)
+		}
+		return inner, nil
+	case tokIdent:
+		return p.parseComparison(t)
+	default:
+		return nil, fmt.Errorf("expected a field, ! or ( at %d", t.pos)
+	}
+}
+
+// parseComparison parses the operator and literal that follow a field
+func (p *parser) parseComparison(field token) (node, error) {
+	op := p.next()
+	if op.kind != tokOp {
+		return nil, fmt.Errorf("expected a comparison operator after %q at %d", field.text, op.pos)
+	}
+	lit := p.next()
+	if lit.kind != tokString && lit.kind != tokNumber && lit.kind != tokBool {
+		return nil, fmt.Errorf("expected a literal after %s at %d", op.text, lit.pos)
+	}
+
+	path := strings.Split(field.text, ".")
+	for _, seg := range path {
+		if seg == "" {
+			return nil, fmt.Errorf("invalid field %q at %d", field.text, field.pos)
+		}
+	}
+	n := compareNode{path: path, op: op.text, lit: lit}
+	switch op.text {
+	case "=~", "!~":
+		if lit.kind != tokString {
+			return nil, fmt.Errorf("%s needs a string pattern at %d", op.text, lit.pos)
+		}
+		re, err := regexp.Compile(lit.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern at %d: %w", lit.pos, err)
+		}
+		n.re = re
+	case "==", "!=":
+	default:
+		if lit.kind == tokBool {
+			return nil, fmt.Errorf("%s cannot compare booleans at %d", op.text, op.pos)
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,80 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+)
+
+// metric is a message as the producer publishes it from the DCGM metrics CSV
+const metric = `{"id":"m1","type":"gpu_metric","source":"producer-1","timestamp":"2025-07-18T20:42:34Z",
+	"payload":{"metric_name":"DCGM_FI_DEV_GPU_TEMP","gpu_id":"3","Hostname":"mtv5-dgx1-hgpu-031","value":"71",
+	"labels_raw":{"gpu":"3","job":"dgx_dcgm_exporter"},"type":"inner","throttled":false}}`
+
+func TestFilterMatch(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`metric_name == "DCGM_FI_DEV_GPU_TEMP" && Hostname =~ "mtv5-.*"`, true},
+		{`metric_name == "DCGM_FI_DEV_GPU_UTIL" && Hostname =~ "mtv5-.*"`, false},
+		{`type == "gpu_metric" && source != "producer-2"`, true},
+		{`payload.type == "inner"`, true},
+		{`Hostname =~ "hgpu"`, true},
+		{`Hostname !~ "^lab-"`, true},
+		{`value > 70 && value <= 71`, true},
+		{`value > 100`, false},
+		{`value > "9"`, true},
+		{`gpu_id == 3`, true},
+		{`labels_raw.gpu == "3" && labels_raw.job =~ "dcgm"`, true},
+		{`throttled == false`, true},
+		{`throttled != true`, true},
+		{`timestamp >= "2025-07-18T00:00:00Z"`, true},
+		{`missing == "x"`, false},
+		{`missing != "x"`, false},
+		{`!(missing == "x")`, true},
+		{`type == "other" || (value >= 71 && !(gpu_id == "0"))`, true},
+		{`labels_raw == "x"`, false},
+	}
+	for _, tt := range tests {
+		f, err := Parse(tt.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.expr, err)
+		}
+		if got := f.Match([]byte(metric)); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestFilterNonJSONNeverMatches(t *testing.T) {
+	f, err := Parse(`type != "x"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Match([]byte("plain text")) || f.Match([]byte(`["array"]`)) {
+		t.Error("expected messages that are not JSON objects not to match")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`type`,
+		`type ==`,
+		`type == "a" &&`,
+		`(type == "a"`,
+		`type == "a")`,
+		`type == other`,
+		`type =~ 5`,
+		`type =~ "("`,
+		`flag > true`,
+		`type == "unterminated`,
+		`a..b == "x"`,
+		`type = "a"`,
+		strings.Repeat("a", MaxExpressionLength+1),
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("expected %q to be rejected", expr)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// tokenKind identifies the kind of a lexical token
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokBool
+	tokOp
+	tokAnd
+	tokOr
+	tokNot
+	tokLParen
+	tokRParen
+)
+
+// token is one lexical token of an expression
+type token struct {
+	kind tokenKind
+	// text is the identifier, operator or unquoted string
+	text string
+	// num is the value of a number token
+	num float64
+	// pos is the byte offset of the token in the expression, for error messages
+	pos int
+}
+
+// comparisonOps are the comparison operators, two-character ones first so they win over their prefixes
+var comparisonOps = []string{"==", "!=", "=~", "!~", "<=", ">=", "<", ">"}
+
+// tokenize splits an expression into tokens, ending with a tokEOF token
+func tokenize(expr string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(expr) {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokLParen, pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokRParen, pos: i})
+			i++
+		case strings.HasPrefix(expr[i:], "&&"):
+			tokens = append(tokens, token{kind: tokAnd, pos: i})
+			i += 2
+		case strings.HasPrefix(expr[i:], "||"):
+			tokens = append(tokens, token{kind: tokOr, pos: i})
+			i += 2
+		case c == '"':
+			end := i + 1
+			for end < len(expr) && expr[end] != '"' {
+				if expr[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expr) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			s, err := strconv.Unquote(expr[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at %d: %w", i, err)
+			}
+			tokens = append(tokens, token{kind: tokString, text: s, pos: i})
+			i = end + 1
+		case isDigit(c) || (c == '-' && i+1 < len(expr) && isDigit(expr[i+1])):
+			end := i + 1
+			for end < len(expr) && (isDigit(expr[end]) || strings.IndexByte(".eE+-", expr[end]) >= 0) {
+				end++
+			}
+			n, err := strconv.ParseFloat(expr[i:end], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at %d", expr[i:end], i)
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: expr[i:end], num: n, pos: i})
+			i = end
+		case isIdentStart(c):
+			end := i + 1
+			for end < len(expr) && (isIdentStart(expr[end]) || isDigit(expr[end]) || expr[end] == '.') {
+				end++
+			}
+			word := expr[i:end]
+			if word == "true" || word == "false" {
+				tokens = append(tokens, token{kind: tokBool, text: word, pos: i})
+			} else {
+				tokens = append(tokens, token{kind: tokIdent, text: word, pos: i})
+			}
+			i = end
+		default:
+			op := ""
+			for _, candidate := range comparisonOps {
+				if strings.HasPrefix(expr[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op != "" {
+				tokens = append(tokens, token{kind: tokOp, text: op, pos: i})
+				i += len(op)
+				continue
+			}
+			if c == '!' {
+				tokens = append(tokens, token{kind: tokNot, pos: i})
+				i++
+				continue
+			}
+			return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(expr)}), nil
+}
+
+// isDigit reports whether c is an ASCII digit
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isIdentStart reports whether c can start a field name
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -14,6 +14,16 @@ type Message struct {
 	Payload   json.RawMessage `json:"payload"`
 	Timestamp time.Time       `json:"timestamp"`
 	Source    string          `json:"source,omitempty"`
+	// TTLMs is how long after Timestamp the message expires; 0 leaves it to the broker's topic settings
+	TTLMs int64 `json:"ttl_ms,omitempty"`
+	// Priority is the message's level on topics with priority levels; higher is delivered first
+	Priority int `json:"priority,omitempty"`
+	// DeliverAt, if set, holds the message in the broker until that time
+	DeliverAt *time.Time `json:"deliver_at,omitempty"`
+	// DelayMs holds the message in the broker for that long after it is received, unless DeliverAt is set
+	DelayMs int64 `json:"delay_ms,omitempty"`
+	// Key picks the partition on partitioned topics, so messages with the same key are consumed in order
+	Key string `json:"key,omitempty"`
 }
 
 func newID() string {
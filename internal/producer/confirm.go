@@ -0,0 +1,101 @@
+package producer
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/message-streaming-app/internal/message"
+	"github.com/message-streaming-app/internal/protocol"
+)
+
+// ErrConfirmsDisabled is returned by StreamAsync and StreamConfirmed on a producer created without WithConfirms
+var ErrConfirmsDisabled = errors.New("publisher confirms are not enabled")
+
+// ErrGoingAway is returned for messages sent after the broker started shutting down; they were not
+// stored and should be resent to another broker
+var ErrGoingAway = errors.New("broker is going away")
+
+// Confirmation is the broker's verdict on one message sent in confirm mode
+type Confirmation struct {
+	// MessageID is the ID of the confirmed message
+	MessageID string
+	// Err is nil if the broker accepted the message, a *RejectedError if it rejected it, or the
+	// connection error if the verdict never arrived
+	Err error
+}
+
+// RejectedError is a message the broker nacked
+type RejectedError struct {
+	MessageID string
+	Reason    string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("broker rejected message %s: %s", e.MessageID, e.Reason)
+}
+
+// pendingConfirm is a sent message waiting for its confirmation
+type pendingConfirm struct {
+	messageID string
+	ch        chan Confirmation
+}
+
+// StreamAsync sends a message and returns without waiting for the broker. The returned channel
+// receives the message's confirmation, so many messages can be in flight at once.
+func (p *Producer) StreamAsync(msg *message.Message) (<-chan Confirmation, error) {
+	if !p.confirms {
+		return nil, ErrConfirmsDisabled
+	}
+	return p.send(msg)
+}
+
+// StreamConfirmed sends a message and waits until the broker has accepted it. It returns a
+// *RejectedError if the broker rejected the message.
+func (p *Producer) StreamConfirmed(msg *message.Message) error {
+	ch, err := p.StreamAsync(msg)
+	if err != nil {
+		return err
+	}
+	return (<-ch).Err
+}
+
+// expectConfirm numbers the next message and registers the channel for its confirmation.
+// The caller holds writeMu so numbers follow the order messages are written in.
+func (p *Producer) expectConfirm(messageID string) (chan Confirmation, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.readErr != nil {
+		return nil, p.readErr
+	}
+	p.seq++
+	ch := make(chan Confirmation, 1)
+	p.pending[p.seq] = pendingConfirm{messageID: messageID, ch: ch}
+	return ch, nil
+}
+
+// cancelConfirm undoes expectConfirm for a message that could not be written, so the next
+// message reuses its number. The caller holds writeMu.
+func (p *Producer) cancelConfirm() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pending, p.seq)
+	p.seq--
+}
+
+// settle hands a confirm from the broker to the message waiting for it
+func (p *Producer) settle(c protocol.Confirm) {
+	p.mu.Lock()
+	pc, ok := p.pending[c.Seq]
+	delete(p.pending, c.Seq)
+	p.mu.Unlock()
+	if !ok {
+		p.logger.Warn("confirm for unknown message", "seq", c.Seq, "message_id", c.MessageID)
+		return
+	}
+
+	conf := Confirmation{MessageID: pc.messageID}
+	if !c.Acked {
+		conf.Err = &RejectedError{MessageID: pc.messageID, Reason: c.Reason}
+	}
+	pc.ch <- conf
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/message-streaming-app/internal/message"
@@ -16,27 +17,201 @@ import (
 type Producer struct {
 	conn   net.Conn
 	logger *slog.Logger
+	topic  string
+
+	// flowControl makes Stream wait for credits granted by the broker before sending
+	flowControl bool
+	// confirms makes the broker ack or nack every message
+	confirms bool
+	// ttl is set on messages that do not carry their own TTL
+	ttl time.Duration
+	// keyColumn is the CSV column whose value StreamCSVMetrics sets as the message key
+	keyColumn string
+	// credentials authenticate the producer in its handshake
+	credentials protocol.Credentials
+
+	// writeMu keeps message numbers in the order messages are written
+	writeMu     sync.Mutex
+	mu          sync.Mutex
+	creditsCond *sync.Cond
+	credits     uint64
+	seq         uint64
+	pending     map[uint64]pendingConfirm
+	readErr     error
+}
+
+// Option configures optional Producer behaviour
+type Option func(*Producer)
+
+// WithTopic publishes to the named topic instead of the broker's default topic
+func WithTopic(topic string) Option {
+	return func(p *Producer) {
+		p.topic = topic
+	}
+}
+
+// WithFlowControl makes the producer send only as many messages as the broker has granted credits
+// for, so it slows down instead of overrunning the broker's queues
+func WithFlowControl() Option {
+	return func(p *Producer) {
+		p.flowControl = true
+	}
+}
+
+// WithConfirms asks the broker to confirm every message, which StreamAsync and StreamConfirmed
+// report to the caller
+func WithConfirms() Option {
+	return func(p *Producer) {
+		p.confirms = true
+	}
+}
+
+// WithTTL makes the broker discard messages that are not delivered within ttl of their timestamp,
+// unless a message sets its own TTLMs
+func WithTTL(ttl time.Duration) Option {
+	return func(p *Producer) {
+		p.ttl = ttl
+	}
+}
+
+// WithPartitionKeyColumn makes StreamCSVMetrics key every message by the value of a CSV column,
+// such as the GPU uuid, so a partitioned topic delivers each key's rows in order
+func WithPartitionKeyColumn(column string) Option {
+	return func(p *Producer) {
+		p.keyColumn = column
+	}
+}
+
+// WithCredentials authenticates the producer with a broker that requires credentials, such as
+// protocol.TokenCredentials or protocol.PlainCredentials
+func WithCredentials(creds protocol.Credentials) Option {
+	return func(p *Producer) {
+		p.credentials = creds
+	}
 }
 
 // NewProducer creates a new Producer instance
-func NewProducer(conn net.Conn, logger *slog.Logger) *Producer {
-	return &Producer{
-		conn:   conn,
-		logger: logger,
+func NewProducer(conn net.Conn, logger *slog.Logger, opts ...Option) *Producer {
+	p := &Producer{
+		conn:    conn,
+		logger:  logger,
+		pending: make(map[uint64]pendingConfirm),
 	}
+	p.creditsCond = sync.NewCond(&p.mu)
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
 }
 
-// Start initializes the producer by sending the role identifier to the broker
+// Start initializes the producer by sending the role identifier (and topic, if set) to the broker.
+// With credentials it also waits for the broker to accept them; a refusal is reported as
+// protocol.ErrAuthenticationFailed.
 func (p *Producer) Start() error {
-	if _, err := p.conn.Write([]byte("PRODUCER\n")); err != nil {
+	hs := protocol.Handshake{Role: "PRODUCER", Topic: p.topic, Options: map[string]string{}}
+	if p.flowControl {
+		hs.Options[protocol.OptionFlow] = protocol.FlowCredit
+	}
+	if p.confirms {
+		hs.Options[protocol.OptionConfirm] = "true"
+	}
+	hs.SetCredentials(p.credentials)
+	if _, err := p.conn.Write([]byte(hs.String())); err != nil {
 		p.logger.Error(fmt.Sprintf("failed to identify as producer: %v", err))
 		return fmt.Errorf("failed to identify as producer: %v", err)
 	}
-	p.logger.Info("successfully identified as producer")
+	if p.credentials.Mechanism != "" {
+		identity, err := protocol.ReadAuthResult(p.conn)
+		if err != nil {
+			p.logger.Error("failed to authenticate with the broker", "error", err)
+			return err
+		}
+		p.logger.Info("authenticated with the broker", "identity", identity)
+	}
+	if p.flowControl || p.confirms {
+		go p.readBroker()
+	}
+	p.logger.Info("successfully identified as producer", "topic", p.topic, "flow_control", p.flowControl, "confirms", p.confirms)
+	return nil
+}
+
+// readBroker handles the credit and confirm frames the broker sends until the connection fails
+func (p *Producer) readBroker() {
+	var buf []byte
+	for {
+		body, err := protocol.ReadFrame(p.conn, buf)
+		if err != nil {
+			p.fail(fmt.Errorf("connection to broker lost: %w", err))
+			return
+		}
+		buf = body
+
+		f, err := protocol.DecodeTypedFrame(body)
+		if err != nil {
+			p.logger.Warn("unexpected frame from broker", "error", err)
+			continue
+		}
+		switch f.Type {
+		case protocol.FrameCredit:
+			p.mu.Lock()
+			p.credits += f.Tag
+			p.creditsCond.Broadcast()
+			p.mu.Unlock()
+		case protocol.FrameAck, protocol.FrameNack:
+			c, err := protocol.DecodeConfirm(f)
+			if err != nil {
+				p.logger.Warn("invalid confirm from broker", "error", err)
+				continue
+			}
+			p.settle(c)
+		case protocol.FrameGoAway:
+			// The broker read nothing after the last confirm, so messages still pending were not stored
+			p.logger.Warn("broker is going away", "reason", string(f.Body))
+			p.fail(fmt.Errorf("%w: %s", ErrGoingAway, f.Body))
+			return
+		case protocol.FrameError:
+			// The broker refused the connection, e.g. because it requires credentials
+			p.logger.Error("broker refused the connection", "reason", string(f.Body))
+			p.fail(fmt.Errorf("%w: %s", protocol.ErrAuthenticationFailed, f.Body))
+			return
+		default:
+			p.logger.Warn("unexpected frame from broker", "type", f.Type.String())
+		}
+	}
+}
+
+// fail records that the connection is gone and fails every message still waiting for a confirm
+func (p *Producer) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readErr = err
+	p.creditsCond.Broadcast()
+	for seq, pc := range p.pending {
+		pc.ch <- Confirmation{MessageID: pc.messageID, Err: err}
+		delete(p.pending, seq)
+	}
+}
+
+// acquireCredit blocks until the broker has granted a credit and spends it
+func (p *Producer) acquireCredit() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.credits == 0 && p.readErr == nil {
+		p.logger.Debug("waiting for broker credits", "topic", p.topic)
+	}
+	for p.credits == 0 {
+		if p.readErr != nil {
+			return p.readErr
+		}
+		p.creditsCond.Wait()
+	}
+	p.credits--
 	return nil
 }
 
-// StreamCSVMetrics reads a CSV file and streams metrics to the broker
+// StreamCSVMetrics reads a CSV file and streams metrics to the broker and returns the number of
+// rows sent. With confirms the rows are pipelined, and once all are sent it waits for the broker's
+// verdicts, logs every rejected row and returns the number of rows the broker accepted.
 func (p *Producer) StreamCSVMetrics(csvPath string, tsColumnName, labelsColumnName string) (int, error) {
 	// Open CSV reader
 	csvReader, err := NewMetricsCSVReader(csvPath, *p.logger)
@@ -50,6 +225,7 @@ func (p *Producer) StreamCSVMetrics(csvPath string, tsColumnName, labelsColumnNa
 	transformer := NewRowTransformer(csvReader, tsColumnName, labelsColumnName)
 
 	rowCount := 0
+	var inflight []sentRow
 	for csvReader.HasNextRow() {
 		row, err := csvReader.GetNextRow()
 		if err != nil {
@@ -57,6 +233,9 @@ func (p *Producer) StreamCSVMetrics(csvPath string, tsColumnName, labelsColumnNa
 				break
 			}
 			p.logger.Warn(fmt.Sprintf("skipping row %d due to read error: %v", rowCount+1, err))
+			if p.confirms {
+				rowCount, _ = p.awaitConfirms(inflight)
+			}
 			return rowCount, fmt.Errorf("failed to read row: %v", err)
 		}
 
@@ -72,21 +251,59 @@ func (p *Producer) StreamCSVMetrics(csvPath string, tsColumnName, labelsColumnNa
 
 		// Create message
 		msg := message.New("metric", body, "csv-producer")
+		if p.keyColumn != "" {
+			msg.Key = row[p.keyColumn]
+		}
 
 		// Write message
-		if err := p.Stream(msg); err != nil {
+		ch, err := p.send(msg)
+		if err != nil {
 			p.logger.Warn(fmt.Sprintf("failed to write message at row %d: %v", rowCount+1, err))
+			if p.confirms {
+				rowCount, _ = p.awaitConfirms(inflight)
+			}
 			return rowCount, fmt.Errorf("failed to write message at row %d: %w", rowCount+1, err)
 		}
+		if ch != nil {
+			inflight = append(inflight, sentRow{row: rowCount + 1, confirm: ch})
+		}
 		time.Sleep(100 * time.Microsecond)
 		rowCount++
 	}
 
+	if p.confirms {
+		accepted, rejected := p.awaitConfirms(inflight)
+		if rejected > 0 {
+			return accepted, fmt.Errorf("broker did not accept %d of %d rows", rejected, rowCount)
+		}
+		rowCount = accepted
+	}
 	p.logger.Info(fmt.Sprintf("metrics streamed successfully: %d rows", rowCount))
 	return rowCount, nil
 
 }
 
+// sentRow is a CSV row waiting for the broker's confirm
+type sentRow struct {
+	row     int
+	confirm <-chan Confirmation
+}
+
+// awaitConfirms waits for the confirms of sent rows, logs the ones that were not accepted and
+// returns the number of accepted and rejected rows
+func (p *Producer) awaitConfirms(rows []sentRow) (accepted, rejected int) {
+	for _, r := range rows {
+		c := <-r.confirm
+		if c.Err != nil {
+			p.logger.Warn("row not accepted by broker", "row", r.row, "message_id", c.MessageID, "error", c.Err)
+			rejected++
+			continue
+		}
+		accepted++
+	}
+	return accepted, rejected
+}
+
 // Close gracefully closes the connection to the broker
 func (p *Producer) Close() error {
 	if p.conn != nil {
@@ -99,15 +316,46 @@ func (p *Producer) Close() error {
 	return nil
 }
 
+// Stream sends a message to the broker, first waiting for a credit when flow control is enabled.
+// It returns once the message is written, without waiting for a confirm.
 func (p *Producer) Stream(msg *message.Message) error {
+	_, err := p.send(msg)
+	return err
+}
+
+// send writes a message and, in confirm mode, returns the channel its confirmation arrives on
+func (p *Producer) send(msg *message.Message) (<-chan Confirmation, error) {
+	if p.ttl > 0 && msg.TTLMs == 0 {
+		withTTL := *msg
+		withTTL.TTLMs = p.ttl.Milliseconds()
+		msg = &withTTL
+	}
 	body, err := json.Marshal(msg)
 	if err != nil {
-		return fmt.Errorf("failed to marshal message: %w", err)
+		return nil, fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	if p.flowControl {
+		if err := p.acquireCredit(); err != nil {
+			return nil, fmt.Errorf("failed to get credit from broker: %w", err)
+		}
 	}
 
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	var ch chan Confirmation
+	if p.confirms {
+		var err error
+		if ch, err = p.expectConfirm(msg.ID); err != nil {
+			return nil, err
+		}
+	}
 	if err := protocol.WriteFrame(p.conn, body); err != nil {
-		return fmt.Errorf("failed to write message to broker: %w", err)
+		if p.confirms {
+			p.cancelConfirm()
+		}
+		return nil, fmt.Errorf("failed to write message to broker: %w", err)
 	}
 
-	return nil
+	return ch, nil
 }
@@ -1,7 +1,9 @@
 package producer
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"errors"
 	"io"
 	"log/slog"
@@ -11,6 +13,7 @@ import (
 	"time"
 
 	"github.com/message-streaming-app/internal/message"
+	"github.com/message-streaming-app/internal/protocol"
 )
 
 // mockNetConn is a simple net.Conn mock for tests
@@ -56,6 +59,20 @@ func TestProducerStartSuccessAndFailure(t *testing.T) {
 	}
 }
 
+func TestProducerStartWithTopic(t *testing.T) {
+	buf := &bytes.Buffer{}
+	mc := &mockNetConn{writeBuffer: buf}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	p := NewProducer(mc, logger, WithTopic("telemetry"))
+
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if buf.String() != "PRODUCER telemetry\n" {
+		t.Fatalf("expected PRODUCER telemetry\n, got %q", buf.String())
+	}
+}
+
 func TestProducerStreamAndClose(t *testing.T) {
 	buf := &bytes.Buffer{}
 	mc := &mockNetConn{writeBuffer: buf}
@@ -86,6 +103,232 @@ func TestProducerStreamAndClose(t *testing.T) {
 	}
 }
 
+func TestProducerWithTTL(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	p := NewProducer(&mockNetConn{writeBuffer: buf}, logger, WithTTL(5*time.Second))
+
+	own := message.New("test", []byte(`"own"`), "tester")
+	own.TTLMs = 100
+	for _, msg := range []*message.Message{message.New("test", []byte(`"default"`), "tester"), own} {
+		if err := p.Stream(msg); err != nil {
+			t.Fatalf("Stream failed: %v", err)
+		}
+	}
+	for _, want := range []int64{5000, 100} {
+		body, err := protocol.ReadFrame(buf, nil)
+		if err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		var got message.Message
+		if err := json.Unmarshal(body, &got); err != nil || got.TTLMs != want {
+			t.Fatalf("expected ttl_ms %d, got %s (err=%v)", want, body, err)
+		}
+	}
+}
+
+func TestProducerFlowControlWaitsForCredits(t *testing.T) {
+	client, broker := net.Pipe()
+	defer broker.Close()
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	p := NewProducer(client, logger, WithTopic("telemetry"), WithFlowControl())
+
+	go func() { _ = p.Start() }()
+	line, err := bufio.NewReader(broker).ReadString('\n')
+	if err != nil || line != "PRODUCER telemetry flow=credit\n" {
+		t.Fatalf("unexpected handshake %q (err=%v)", line, err)
+	}
+
+	sent := make(chan error, 1)
+	go func() { sent <- p.Stream(message.New("test", []byte(`"hello"`), "tester")) }()
+	select {
+	case err := <-sent:
+		t.Fatalf("expected Stream to wait for a credit, returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// One credit lets exactly one message through
+	grant := protocol.EncodeTypedFrame(protocol.TypedFrame{Type: protocol.FrameCredit, Tag: 1})
+	if err := protocol.WriteFrame(broker, grant); err != nil {
+		t.Fatalf("grant credit: %v", err)
+	}
+	if _, err := protocol.ReadFrame(broker, nil); err != nil {
+		t.Fatalf("read message: %v", err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("Stream failed: %v", err)
+	}
+
+	// Losing the connection fails a waiting Stream instead of hanging
+	go func() { sent <- p.Stream(message.New("test", []byte(`"again"`), "tester")) }()
+	broker.Close()
+	if err := <-sent; err == nil {
+		t.Fatal("expected Stream to fail once the broker connection is lost")
+	}
+}
+
+// confirmNext reads the next message from a fake broker connection and confirms it
+func confirmNext(t *testing.T, broker net.Conn, c protocol.Confirm) {
+	t.Helper()
+	if _, err := protocol.ReadFrame(broker, nil); err != nil {
+		t.Fatalf("read message: %v", err)
+	}
+	if err := protocol.WriteFrame(broker, protocol.EncodeConfirm(c)); err != nil {
+		t.Fatalf("write confirm: %v", err)
+	}
+}
+
+func TestProducerConfirms(t *testing.T) {
+	client, broker := net.Pipe()
+	defer broker.Close()
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	p := NewProducer(client, logger, WithTopic("telemetry"), WithConfirms())
+
+	go func() { _ = p.Start() }()
+	line, err := bufio.NewReader(broker).ReadString('\n')
+	if err != nil || line != "PRODUCER telemetry confirm=true\n" {
+		t.Fatalf("unexpected handshake %q (err=%v)", line, err)
+	}
+
+	accepted := message.New("test", []byte(`"ok"`), "tester")
+	done := make(chan error, 1)
+	go func() { done <- p.StreamConfirmed(accepted) }()
+	confirmNext(t, broker, protocol.Confirm{Seq: 1, Acked: true, MessageID: accepted.ID})
+	if err := <-done; err != nil {
+		t.Fatalf("expected message to be accepted, got %v", err)
+	}
+
+	// Pipelined messages get their own verdicts
+	go func() {
+		for _, c := range []protocol.Confirm{{Seq: 2, Acked: true}, {Seq: 3, Reason: "queue is closed"}} {
+			_, _ = protocol.ReadFrame(broker, nil)
+			_ = protocol.WriteFrame(broker, protocol.EncodeConfirm(c))
+		}
+	}()
+	first, err := p.StreamAsync(message.New("test", []byte(`"a"`), "tester"))
+	if err != nil {
+		t.Fatalf("StreamAsync failed: %v", err)
+	}
+	second, err := p.StreamAsync(message.New("test", []byte(`"b"`), "tester"))
+	if err != nil {
+		t.Fatalf("StreamAsync failed: %v", err)
+	}
+	if c := <-first; c.Err != nil {
+		t.Fatalf("expected first message to be accepted, got %v", c.Err)
+	}
+	var rejected *RejectedError
+	if c := <-second; !errors.As(c.Err, &rejected) || rejected.Reason != "queue is closed" {
+		t.Fatalf("expected second message to be rejected, got %v", c.Err)
+	}
+
+	// Losing the connection fails messages still waiting for a verdict
+	go func() {
+		_, _ = protocol.ReadFrame(broker, nil)
+		broker.Close()
+	}()
+	pending, err := p.StreamAsync(message.New("test", []byte(`"c"`), "tester"))
+	if err != nil {
+		t.Fatalf("StreamAsync failed: %v", err)
+	}
+	if c := <-pending; c.Err == nil {
+		t.Fatal("expected pending message to fail once the broker connection is lost")
+	}
+}
+
+func TestProducerGoingAway(t *testing.T) {
+	client, broker := net.Pipe()
+	defer broker.Close()
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	p := NewProducer(client, logger, WithConfirms())
+
+	go func() { _ = p.Start() }()
+	if _, err := bufio.NewReader(broker).ReadString('\n'); err != nil {
+		t.Fatalf("read handshake: %v", err)
+	}
+
+	// The broker stops reading: the message in flight is answered by a going-away frame
+	go func() {
+		_, _ = protocol.ReadFrame(broker, nil)
+		goAway := protocol.TypedFrame{Type: protocol.FrameGoAway, Body: []byte("broker shutting down")}
+		_ = protocol.WriteFrame(broker, protocol.EncodeTypedFrame(goAway))
+	}()
+	if err := p.StreamConfirmed(message.New("test", []byte(`"x"`), "tester")); !errors.Is(err, ErrGoingAway) {
+		t.Fatalf("expected ErrGoingAway, got %v", err)
+	}
+	if _, err := p.StreamAsync(message.New("test", []byte(`"y"`), "tester")); !errors.Is(err, ErrGoingAway) {
+		t.Fatalf("expected later messages to fail with ErrGoingAway, got %v", err)
+	}
+}
+
+func TestProducerCredentials(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	for _, reply := range []protocol.TypedFrame{
+		{Type: protocol.FrameAuthenticated, Body: []byte("csv-producer")},
+		{Type: protocol.FrameError, Body: []byte("authentication failed")},
+	} {
+		client, broker := net.Pipe()
+		p := NewProducer(client, logger, WithTopic("telemetry"), WithCredentials(protocol.TokenCredentials("p-token")))
+
+		started := make(chan error, 1)
+		go func() { started <- p.Start() }()
+		line, err := bufio.NewReader(broker).ReadString('\n')
+		if err != nil {
+			t.Fatalf("read handshake: %v", err)
+		}
+		hs, err := protocol.ParseHandshake(line)
+		if err != nil {
+			t.Fatalf("parse handshake: %v", err)
+		}
+		if creds, ok, err := hs.Credentials(); !ok || err != nil || string(creds.Response) != "p-token" {
+			t.Fatalf("expected the token in the handshake, got %+v (err=%v)", creds, err)
+		}
+		if err := protocol.WriteFrame(broker, protocol.EncodeTypedFrame(reply)); err != nil {
+			t.Fatalf("write reply: %v", err)
+		}
+
+		err = <-started
+		if reply.Type == protocol.FrameAuthenticated && err != nil {
+			t.Fatalf("expected Start to succeed, got %v", err)
+		}
+		if reply.Type == protocol.FrameError && !errors.Is(err, protocol.ErrAuthenticationFailed) {
+			t.Fatalf("expected ErrAuthenticationFailed, got %v", err)
+		}
+		client.Close()
+		broker.Close()
+	}
+}
+
+func TestProducerConfirmsWriteError(t *testing.T) {
+	mc := &mockNetConn{writeBuffer: &bytes.Buffer{}, writeErr: errors.New("write fail")}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	p := NewProducer(mc, logger, WithConfirms())
+
+	// A message that was never written must not wait for a confirm or take a sequence number
+	if _, err := p.StreamAsync(message.New("test", []byte(`"lost"`), "tester")); err == nil {
+		t.Fatal("expected StreamAsync to fail on write error")
+	}
+	if len(p.pending) != 0 || p.seq != 0 {
+		t.Fatalf("expected no pending confirm, got %d pending and seq %d", len(p.pending), p.seq)
+	}
+
+	mc.writeErr = nil
+	if _, err := p.StreamAsync(message.New("test", []byte(`"sent"`), "tester")); err != nil {
+		t.Fatalf("StreamAsync failed: %v", err)
+	}
+	if _, ok := p.pending[1]; !ok || p.seq != 1 {
+		t.Fatalf("expected the next message to be number 1, got seq %d", p.seq)
+	}
+}
+
+func TestProducerConfirmsDisabled(t *testing.T) {
+	mc := &mockNetConn{writeBuffer: &bytes.Buffer{}}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	p := NewProducer(mc, logger)
+	if err := p.StreamConfirmed(message.New("test", []byte(`"x"`), "tester")); !errors.Is(err, ErrConfirmsDisabled) {
+		t.Fatalf("expected ErrConfirmsDisabled, got %v", err)
+	}
+}
+
 func TestStreamCSVMetricsSuccessAndCSVNotFound(t *testing.T) {
 	// prepare temp CSV
 	tmpFile, err := os.CreateTemp("", "prod_*.csv")
@@ -116,6 +359,33 @@ func TestStreamCSVMetricsSuccessAndCSVNotFound(t *testing.T) {
 	}
 }
 
+func TestStreamCSVMetricsPartitionKey(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "prod_*.csv")
+	if err != nil {
+		t.Fatalf("temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.WriteString("uuid,value\nGPU-a,1\nGPU-b,2\n")
+	tmpFile.Close()
+
+	buf := &bytes.Buffer{}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	p := NewProducer(&mockNetConn{writeBuffer: buf}, logger, WithPartitionKeyColumn("uuid"))
+	if _, err := p.StreamCSVMetrics(tmpFile.Name(), "", ""); err != nil {
+		t.Fatalf("StreamCSVMetrics failed: %v", err)
+	}
+	for _, want := range []string{"GPU-a", "GPU-b"} {
+		body, err := protocol.ReadFrame(buf, nil)
+		if err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		var got message.Message
+		if err := json.Unmarshal(body, &got); err != nil || got.Key != want {
+			t.Fatalf("expected key %s, got %s (err=%v)", want, body, err)
+		}
+	}
+}
+
 func TestParseLabelsAndTransformRowWithRaw(t *testing.T) {
 	raw := `k1="v1",k2="v,2",k3="v\\"3"`
 	labels := ParseLabels(raw)
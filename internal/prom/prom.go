@@ -0,0 +1,329 @@
+// Package prom keeps counters, gauges and histograms and serves them in the Prometheus text
+// exposition format, so services can be scraped without depending on the Prometheus client library.
+package prom
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentType is the media type of the text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are histogram buckets in seconds suited to latencies from a millisecond to a minute
+var DefBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// family is a named metric with all of its label combinations
+type family interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds the metric families served by one endpoint, in registration order
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// register adds a family to the registry
+func (r *Registry) register(f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, f)
+}
+
+// WriteTo writes every family in the text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := append([]family(nil), r.families...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range families {
+		f.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Handler serves the registry's metrics
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		_, _ = r.WriteTo(w)
+	})
+}
+
+// countingWriter counts the bytes written through it for WriteTo
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write writes p and counts it
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// vec holds the children of a family by their label values
+type vec[T any] struct {
+	name   string
+	help   string
+	labels []string
+	newT   func() *T
+
+	mu       sync.Mutex
+	children map[string]*child[T]
+}
+
+// child is one label combination of a family
+type child[T any] struct {
+	values []string
+	metric *T
+}
+
+// with returns the child for the given label values, creating it on first use
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("prom: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.children[key]
+	if !ok {
+		c = &child[T]{values: append([]string(nil), values...), metric: v.newT()}
+		v.children[key] = c
+	}
+	return c.metric
+}
+
+// sorted returns the children ordered by label values
+func (v *vec[T]) sorted() []*child[T] {
+	v.mu.Lock()
+	children := make([]*child[T], 0, len(v.children))
+	for _, c := range v.children {
+		children = append(children, c)
+	}
+	v.mu.Unlock()
+	sort.Slice(children, func(i, j int) bool {
+		return strings.Join(children[i].values, "\xff") < strings.Join(children[j].values, "\xff")
+	})
+	return children
+}
+
+// Counter is a monotonically increasing count
+type Counter struct {
+	n atomic.Uint64
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() {
+	c.n.Add(1)
+}
+
+// Add adds n to the counter
+func (c *Counter) Add(n uint64) {
+	c.n.Add(n)
+}
+
+// Value returns the current count
+func (c *Counter) Value() uint64 {
+	return c.n.Load()
+}
+
+// CounterVec is a counter family partitioned by labels
+type CounterVec struct {
+	vec[Counter]
+}
+
+// NewCounterVec registers a counter family with the given label names
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{vec[Counter]{name: name, help: help, labels: labels, newT: func() *Counter { return &Counter{} }, children: make(map[string]*child[Counter])}}
+	r.register(v)
+	return v
+}
+
+// With returns the counter of a label combination
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.with(values)
+}
+
+// write writes the family's samples
+func (v *CounterVec) write(w *bufio.Writer) {
+	writeHeader(w, v.name, v.help, "counter")
+	for _, c := range v.sorted() {
+		writeSample(w, v.name, v.labels, c.values, "", "", float64(c.metric.Value()))
+	}
+}
+
+// GaugeFunc is a gauge family whose samples are computed at every scrape
+type GaugeFunc struct {
+	name    string
+	help    string
+	labels  []string
+	collect func(emit func(value float64, labelValues ...string))
+}
+
+// NewGaugeFunc registers a gauge family; collect calls emit once per label combination
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, labels: labels, collect: collect}
+	r.register(g)
+	return g
+}
+
+// write writes the family's samples
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	g.collect(func(value float64, values ...string) {
+		if len(values) != len(g.labels) {
+			panic(fmt.Sprintf("prom: %s expects %d label values, got %d", g.name, len(g.labels), len(values)))
+		}
+		writeSample(w, g.name, g.labels, values, "", "", value)
+	})
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	upper []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Observe records one observation
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upper, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// snapshot returns the cumulative bucket counts, the total count and the sum
+func (h *Histogram) snapshot() ([]uint64, uint64, float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cumulative := make([]uint64, len(h.counts))
+	var n uint64
+	for i, c := range h.counts {
+		n += c
+		cumulative[i] = n
+	}
+	return cumulative, h.count, h.sum
+}
+
+// HistogramVec is a histogram family partitioned by labels
+type HistogramVec struct {
+	vec[Histogram]
+	buckets []float64
+}
+
+// NewHistogramVec registers a histogram family with sorted bucket upper bounds and label names
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	upper := append([]float64(nil), buckets...)
+	sort.Float64s(upper)
+	v := &HistogramVec{buckets: upper}
+	v.vec = vec[Histogram]{name: name, help: help, labels: labels, children: make(map[string]*child[Histogram]), newT: func() *Histogram {
+		return &Histogram{upper: upper, counts: make([]uint64, len(upper))}
+	}}
+	r.register(v)
+	return v
+}
+
+// With returns the histogram of a label combination
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.with(values)
+}
+
+// write writes the family's buckets, sums and counts
+func (v *HistogramVec) write(w *bufio.Writer) {
+	writeHeader(w, v.name, v.help, "histogram")
+	for _, c := range v.sorted() {
+		cumulative, count, sum := c.metric.snapshot()
+		for i, le := range v.buckets {
+			writeSample(w, v.name+"_bucket", v.labels, c.values, "le", formatValue(le), float64(cumulative[i]))
+		}
+		writeSample(w, v.name+"_bucket", v.labels, c.values, "le", "+Inf", float64(count))
+		writeSample(w, v.name+"_sum", v.labels, c.values, "", "", sum)
+		writeSample(w, v.name+"_count", v.labels, c.values, "", "", float64(count))
+	}
+}
+
+// writeHeader writes the HELP and TYPE lines of a family
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, typ)
+}
+
+// writeSample writes one sample line; extraName and extraValue add a label such as a bucket's "le"
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraName, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", l, escapeLabel(values[i]))
+		}
+		if extraName != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatValue(value))
+	w.WriteByte('\n')
+}
+
+// formatValue formats a sample value as the exposition format expects
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// helpEscaper and labelEscaper escape HELP text and label values
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// escapeHelp escapes HELP text
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+// escapeLabel escapes a label value
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
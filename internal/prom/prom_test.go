@@ -0,0 +1,57 @@
+package prom
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWritesExpositionFormat(t *testing.T) {
+	r := NewRegistry()
+	frames := r.NewCounterVec("frames_total", "Frames read.", "role")
+	frames.With("producer").Add(3)
+	frames.With("consumer").Inc()
+	r.NewGaugeFunc("queue_depth", "Waiting messages.", []string{"topic"}, func(emit func(float64, ...string)) {
+		emit(7, `a"b\c`)
+	})
+	latency := r.NewHistogramVec("latency_seconds", "Latency.", []float64{1, 0.1}, "mode")
+	for _, v := range []float64{0.05, 0.5, 0.1, 3} {
+		latency.With("queue").Observe(v)
+	}
+
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	want := `# HELP frames_total Frames read.
+# TYPE frames_total counter
+frames_total{role="consumer"} 1
+frames_total{role="producer"} 3
+# HELP queue_depth Waiting messages.
+# TYPE queue_depth gauge
+queue_depth{topic="a\"b\\c"} 7
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{mode="queue",le="0.1"} 2
+latency_seconds_bucket{mode="queue",le="1"} 3
+latency_seconds_bucket{mode="queue",le="+Inf"} 4
+latency_seconds_sum{mode="queue"} 3.65
+latency_seconds_count{mode="queue"} 4
+`
+	if got := b.String(); got != want {
+		t.Fatalf("unexpected output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRegistryHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("up_total", "Scrapes.").With().Inc()
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "up_total 1\n") {
+		t.Fatalf("unexpected body %q", rec.Body.String())
+	}
+}
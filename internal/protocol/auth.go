@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Mechanisms for OptionAuth
+const (
+	// AuthToken sends a bearer token as the credentials
+	AuthToken = "token"
+	// AuthPlain sends a username and password laid out like a SASL PLAIN initial response
+	// (RFC 4616): "authzid NUL username NUL password", with an empty authzid
+	AuthPlain = "plain"
+)
+
+// ErrAuthenticationFailed is returned by ReadAuthResult when the broker refuses a client's credentials
+var ErrAuthenticationFailed = errors.New("authentication failed")
+
+// Credentials authenticate a client in its handshake. Response is the mechanism's initial
+// response, as in SASL; it travels base64-encoded in OptionCredentials, so it is only private on
+// connections that use TLS.
+type Credentials struct {
+	Mechanism string
+	Response  []byte
+}
+
+// TokenCredentials returns credentials for a bearer token
+func TokenCredentials(token string) Credentials {
+	return Credentials{Mechanism: AuthToken, Response: []byte(token)}
+}
+
+// PlainCredentials returns credentials for a username and password
+func PlainCredentials(username, password string) Credentials {
+	return Credentials{Mechanism: AuthPlain, Response: []byte("\x00" + username + "\x00" + password)}
+}
+
+// Plain returns the username and password of AuthPlain credentials
+func (c Credentials) Plain() (username, password string, err error) {
+	parts := bytes.Split(c.Response, []byte{0})
+	if c.Mechanism != AuthPlain || len(parts) != 3 || len(parts[1]) == 0 {
+		return "", "", fmt.Errorf("malformed %s credentials", AuthPlain)
+	}
+	return string(parts[1]), string(parts[2]), nil
+}
+
+// SetCredentials adds credentials to the handshake. Zero credentials leave it unchanged.
+func (h *Handshake) SetCredentials(c Credentials) {
+	if c.Mechanism == "" {
+		return
+	}
+	if h.Options == nil {
+		h.Options = make(map[string]string)
+	}
+	h.Options[OptionAuth] = c.Mechanism
+	h.Options[OptionCredentials] = base64.StdEncoding.EncodeToString(c.Response)
+}
+
+// Credentials returns the credentials sent in the handshake; ok is false when there are none
+func (h Handshake) Credentials() (c Credentials, ok bool, err error) {
+	mechanism := h.Option(OptionAuth, "")
+	if mechanism == "" {
+		return Credentials{}, false, nil
+	}
+	response, err := base64.StdEncoding.DecodeString(h.Option(OptionCredentials, ""))
+	if err != nil {
+		return Credentials{}, true, fmt.Errorf("invalid %s option: %w", OptionCredentials, err)
+	}
+	return Credentials{Mechanism: mechanism, Response: response}, true, nil
+}
+
+// ReadAuthResult reads the broker's answer to a handshake that carried credentials, and returns
+// the identity they belong to. A refusal is reported as ErrAuthenticationFailed with its reason.
+func ReadAuthResult(r io.Reader) (string, error) {
+	body, err := ReadFrame(r, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to read authentication result: %w", err)
+	}
+	f, err := DecodeTypedFrame(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read authentication result: %w", err)
+	}
+	switch f.Type {
+	case FrameAuthenticated:
+		return string(f.Body), nil
+	case FrameError:
+		return "", fmt.Errorf("%w: %s", ErrAuthenticationFailed, f.Body)
+	default:
+		return "", fmt.Errorf("unexpected %s frame in answer to credentials", f.Type)
+	}
+}
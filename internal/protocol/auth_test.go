@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// TestHandshakeCredentials tests that credentials survive the handshake line
+func TestHandshakeCredentials(t *testing.T) {
+	h := Handshake{Role: "PRODUCER", Topic: "telemetry"}
+	h.SetCredentials(PlainCredentials("csv-producer", "s3cret pass=word"))
+	parsed, err := ParseHandshake(h.String())
+	if err != nil {
+		t.Fatalf("failed to parse handshake: %v", err)
+	}
+	c, ok, err := parsed.Credentials()
+	if err != nil || !ok || c.Mechanism != AuthPlain {
+		t.Fatalf("expected plain credentials, got %+v ok=%v err=%v", c, ok, err)
+	}
+	if user, pass, err := c.Plain(); err != nil || user != "csv-producer" || pass != "s3cret pass=word" {
+		t.Errorf("unexpected username and password %q %q (err=%v)", user, pass, err)
+	}
+
+	if _, ok, err := (Handshake{Role: "PRODUCER"}).Credentials(); ok || err != nil {
+		t.Errorf("expected no credentials, got ok=%v err=%v", ok, err)
+	}
+	bad := Handshake{Role: "PRODUCER", Options: map[string]string{OptionAuth: AuthToken, OptionCredentials: "%%%"}}
+	if _, _, err := bad.Credentials(); err == nil {
+		t.Error("expected invalid base64 to be rejected")
+	}
+	if _, _, err := TokenCredentials("abc").Plain(); err == nil {
+		t.Error("expected token credentials to have no username and password")
+	}
+}
+
+// TestReadAuthResult tests reading the broker's answer to credentials
+func TestReadAuthResult(t *testing.T) {
+	var buf bytes.Buffer
+	_ = WriteFrame(&buf, EncodeTypedFrame(TypedFrame{Type: FrameAuthenticated, Body: []byte("csv-producer")}))
+	if identity, err := ReadAuthResult(&buf); err != nil || identity != "csv-producer" {
+		t.Errorf("expected csv-producer, got %q (err=%v)", identity, err)
+	}
+
+	_ = WriteFrame(&buf, EncodeTypedFrame(TypedFrame{Type: FrameError, Body: []byte("invalid credentials")}))
+	if _, err := ReadAuthResult(&buf); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("expected ErrAuthenticationFailed, got %v", err)
+	}
+
+	if _, err := ReadAuthResult(&buf); err == nil {
+		t.Error("expected a closed connection to fail")
+	}
+}
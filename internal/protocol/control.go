@@ -0,0 +1,146 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// FrameType identifies the kind of a typed frame.
+//
+// Typed frames are used on connections that negotiated them in the handshake (for example a
+// consumer that asked for manual acknowledgements). They travel inside ordinary length-prefixed
+// frames; the frame body is a 1-byte type, an 8-byte big-endian tag and the payload.
+type FrameType byte
+
+const (
+	// FrameDeliver carries a message from the broker to a consumer; Tag is the delivery tag
+	FrameDeliver FrameType = 'D'
+	// FrameAck tells the broker that the delivery identified by Tag was processed. In the other
+	// direction it confirms to a producer that its message number Tag was accepted; see EncodeConfirm.
+	FrameAck FrameType = 'A'
+	// FrameNack tells the broker that the delivery identified by Tag failed; Body holds a reason.
+	// In the other direction it tells a producer that its message number Tag was rejected.
+	FrameNack FrameType = 'N'
+	// FrameCommit tells the broker that a replaying consumer processed every message up to offset Tag
+	FrameCommit FrameType = 'C'
+	// FrameCredit grants a flow-controlled producer permission to send Tag more messages
+	FrameCredit FrameType = 'K'
+	// FrameGoAway tells a client that the broker is shutting down and is about to close the
+	// connection; Body holds a reason. The broker has read nothing from the client since, so a
+	// producer should reconnect and resend what was not confirmed.
+	FrameGoAway FrameType = 'G'
+	// FrameAuthenticated answers a handshake that carried credentials once the broker accepted
+	// them; Body holds the identity they belong to
+	FrameAuthenticated FrameType = 'O'
+	// FrameError tells a client why the broker refused its connection, which is closed right after;
+	// Body holds the reason
+	FrameError FrameType = 'E'
+)
+
+// typedHeaderSize is the size of the type byte plus the tag
+const typedHeaderSize = 1 + 8
+
+// TypedFrame is a decoded typed frame
+type TypedFrame struct {
+	Type FrameType
+	Tag  uint64
+	Body []byte
+}
+
+// String returns a readable name for the frame type
+func (t FrameType) String() string {
+	switch t {
+	case FrameDeliver:
+		return "deliver"
+	case FrameAck:
+		return "ack"
+	case FrameNack:
+		return "nack"
+	case FrameCommit:
+		return "commit"
+	case FrameCredit:
+		return "credit"
+	case FrameGoAway:
+		return "go-away"
+	case FrameAuthenticated:
+		return "authenticated"
+	case FrameError:
+		return "error"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(t))
+	}
+}
+
+// EncodeTypedFrame returns the frame body for f, ready to be passed to WriteFrame
+func EncodeTypedFrame(f TypedFrame) []byte {
+	out := make([]byte, typedHeaderSize+len(f.Body))
+	out[0] = byte(f.Type)
+	binary.BigEndian.PutUint64(out[1:typedHeaderSize], f.Tag)
+	copy(out[typedHeaderSize:], f.Body)
+	return out
+}
+
+// DecodeTypedFrame parses a frame body produced by EncodeTypedFrame.
+// The returned Body aliases body.
+func DecodeTypedFrame(body []byte) (TypedFrame, error) {
+	if len(body) < typedHeaderSize {
+		return TypedFrame{}, fmt.Errorf("typed frame too short: %d bytes", len(body))
+	}
+	return TypedFrame{
+		Type: FrameType(body[0]),
+		Tag:  binary.BigEndian.Uint64(body[1:typedHeaderSize]),
+		Body: body[typedHeaderSize:],
+	}, nil
+}
+
+// Confirm is the broker's verdict on one message sent by a producer in confirm mode
+type Confirm struct {
+	// Seq numbers the producer's messages on the connection, starting at 1
+	Seq uint64
+	// Acked is true for FrameAck and false for FrameNack
+	Acked bool
+	// MessageID is the "id" field of the message, if it had one
+	MessageID string
+	// Reason explains a rejection
+	Reason string
+}
+
+// EncodeConfirm returns the frame body for c, ready to be passed to WriteFrame. The typed frame
+// body is a 2-byte big-endian message ID length, the message ID and the reason.
+func EncodeConfirm(c Confirm) []byte {
+	id := c.MessageID
+	if len(id) > math.MaxUint16 {
+		id = id[:math.MaxUint16]
+	}
+	body := make([]byte, 2+len(id)+len(c.Reason))
+	binary.BigEndian.PutUint16(body, uint16(len(id)))
+	copy(body[2:], id)
+	copy(body[2+len(id):], c.Reason)
+
+	typ := FrameNack
+	if c.Acked {
+		typ = FrameAck
+	}
+	return EncodeTypedFrame(TypedFrame{Type: typ, Tag: c.Seq, Body: body})
+}
+
+// DecodeConfirm parses a typed frame produced by EncodeConfirm
+func DecodeConfirm(f TypedFrame) (Confirm, error) {
+	if f.Type != FrameAck && f.Type != FrameNack {
+		return Confirm{}, fmt.Errorf("not a confirm frame: %s", f.Type)
+	}
+	if len(f.Body) < 2 {
+		return Confirm{}, fmt.Errorf("confirm frame too short: %d bytes", len(f.Body))
+	}
+	n := int(binary.BigEndian.Uint16(f.Body))
+	if len(f.Body) < 2+n {
+		return Confirm{}, fmt.Errorf("confirm frame message ID truncated")
+	}
+	return Confirm{
+		Seq:       f.Tag,
+		Acked:     f.Type == FrameAck,
+		MessageID: string(f.Body[2 : 2+n]),
+		Reason:    string(f.Body[2+n:]),
+	}, nil
+}
@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestTypedFrameRoundTrip tests encoding and decoding typed frames through the framing layer
+func TestTypedFrameRoundTrip(t *testing.T) {
+	in := TypedFrame{Type: FrameDeliver, Tag: 42, Body: []byte("payload")}
+
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, EncodeTypedFrame(in)); err != nil {
+		t.Fatalf("WriteFrame failed: %v", err)
+	}
+	body, err := ReadFrame(&buf, nil)
+	if err != nil {
+		t.Fatalf("ReadFrame failed: %v", err)
+	}
+
+	out, err := DecodeTypedFrame(body)
+	if err != nil {
+		t.Fatalf("DecodeTypedFrame failed: %v", err)
+	}
+	if out.Type != in.Type || out.Tag != in.Tag || !bytes.Equal(out.Body, in.Body) {
+		t.Errorf("round trip mismatch: got %+v, expected %+v", out, in)
+	}
+}
+
+// TestDecodeTypedFrameTooShort tests that truncated typed frames are rejected
+func TestDecodeTypedFrameTooShort(t *testing.T) {
+	if _, err := DecodeTypedFrame([]byte{byte(FrameAck), 0, 0}); err == nil {
+		t.Error("expected error for truncated typed frame")
+	}
+}
+
+// TestFrameTypeString tests readable frame type names
+func TestFrameTypeString(t *testing.T) {
+	if FrameAck.String() != "ack" || FrameNack.String() != "nack" || FrameDeliver.String() != "deliver" || FrameCommit.String() != "commit" || FrameCredit.String() != "credit" || FrameGoAway.String() != "go-away" ||
+		FrameAuthenticated.String() != "authenticated" || FrameError.String() != "error" {
+		t.Error("unexpected frame type names")
+	}
+	if FrameType(0).String() != "unknown(0)" {
+		t.Errorf("unexpected unknown frame type name: %s", FrameType(0).String())
+	}
+}
+
+// TestConfirmRoundTrip tests encoding and decoding producer confirms
+func TestConfirmRoundTrip(t *testing.T) {
+	for _, in := range []Confirm{
+		{Seq: 1, Acked: true, MessageID: "a1b2"},
+		{Seq: 7, MessageID: "c3d4", Reason: "queue full"},
+		{Seq: 9, Reason: "no id"},
+	} {
+		f, err := DecodeTypedFrame(EncodeConfirm(in))
+		if err != nil {
+			t.Fatalf("DecodeTypedFrame failed: %v", err)
+		}
+		out, err := DecodeConfirm(f)
+		if err != nil {
+			t.Fatalf("DecodeConfirm failed: %v", err)
+		}
+		if out != in {
+			t.Errorf("round trip mismatch: got %+v, expected %+v", out, in)
+		}
+	}
+
+	if _, err := DecodeConfirm(TypedFrame{Type: FrameAck, Body: []byte{0, 5, 'x'}}); err == nil {
+		t.Error("expected error for truncated message ID")
+	}
+	if _, err := DecodeConfirm(TypedFrame{Type: FrameCredit}); err == nil {
+		t.Error("expected error for a non-confirm frame")
+	}
+}
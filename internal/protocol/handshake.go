@@ -0,0 +1,182 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Handshake is the first line a client sends after connecting: "<ROLE> [topic] [key=value ...]\n".
+// A bare role line (no topic, no options) is accepted for backwards compatibility. Values that
+// contain spaces or quotes are written as Go double-quoted strings, e.g. filter="type == \"alert\"".
+type Handshake struct {
+	Role    string
+	Topic   string
+	Options map[string]string
+}
+
+// Handshake option keys understood by the broker
+const (
+	// OptionAck selects the acknowledgement mode of a consumer: AckAuto (default) or AckManual
+	OptionAck = "ack"
+	// OptionPrefetch bounds the number of unacknowledged deliveries a consumer may hold
+	OptionPrefetch = "prefetch"
+	// OptionGroup names the consumer group a consumer joins; each group receives every message once
+	OptionGroup = "group"
+	// OptionFrom makes a consumer replay retained messages: FromEarliest, FromLatest, an offset or an RFC 3339 time
+	OptionFrom = "from"
+	// OptionConsumerID names a replaying consumer whose committed offset the broker remembers
+	OptionConsumerID = "id"
+	// OptionSlowConsumer selects what happens when a broadcast consumer falls behind:
+	// drop-newest, drop-oldest, block or disconnect
+	OptionSlowConsumer = "slow"
+	// OptionBlockTimeout is how many milliseconds the block policy waits for room
+	OptionBlockTimeout = "block_timeout_ms"
+	// OptionFlow selects a producer's flow control: FlowCredit, or none when unset
+	OptionFlow = "flow"
+	// OptionConfirm set to "true" makes the broker confirm every message of a producer with an
+	// ack or nack frame (see EncodeConfirm)
+	OptionConfirm = "confirm"
+	// OptionFilter is an expression a message must match to be delivered to a consumer
+	// (see the filter package)
+	OptionFilter = "filter"
+	// OptionAuth names the mechanism of the credentials a client authenticates with: AuthToken or
+	// AuthPlain (see Credentials)
+	OptionAuth = "auth"
+	// OptionCredentials holds the base64-encoded credentials of OptionAuth's mechanism
+	OptionCredentials = "credentials"
+)
+
+// Values for OptionAck
+const (
+	AckAuto   = "auto"
+	AckManual = "manual"
+)
+
+// Values for OptionFlow
+const (
+	// FlowCredit makes the broker grant credits with FrameCredit; the producer sends one message per credit
+	FlowCredit = "credit"
+)
+
+// Named positions for OptionFrom
+const (
+	FromEarliest = "earliest"
+	FromLatest   = "latest"
+)
+
+// ParseHandshake parses a handshake line. Trailing line endings are ignored.
+func ParseHandshake(line string) (Handshake, error) {
+	fields, err := splitFields(line)
+	if err != nil {
+		return Handshake{}, err
+	}
+	if len(fields) == 0 {
+		return Handshake{}, fmt.Errorf("empty handshake")
+	}
+
+	h := Handshake{Role: fields[0]}
+	rest := fields[1:]
+	if len(rest) > 0 && !strings.Contains(rest[0], "=") {
+		h.Topic = rest[0]
+		rest = rest[1:]
+	}
+	for _, field := range rest {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key == "" {
+			return Handshake{}, fmt.Errorf("unexpected handshake field: %q", field)
+		}
+		if h.Options == nil {
+			h.Options = make(map[string]string)
+		}
+		h.Options[key] = value
+	}
+	return h, nil
+}
+
+// splitFields splits a handshake line on whitespace. A double-quoted section is part of the field
+// it appears in, even if it contains spaces, and is unquoted with Go string literal rules.
+func splitFields(line string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	inField := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '"':
+			end := i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return nil, fmt.Errorf("unterminated quoted value in handshake")
+			}
+			s, err := strconv.Unquote(line[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted value in handshake: %w", err)
+			}
+			field.WriteString(s)
+			inField = true
+			i = end
+		case unicode.IsSpace(rune(c)):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteByte(c)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+// quoteValue quotes an option value if it would not survive splitFields as is
+func quoteValue(v string) string {
+	if strings.ContainsFunc(v, func(r rune) bool { return r == '"' || unicode.IsSpace(r) }) {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// Option returns the value of a handshake option, or defaultValue when it is not set
+func (h Handshake) Option(key, defaultValue string) string {
+	if v, ok := h.Options[key]; ok && v != "" {
+		return v
+	}
+	return defaultValue
+}
+
+// String encodes the handshake as a newline-terminated line ready to be written to a connection.
+// Options are written in key order so the encoding is deterministic.
+func (h Handshake) String() string {
+	var sb strings.Builder
+	sb.WriteString(h.Role)
+	if h.Topic != "" {
+		sb.WriteString(" ")
+		sb.WriteString(h.Topic)
+	}
+
+	keys := make([]string, 0, len(h.Options))
+	for k := range h.Options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		sb.WriteString(" ")
+		sb.WriteString(k)
+		sb.WriteString("=")
+		sb.WriteString(quoteValue(h.Options[k]))
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
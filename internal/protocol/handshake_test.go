@@ -0,0 +1,99 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestParseHandshake tests parsing of role lines with and without topics
+func TestParseHandshake(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    Handshake
+		wantErr bool
+	}{
+		{"PRODUCER", Handshake{Role: "PRODUCER"}, false},
+		{"CONSUMER telemetry", Handshake{Role: "CONSUMER", Topic: "telemetry"}, false},
+		{"PRODUCER alerts\r\n", Handshake{Role: "PRODUCER", Topic: "alerts"}, false},
+		{"CONSUMER storage ack=manual prefetch=10", Handshake{Role: "CONSUMER", Topic: "storage", Options: map[string]string{"ack": "manual", "prefetch": "10"}}, false},
+		{"CONSUMER ack=manual", Handshake{Role: "CONSUMER", Options: map[string]string{"ack": "manual"}}, false},
+		{"", Handshake{}, true},
+		{"CONSUMER a b", Handshake{}, true},
+		{"CONSUMER a =x", Handshake{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseHandshake(tt.line)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseHandshake(%q) expected error", tt.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseHandshake(%q) returned error: %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseHandshake(%q) = %+v, expected %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+// TestHandshakeString tests that String round-trips through ParseHandshake
+func TestHandshakeString(t *testing.T) {
+	if s := (Handshake{Role: "PRODUCER"}).String(); s != "PRODUCER\n" {
+		t.Errorf("expected bare role line, got %q", s)
+	}
+
+	h := Handshake{Role: "CONSUMER", Topic: "telemetry"}
+	if s := h.String(); s != "CONSUMER telemetry\n" {
+		t.Errorf("expected topic role line, got %q", s)
+	}
+	parsed, err := ParseHandshake(h.String())
+	if err != nil || !reflect.DeepEqual(parsed, h) {
+		t.Errorf("round trip failed: %+v (err=%v)", parsed, err)
+	}
+
+	h.Options = map[string]string{OptionPrefetch: "5", OptionAck: AckManual}
+	if s := h.String(); s != "CONSUMER telemetry ack=manual prefetch=5\n" {
+		t.Errorf("expected options in key order, got %q", s)
+	}
+	parsed, err = ParseHandshake(h.String())
+	if err != nil || !reflect.DeepEqual(parsed, h) {
+		t.Errorf("round trip with options failed: %+v (err=%v)", parsed, err)
+	}
+}
+
+// TestHandshakeOption tests option lookup with defaults
+func TestHandshakeOption(t *testing.T) {
+	h := Handshake{Role: "CONSUMER", Options: map[string]string{OptionAck: AckManual}}
+	if v := h.Option(OptionAck, AckAuto); v != AckManual {
+		t.Errorf("expected %q, got %q", AckManual, v)
+	}
+	if v := h.Option(OptionPrefetch, "100"); v != "100" {
+		t.Errorf("expected default value, got %q", v)
+	}
+}
+
+// TestHandshakeQuotedValues tests that values with spaces and quotes survive a round trip
+func TestHandshakeQuotedValues(t *testing.T) {
+	h, err := ParseHandshake(`CONSUMER telemetry filter="type == \"alert\" && Hostname =~ \"mtv5-.*\"" ack=manual` + "\n")
+	if err != nil {
+		t.Fatalf("failed to parse quoted handshake: %v", err)
+	}
+	if v := h.Options[OptionFilter]; v != `type == "alert" && Hostname =~ "mtv5-.*"` {
+		t.Errorf("unexpected filter %q", v)
+	}
+	if h.Options[OptionAck] != AckManual {
+		t.Errorf("expected options after a quoted value, got %+v", h.Options)
+	}
+	parsed, err := ParseHandshake(h.String())
+	if err != nil || !reflect.DeepEqual(parsed, h) {
+		t.Errorf("round trip with quoted value failed: %+v (err=%v)", parsed, err)
+	}
+
+	if _, err := ParseHandshake(`CONSUMER telemetry filter="unterminated`); err == nil {
+		t.Error("expected an unterminated quote to be rejected")
+	}
+}
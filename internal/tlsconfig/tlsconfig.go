@@ -0,0 +1,223 @@
+// Package tlsconfig builds the TLS settings of the broker's listener and of the clients that dial
+// it. Certificates are read from PEM files and reloaded when the files change, so certificates
+// rotated on disk are picked up without a restart.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/message-streaming-app/internal/common"
+)
+
+// defaultReloadInterval is how often certificate files are checked for changes when no interval is set
+const defaultReloadInterval = 10 * time.Second
+
+// ServerOptions locates the broker's certificate and, for mutual TLS, the CAs of client certificates
+type ServerOptions struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile enables mutual TLS: clients must present a certificate signed by one of its CAs
+	ClientCAFile string
+	// ReloadInterval is how often the files are checked for changes (default 10s)
+	ReloadInterval time.Duration
+}
+
+// ClientOptions configures a client's TLS connection to the broker
+type ClientOptions struct {
+	// CAFile holds the CAs the broker's certificate is verified against; empty uses the system roots
+	CAFile string
+	// CertFile and KeyFile hold the certificate presented to a broker that requires one
+	CertFile string
+	KeyFile  string
+	// ServerName is checked against the broker's certificate instead of the dialed host
+	ServerName string
+	// ReloadInterval is how often the client certificate files are checked for changes (default 10s)
+	ReloadInterval time.Duration
+}
+
+// NewServerConfig loads the server certificate, and the client CAs if set, and returns a config
+// that reloads them when their files change. A file that fails to reload keeps the previous one in
+// use, and is retried at the next check.
+func NewServerConfig(opts ServerOptions, logger *slog.Logger) (*tls.Config, error) {
+	cert, err := newReloader(opts.ReloadInterval, logger, func() (*tls.Certificate, error) {
+		return loadKeyPair(opts.CertFile, opts.KeyFile)
+	}, opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cert.get(), nil
+		},
+	}
+	if opts.ClientCAFile == "" {
+		return cfg, nil
+	}
+
+	cas, err := newReloader(opts.ReloadInterval, logger, func() (*x509.CertPool, error) {
+		return loadCertPool(opts.ClientCAFile)
+	}, opts.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	base := cfg.Clone()
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := base.Clone()
+		c.ClientCAs = cas.get()
+		return c, nil
+	}
+	return cfg, nil
+}
+
+// NewClientConfig loads the CAs and the client certificate, if set, and returns a config that
+// reloads the client certificate when its files change
+func NewClientConfig(opts ClientOptions, logger *slog.Logger) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: opts.ServerName}
+	if opts.CAFile != "" {
+		pool, err := loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if opts.CertFile == "" && opts.KeyFile == "" {
+		return cfg, nil
+	}
+
+	cert, err := newReloader(opts.ReloadInterval, logger, func() (*tls.Certificate, error) {
+		return loadKeyPair(opts.CertFile, opts.KeyFile)
+	}, opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return cert.get(), nil
+	}
+	return cfg, nil
+}
+
+// ClientConfigFromEnv builds the client TLS config of the producer and consumer services from the
+// BROKER_TLS_* variables. It returns nil when BROKER_TLS is not "true", and clients dial in plaintext.
+func ClientConfigFromEnv(logger *slog.Logger) (*tls.Config, error) {
+	if common.GetEnv("BROKER_TLS", "false") != "true" {
+		return nil, nil
+	}
+	return NewClientConfig(ClientOptions{
+		CAFile:     common.GetEnv("BROKER_TLS_CA_FILE", ""),
+		CertFile:   common.GetEnv("BROKER_TLS_CERT_FILE", ""),
+		KeyFile:    common.GetEnv("BROKER_TLS_KEY_FILE", ""),
+		ServerName: common.GetEnv("BROKER_TLS_SERVER_NAME", ""),
+	}, logger)
+}
+
+// Dial connects to the broker at addr, over TLS if cfg is not nil
+func Dial(addr string, cfg *tls.Config) (net.Conn, error) {
+	if cfg == nil {
+		return net.Dial("tcp", addr)
+	}
+	return tls.Dial("tcp", addr, cfg)
+}
+
+// loadKeyPair loads a certificate and its private key
+func loadKeyPair(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate %s: %w", certFile, err)
+	}
+	return &cert, nil
+}
+
+// loadCertPool loads the PEM certificates of a CA file
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("failed to load CA file %s: no PEM certificates", file)
+	}
+	return pool, nil
+}
+
+// reloader holds a value loaded from files and loads it again when one of their modification
+// times changes. Files are checked at most once per interval, on the handshake that needs them.
+type reloader[T any] struct {
+	files    []string
+	load     func() (T, error)
+	interval time.Duration
+	logger   *slog.Logger
+
+	mu       sync.Mutex
+	value    T
+	modTimes []time.Time
+	checked  time.Time
+}
+
+// newReloader loads the value for the first time
+func newReloader[T any](interval time.Duration, logger *slog.Logger, load func() (T, error), files ...string) (*reloader[T], error) {
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	r := &reloader[T]{files: files, load: load, interval: interval, logger: logger}
+	modTimes, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	if r.value, err = load(); err != nil {
+		return nil, err
+	}
+	r.modTimes, r.checked = modTimes, time.Now()
+	return r, nil
+}
+
+// get returns the current value, reloading it first if the files changed
+func (r *reloader[T]) get() T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) < r.interval {
+		return r.value
+	}
+	r.checked = time.Now()
+
+	modTimes, err := r.stat()
+	if err != nil {
+		r.logger.Warn("failed to check TLS files, keeping the loaded ones", "files", r.files, "error", err)
+		return r.value
+	}
+	if slices.EqualFunc(modTimes, r.modTimes, time.Time.Equal) {
+		return r.value
+	}
+	// A certificate and key replaced one after the other may not match yet; the next check retries
+	value, err := r.load()
+	if err != nil {
+		r.logger.Warn("failed to reload TLS files, keeping the loaded ones", "files", r.files, "error", err)
+		return r.value
+	}
+	r.value, r.modTimes = value, modTimes
+	r.logger.Info("reloaded TLS files", "files", r.files)
+	return r.value
+}
+
+// stat returns the modification times of the files
+func (r *reloader[T]) stat() ([]time.Time, error) {
+	modTimes := make([]time.Time, len(r.files))
+	for i, f := range r.files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat TLS file: %w", err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
@@ -0,0 +1,243 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA signs certificates for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCA creates a self-signed CA
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create CA: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate for name signed by the CA, and its key, to dir
+func (ca *testCA) issue(t *testing.T, dir, name string, usage x509.ExtKeyUsage) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return certFile, keyFile
+}
+
+// writeFile writes a file and moves its modification time forward, so a rewrite within the
+// file system's timestamp resolution is still seen as a change
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	var mtime time.Time
+	if info, err := os.Stat(path); err == nil {
+		mtime = info.ModTime().Add(time.Second)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+	if !mtime.IsZero() {
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatalf("chtimes %s: %v", path, err)
+		}
+	}
+}
+
+// serveTLS accepts TLS connections and echoes one byte on each
+func serveTLS(t *testing.T, cfg *tls.Config) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b := make([]byte, 1)
+				if _, err := io.ReadFull(conn, b); err == nil {
+					_, _ = conn.Write(b)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// roundTrip dials addr, sends a byte and waits for the echo; it returns the broker's certificate name
+func roundTrip(addr string, cfg *tls.Config) (string, error) {
+	conn, err := Dial(addr, cfg)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte{1}); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+		return "", err
+	}
+	return conn.(*tls.Conn).ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+}
+
+func TestMutualTLS(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.crt")
+	writeFile(t, caFile, ca.pem)
+	serverCert, serverKey := ca.issue(t, dir, "broker", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, dir, "producer", x509.ExtKeyUsageClientAuth)
+
+	serverCfg, err := NewServerConfig(ServerOptions{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: caFile}, logger)
+	if err != nil {
+		t.Fatalf("NewServerConfig: %v", err)
+	}
+	addr := serveTLS(t, serverCfg)
+
+	clientCfg, err := NewClientConfig(ClientOptions{CAFile: caFile, CertFile: clientCert, KeyFile: clientKey}, logger)
+	if err != nil {
+		t.Fatalf("NewClientConfig: %v", err)
+	}
+	if name, err := roundTrip(addr, clientCfg); err != nil || name != "broker" {
+		t.Fatalf("expected a verified connection to broker, got %q (err=%v)", name, err)
+	}
+
+	// Without a client certificate the broker ends the handshake
+	anonymous, err := NewClientConfig(ClientOptions{CAFile: caFile}, logger)
+	if err != nil {
+		t.Fatalf("NewClientConfig: %v", err)
+	}
+	if _, err := roundTrip(addr, anonymous); err == nil {
+		t.Fatal("expected a client without certificate to be rejected")
+	}
+
+	// A client that does not trust the broker's CA refuses it
+	if _, err := roundTrip(addr, &tls.Config{MinVersion: tls.VersionTLS12}); err == nil {
+		t.Fatal("expected an unknown broker certificate to be refused")
+	}
+}
+
+func TestServerCertificateReload(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.crt")
+	writeFile(t, caFile, ca.pem)
+	certFile, keyFile := ca.issue(t, dir, "broker", x509.ExtKeyUsageServerAuth)
+
+	serverCfg, err := NewServerConfig(ServerOptions{CertFile: certFile, KeyFile: keyFile, ReloadInterval: time.Millisecond}, logger)
+	if err != nil {
+		t.Fatalf("NewServerConfig: %v", err)
+	}
+	addr := serveTLS(t, serverCfg)
+	clientCfg, err := NewClientConfig(ClientOptions{CAFile: caFile, ServerName: "localhost"}, logger)
+	if err != nil {
+		t.Fatalf("NewClientConfig: %v", err)
+	}
+	if name, err := roundTrip(addr, clientCfg); err != nil || name != "broker" {
+		t.Fatalf("expected broker, got %q (err=%v)", name, err)
+	}
+
+	// A broken certificate file keeps the loaded certificate in use
+	writeFile(t, certFile, []byte("not a certificate"))
+	time.Sleep(5 * time.Millisecond)
+	if name, err := roundTrip(addr, clientCfg); err != nil || name != "broker" {
+		t.Fatalf("expected the previous certificate, got %q (err=%v)", name, err)
+	}
+
+	// A rotated certificate is served from the next handshake on
+	rotatedCert, rotatedKey := ca.issue(t, dir, "broker-rotated", x509.ExtKeyUsageServerAuth)
+	for src, dst := range map[string]string{rotatedCert: certFile, rotatedKey: keyFile} {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatalf("read %s: %v", src, err)
+		}
+		writeFile(t, dst, data)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if name, err := roundTrip(addr, clientCfg); err != nil || name != "broker-rotated" {
+		t.Fatalf("expected the rotated certificate, got %q (err=%v)", name, err)
+	}
+}
+
+func TestNewServerConfigErrors(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, dir, "broker", x509.ExtKeyUsageServerAuth)
+	notPEM := filepath.Join(dir, "empty.crt")
+	writeFile(t, notPEM, []byte("nothing here"))
+
+	for name, opts := range map[string]ServerOptions{
+		"missing certificate": {CertFile: filepath.Join(dir, "missing.crt"), KeyFile: keyFile},
+		"invalid certificate": {CertFile: notPEM, KeyFile: keyFile},
+		"invalid client CAs":  {CertFile: certFile, KeyFile: keyFile, ClientCAFile: notPEM},
+	} {
+		if _, err := NewServerConfig(opts, logger); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}